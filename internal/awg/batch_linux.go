@@ -65,14 +65,36 @@ func sockaddrToAddrPort(sa *sockaddrIn) netip.AddrPort {
 
 // batchState holds pre-allocated buffers for batch I/O on one direction.
 type batchState struct {
-	bufs   [batchSize][bufSize + 256]byte // extra room for S4 prefix
+	bufs   [batchSize][]byte
 	iovecs [batchSize]iovec
 	msgs   [batchSize]mmsghdr
 	addrs  [batchSize]sockaddrIn
+	size   int // messages in use: batchSize, or gsoBatchSize with offload
+
+	// Send queue (see queue): count messages holding pkts packets of bytes
+	// in total; message k holds segs[k] packets, lens[k] bytes.
+	count, pkts, bytes int
+	segs, lens, seg    [batchSize]int // seg[k]: segment size of a GSO run
+
+	// UDP offload (gso_linux.go).
+	gro  bool                 // received messages may hold several packets
+	gso  bool                 // queued packets of equal size are coalesced
+	ctrl [batchSize][3]uint64 // UDP_GRO / UDP_SEGMENT control messages
+}
+
+// newBatchState allocates a batchState with size-byte packet buffers.
+func newBatchState(size int) *batchState {
+	bs := new(batchState)
+	bs.size = batchSize
+	mem := make([]byte, batchSize*size)
+	for i := range bs.bufs {
+		bs.bufs[i] = mem[i*size : (i+1)*size : (i+1)*size]
+	}
+	return bs
 }
 
 func (bs *batchState) initRecv(needAddr bool) {
-	for i := range bs.msgs {
+	for i := range bs.size {
 		bs.iovecs[i].Base = &bs.bufs[i][0]
 		setIovecLen(&bs.iovecs[i], uint64(len(bs.bufs[i])))
 		bs.msgs[i].Hdr.Iov = &bs.iovecs[i]
@@ -85,7 +107,7 @@ func (bs *batchState) initRecv(needAddr bool) {
 }
 
 func (bs *batchState) initSend(needAddr bool) {
-	for i := range bs.msgs {
+	for i := range bs.size {
 		bs.iovecs[i].Base = &bs.bufs[i][0]
 		bs.msgs[i].Hdr.Iov = &bs.iovecs[i]
 		setIovlen(&bs.msgs[i].Hdr, 1)
@@ -103,12 +125,15 @@ func recvBatch(raw syscall.RawConn, bs *batchState) (int, error) {
 		sysErr error
 	)
 
+	if bs.gro {
+		bs.resetControl()
+	}
 	err := raw.Read(func(fd uintptr) bool {
 		r, _, errno := syscall.Syscall6(
 			sysRecvmmsg,
 			fd,
 			uintptr(unsafe.Pointer(&bs.msgs[0])),
-			uintptr(batchSize),
+			uintptr(bs.size),
 			uintptr(msgWaitfirst),
 			0, 0,
 		)
@@ -133,12 +158,20 @@ func recvBatch(raw syscall.RawConn, bs *batchState) (int, error) {
 }
 
 // sendBatch calls sendmmsg via RawConn with retry for partial sends.
+// A packet rejected with EMSGSIZE is skipped and the rest of the batch is
+// still sent; the returned error is then EMSGSIZE and the count excludes the
+// skipped packets (their msgs[i].Len is left 0, see sentBytes).
 func sendBatch(raw syscall.RawConn, bs *batchState, count int) (int, error) {
 	if count <= 0 {
 		return 0, nil
 	}
+	for i := 0; i < count; i++ {
+		bs.msgs[i].Len = 0
+	}
 
 	total := 0
+	sent := 0
+	var tooBig error
 	for total < count {
 		var (
 			n      int
@@ -164,49 +197,244 @@ func sendBatch(raw syscall.RawConn, bs *batchState, count int) (int, error) {
 			return true
 		})
 
+		if sysErr == syscall.EMSGSIZE {
+			tooBig = sysErr
+			total++ // skip the oversized packet
+			continue
+		}
 		if sysErr != nil {
-			return total, sysErr
+			return sent, sysErr
 		}
 		if err != nil {
-			return total, err
+			return sent, err
 		}
 		total += n
+		sent += n
+	}
+	return sent, tooBig
+}
+
+// sentBytes returns the bytes sent by the last sendBatch of count packets.
+func (bs *batchState) sentBytes(count int) int {
+	total := 0
+	for i := 0; i < count; i++ {
+		total += int(bs.msgs[i].Len)
+	}
+	return total
+}
+
+// sentPackets returns the packets sent by the last sendBatch of the queue.
+func (bs *batchState) sentPackets() int {
+	total := 0
+	for i := 0; i < bs.count; i++ {
+		if bs.msgs[i].Len > 0 {
+			total += bs.segs[i]
+		}
+	}
+	return total
+}
+
+// unsentPackets returns the queued packets the last sendBatch skipped, split
+// into packets sent on their own and packets of coalesced GSO messages.
+func (bs *batchState) unsentPackets() (single, coalesced int) {
+	for i := 0; i < bs.count; i++ {
+		switch {
+		case bs.msgs[i].Len > 0:
+		case bs.segs[i] == 1:
+			single++
+		default:
+			coalesced += bs.segs[i]
+		}
+	}
+	return single, coalesced
+}
+
+// eachSent calls fn for every queued packet the last sendBatch handed to the
+// kernel, with the address it was queued for.
+func (bs *batchState) eachSent(fn func(pkt []byte, addr netip.AddrPort)) {
+	for k := 0; k < bs.count; k++ {
+		if bs.msgs[k].Len == 0 {
+			continue
+		}
+		var addr netip.AddrPort
+		if bs.msgs[k].Hdr.Name != nil {
+			addr = sockaddrToAddrPort(&bs.addrs[k])
+		}
+		buf := bs.bufs[k][:bs.lens[k]]
+		for off := 0; off < len(buf); off += bs.seg[k] {
+			fn(buf[off:min(off+bs.seg[k], len(buf))], addr)
+		}
 	}
-	return total, nil
 }
 
-// sendSingle sends a single packet via sendmmsg (count=1).
+// queue appends out to the send queue, addressed to addr or, if addr is nil,
+// over a connected socket. With GSO it may join the previous packet's
+// message, so all packets queued between resets must go to the same
+// address. It returns false if the queue is full; the caller then sends it
+// with sendBatch, resets it and queues out again.
+func (bs *batchState) queue(out []byte, addr *netip.AddrPort) bool {
+	if !bs.coalesce(out) {
+		k := bs.count
+		if k == bs.size {
+			return false
+		}
+		copy(bs.bufs[k], out)
+		bs.iovecs[k].Base = &bs.bufs[k][0]
+		setIovecLen(&bs.iovecs[k], uint64(len(out)))
+		hdr := &bs.msgs[k].Hdr
+		hdr.Iov = &bs.iovecs[k]
+		setIovlen(hdr, 1)
+		if addr != nil {
+			addrPortToSockaddr(*addr, &bs.addrs[k])
+			hdr.Name = (*byte)(unsafe.Pointer(&bs.addrs[k]))
+			hdr.Namelen = sockaddrInSize
+		} else {
+			hdr.Name = nil
+			hdr.Namelen = 0
+		}
+		hdr.Control = nil
+		setControllen(hdr, 0)
+		bs.segs[k], bs.lens[k], bs.seg[k] = 1, len(out), len(out)
+		bs.count++
+	}
+	bs.pkts++
+	bs.bytes += len(out)
+	return true
+}
+
+// reset empties the send queue.
+func (bs *batchState) reset() {
+	bs.count, bs.pkts, bs.bytes = 0, 0, 0
+}
+
+// sendSingle sends a single packet via sendmmsg (count=1). The send queue
+// must be empty.
 func sendSingle(raw syscall.RawConn, data []byte, bs *batchState) error {
-	copy(bs.bufs[0][:len(data)], data)
-	bs.iovecs[0].Base = &bs.bufs[0][0]
-	setIovecLen(&bs.iovecs[0], uint64(len(data)))
-	bs.msgs[0].Hdr.Iov = &bs.iovecs[0]
-	setIovlen(&bs.msgs[0].Hdr, 1)
-	bs.msgs[0].Hdr.Name = nil
-	bs.msgs[0].Hdr.Namelen = 0
+	bs.queue(data, nil)
 	_, err := sendBatch(raw, bs, 1)
+	bs.reset()
 	return err
 }
 
+// queueToServer queues a packet for the server, sending the queue first if
+// it is full.
+func (p *Proxy) queueToServer(raw syscall.RawConn, conn *net.UDPConn, bs *batchState, out []byte) {
+	if !bs.queue(out, nil) {
+		p.sendToServer(raw, conn, bs)
+		bs.queue(out, nil)
+	}
+}
+
+// sendToServer sends and resets the client -> server queue.
+func (p *Proxy) sendToServer(raw syscall.RawConn, conn *net.UDPConn, bs *batchState) {
+	if bs.count == 0 {
+		return
+	}
+	defer bs.reset()
+	_, err := sendBatch(raw, bs, bs.count)
+	if p.capture != nil {
+		bs.eachSent(func(pkt []byte, _ netip.AddrPort) {
+			p.captureServerSide(captureOut, conn, pkt, "")
+		})
+	}
+	sent, sentBytes := bs.pkts, bs.bytes
+	if isMsgSizeErr(err) {
+		// Only a packet sent on its own exceeds the path MTU; a coalesced
+		// message is rejected for its total size.
+		sent, sentBytes = bs.sentPackets(), bs.sentBytes(bs.count)
+		single, coalesced := bs.unsentPackets()
+		if single > 0 {
+			p.remoteWriteErr(conn, err, single)
+		}
+		if coalesced > 0 {
+			p.logError("remote batch write: ", err.Error(), ", ", strconv.Itoa(coalesced), " coalesced packets lost")
+		}
+	} else if err != nil {
+		if isClosedErr(err) {
+			return
+		}
+		var capture func([]byte, netip.AddrPort)
+		if p.capture != nil {
+			capture = func(pkt []byte, _ netip.AddrPort) {
+				p.captureServerSide(captureOut, conn, pkt, "")
+			}
+		}
+		sent, sentBytes = bs.sentPackets(), bs.sentBytes(bs.count)
+		retried, retriedBytes := p.batchWriteErr("remote", raw, bs, err, p.cfg.maxSendSize(), false, capture)
+		sent += retried
+		sentBytes += retriedBytes
+	}
+	p.stats.pktsOut.Add(uint64(sent))
+	p.stats.bytesOut.Add(uint64(sentBytes))
+}
+
+// batchWriteErr logs a failed batch write. A failure that may be caused by
+// GSO is retried once: the unsent packets of bs are sent one per message,
+// through a plain batchState of size-byte buffers set up for sends with
+// addresses if needAddr, and passed to capture (if not nil). If the retry
+// works, GSO is off for the rest of the run and the plain state replaces
+// bs; otherwise GSO stays on and the packets are lost. It returns the
+// packets and bytes the retry sent.
+func (p *Proxy) batchWriteErr(side string, raw syscall.RawConn, bs *batchState, err error, size int, needAddr bool, capture func([]byte, netip.AddrPort)) (pkts, bytes int) {
+	if !bs.gso || !isGSOErr(err) {
+		p.logError(side, " batch write: ", err.Error())
+		return 0, 0
+	}
+	plain := newBatchState(size)
+	plain.initSend(needAddr)
+	pkts, bytes, retryErr := resendPlain(raw, bs, plain, capture)
+	if retryErr != nil && !isMsgSizeErr(retryErr) {
+		p.logError(side, " batch write: ", err.Error(), ", retry without GSO: ", retryErr.Error())
+		return pkts, bytes
+	}
+	*bs = *plain
+	bs.initSend(needAddr)
+	p.logError(side, " batch write: ", err.Error(), ", sent without GSO, UDP GSO disabled")
+	return pkts, bytes
+}
+
+// offloadStates returns the receive and send batch states for a direction:
+// with offload, UDP_GRO on recvConn and GSO towards sendConn where the
+// kernel supports them.
+func (p *Proxy) offloadStates(side string, recvConn, sendConn *net.UDPConn, recvSize, sendSize int) (recvBS, sendBS *batchState) {
+	gro := p.offload && enableGRO(recvConn)
+	gso := p.offload && gsoSupported(sendConn)
+	if p.offload {
+		LogInfo(p.cfg, side, ": UDP GRO=", strconv.FormatBool(gro), " GSO=", strconv.FormatBool(gso))
+	}
+	if gro {
+		recvBS = newOffloadBatchState(true, false)
+	} else {
+		recvBS = newBatchState(recvSize)
+	}
+	if gso {
+		sendBS = newOffloadBatchState(false, true)
+	} else {
+		sendBS = newBatchState(sendSize)
+	}
+	return recvBS, sendBS
+}
+
 // clientToServerBatch is the batch version of clientToServer.
 // For the client->server direction: listenConn is unconnected (need addr),
 // remoteConn is connected (no addr needed for send).
 func (p *Proxy) clientToServerBatch(listenConn *net.UDPConn) {
 	runtime.LockOSThread()
 
-	recvBS := new(batchState)
-	sendBS := new(batchState)
+	size := p.cfg.packetBufSize()
+	recvBS, sendBS := p.offloadStates("c->s", listenConn, p.remoteConn.Load(), size, p.cfg.maxSendSize())
 	recvBS.initRecv(true)  // need client addr from listenConn
 	sendBS.initSend(false) // remoteConn is connected, no addr needed
 
 	listenRaw, err := listenConn.SyscallConn()
 	if err != nil {
-		LogError(p.cfg, "listen syscall conn: ", err.Error())
+		p.logError("listen syscall conn: ", err.Error())
 		return
 	}
 
 	var sendRaw syscall.RawConn
 	var sendConn *net.UDPConn
+	tmpBuf := make([]byte, p.cfg.S4+size)
 
 	for {
 		nRecv, err := recvBatch(listenRaw, recvBS)
@@ -214,7 +442,7 @@ func (p *Proxy) clientToServerBatch(listenConn *net.UDPConn) {
 			if p.stopped.Load() || isClosedErr(err) {
 				return
 			}
-			LogError(p.cfg, "listen batch read: ", err.Error())
+			p.logError("listen batch read: ", err.Error())
 			continue
 		}
 		p.lastActive.Store(true)
@@ -223,18 +451,17 @@ func (p *Proxy) clientToServerBatch(listenConn *net.UDPConn) {
 		if currentRemote != sendConn {
 			sendRaw, err = currentRemote.SyscallConn()
 			if err != nil {
-				LogError(p.cfg, "remote syscall conn: ", err.Error())
+				p.logError("remote syscall conn: ", err.Error())
 				continue
 			}
 			sendConn = currentRemote
 		}
-		nSend := 0
 		prefix := p.cfg.S4
-		var tmpBuf [bufSize + 256]byte
+		at := p.tr.Load()
 
 		for i := 0; i < nRecv; i++ {
-			n := int(recvBS.msgs[i].Len)
-			if n <= 0 {
+			total := int(recvBS.msgs[i].Len)
+			if total <= 0 {
 				continue
 			}
 
@@ -244,75 +471,95 @@ func (p *Proxy) clientToServerBatch(listenConn *net.UDPConn) {
 				if cur := p.clientAddr.Load(); cur == nil || *cur != addr {
 					a := addr
 					p.clientAddr.Store(&a)
-					LogInfo(p.cfg, "client: ", addr.String())
+					p.logInfo("client: ", addr.String())
 				}
 			} else if p.clientAddr.Load() == nil {
-				LogInfo(p.cfg, "client: unexpected addr family=", strconv.Itoa(int(recvBS.addrs[i].Family)))
+				p.logInfo("client: unexpected addr family=", strconv.Itoa(int(recvBS.addrs[i].Family)))
 			}
 
-			data := recvBS.bufs[i][:n]
-
-			// Fast path: H4 identity transform (no type change, no S4 padding).
-			// Avoid tmpBuf entirely — copy directly to send buffer.
-			if p.cfg.h4NoOp && n >= WgTransportMinSize {
-				h := binary.LittleEndian.Uint32(data[:4])
-				if h == wgTransportData {
-					copy(sendBS.bufs[nSend][:n], data)
-					sendBS.iovecs[nSend].Base = &sendBS.bufs[nSend][0]
-					setIovecLen(&sendBS.iovecs[nSend], uint64(n))
-					sendBS.msgs[nSend].Hdr.Iov = &sendBS.iovecs[nSend]
-					setIovlen(&sendBS.msgs[nSend].Hdr, 1)
-					sendBS.msgs[nSend].Hdr.Name = nil
-					sendBS.msgs[nSend].Hdr.Namelen = 0
-					nSend++
-					continue
+			// With GRO the message holds several packets of seg bytes.
+			seg := recvBS.segSize(i, total)
+			for off := 0; off < total; off += seg {
+				data := recvBS.bufs[i][off:min(off+seg, total)]
+				n := len(data)
+				p.filterOutbound(data)
+
+				if p.capture != nil {
+					if ca := p.clientAddr.Load(); ca != nil {
+						p.captureClientSide(captureIn, *ca, data, "")
+					}
 				}
-			}
 
-			// For handshake packets that need junk/CPS, fall back to single sends.
-			copy(tmpBuf[prefix:prefix+n], data)
-			out, sendJunk := TransformOutbound(tmpBuf[:prefix+n], prefix, n, p.cfg)
+				// Fast path: H4 identity transform (no type change, no S4 padding).
+				// Avoid tmpBuf entirely — copy directly to send buffer.
+				if at.identity && n >= WgTransportMinSize {
+					h := binary.LittleEndian.Uint32(data[:4])
+					if h == wgTransportData {
+						p.queueToServer(sendRaw, sendConn, sendBS, data)
+						continue
+					}
+				}
 
-			if p.cfg.LogLevel >= LevelDebug {
-				LogDebug(p.cfg, "c->s batch: recv ", strconv.Itoa(n), "B, send ", strconv.Itoa(len(out)), "B, junk=", strconv.FormatBool(sendJunk))
-			}
+				// For handshake packets that need junk/CPS, fall back to single sends.
+				copy(tmpBuf[prefix:prefix+n], data)
+				out, sendJunk := at.tr.Outbound(tmpBuf[:prefix+n], prefix, n)
 
-			if sendJunk {
-				LogDebug(p.cfg, "c->s: handshake init ", strconv.Itoa(n), "B -> ", strconv.Itoa(len(out)), "B")
-				// CPS and junk need individual sends (rare, handshake only).
-				cpsPackets := GenerateCPSPackets(p.cfg.CPS, &p.cpsCounter)
-				for _, pkt := range cpsPackets {
-					sendSingle(sendRaw, pkt, sendBS)
+				if p.cfg.logLevel() >= LevelDebug {
+					LogDebug(p.cfg, "c->s batch: recv ", strconv.Itoa(n), "B, send ", strconv.Itoa(len(out)), "B, junk=", strconv.FormatBool(sendJunk))
 				}
-				junkPackets := p.generateJunk()
-				for _, junk := range junkPackets {
-					sendSingle(sendRaw, junk, sendBS)
-				}
-				// Send the transformed packet individually too.
-				sendSingle(sendRaw, out, sendBS)
-				continue
-			}
-
-			// Batch the transformed packet for sendmmsg.
-			copy(sendBS.bufs[nSend][:len(out)], out)
-			sendBS.iovecs[nSend].Base = &sendBS.bufs[nSend][0]
-			setIovecLen(&sendBS.iovecs[nSend], uint64(len(out)))
-			sendBS.msgs[nSend].Hdr.Iov = &sendBS.iovecs[nSend]
-			setIovlen(&sendBS.msgs[nSend].Hdr, 1)
-			sendBS.msgs[nSend].Hdr.Name = nil
-			sendBS.msgs[nSend].Hdr.Namelen = 0
-			nSend++
-		}
 
-		if nSend > 0 {
-			_, err := sendBatch(sendRaw, sendBS, nSend)
-			if err != nil {
-				if isClosedErr(err) {
+				var cps bool
+				var jc int
+				if sendJunk {
+					cps, jc = p.preamble(data)
+				}
+				if sendJunk && p.hsQueue != nil {
+					p.queueHandshake(sendConn, out, cps, jc)
+					continue
+				}
+				if sendJunk {
+					LogDebug(p.cfg, "c->s: handshake init ", strconv.Itoa(n), "B -> ", strconv.Itoa(len(out)), "B")
+					// Packets queued so far go first, then CPS and junk as
+					// individual sends (rare, handshake only).
+					p.sendToServer(sendRaw, sendConn, sendBS)
+					cpsPackets, junkPackets := at.tr.Prelude(cps, jc)
+					for ci, pkt := range cpsPackets {
+						if sendSingle(sendRaw, pkt, sendBS) != nil {
+							break
+						}
+						p.stats.cpsSent.Add(1)
+						if p.capture != nil {
+							p.captureServerSide(captureOut, sendConn, pkt, "cps "+strconv.Itoa(ci+1))
+						}
+					}
+					for _, junk := range junkPackets {
+						if sendSingle(sendRaw, junk, sendBS) != nil {
+							break
+						}
+						p.stats.junkSent.Add(1)
+						if p.capture != nil {
+							p.captureServerSide(captureOut, sendConn, junk, "junk")
+						}
+					}
+					// Send the transformed packet individually too.
+					if err := sendSingle(sendRaw, out, sendBS); err == nil {
+						p.stats.pktsOut.Add(1)
+						p.stats.bytesOut.Add(uint64(len(out)))
+						if p.capture != nil {
+							p.captureServerSide(captureOut, sendConn, out, "")
+						}
+					} else if !isClosedErr(err) {
+						p.remoteWriteErr(sendConn, err, 1)
+					}
 					continue
 				}
-				LogError(p.cfg, "remote batch write: ", err.Error())
+
+				// Queue the transformed packet for sendmmsg.
+				p.queueToServer(sendRaw, sendConn, sendBS, out)
 			}
 		}
+
+		p.sendToServer(sendRaw, sendConn, sendBS)
 	}
 }
 
@@ -321,26 +568,27 @@ func (p *Proxy) clientToServerBatch(listenConn *net.UDPConn) {
 func (p *Proxy) serverToClientBatch(listenConn *net.UDPConn, remoteConn *net.UDPConn, stop <-chan struct{}) {
 	runtime.LockOSThread()
 
-	recvBS := new(batchState)
-	sendBS := new(batchState)
+	size := p.cfg.packetBufSize()
+	recvBS, sendBS := p.offloadStates("s->c", remoteConn, listenConn, size, size)
 	recvBS.initRecv(false) // remoteConn is connected
 	sendBS.initSend(true)  // need client addr for listenConn sends
 
 	sendRaw, err := listenConn.SyscallConn()
 	if err != nil {
-		LogError(p.cfg, "listen syscall conn: ", err.Error())
+		p.logError("listen syscall conn: ", err.Error())
 		return
 	}
 
 	currentRemote := remoteConn
 	recvRaw, err := currentRemote.SyscallConn()
 	if err != nil {
-		LogError(p.cfg, "remote syscall conn: ", err.Error())
+		p.logError("remote syscall conn: ", err.Error())
 		return
 	}
 
 	backoff := time.Second
 	var pktCount uint8 = 255
+	var capRaw []byte // pre-transform copy for capture (TransformInbound works in place)
 
 	for {
 		nRecv, err := recvBatch(recvRaw, recvBS)
@@ -348,18 +596,22 @@ func (p *Proxy) serverToClientBatch(listenConn *net.UDPConn, remoteConn *net.UDP
 			if p.stopped.Load() {
 				return
 			}
-			LogInfo(p.cfg, "remote: ", err.Error(), ", reconnecting")
+			p.logInfo("remote: ", err.Error(), ", reconnecting")
 			newConn := p.reconnectRemote(stop, &backoff)
 			if newConn == nil {
 				return
 			}
 			currentRemote.Close()
 			currentRemote = newConn
+			p.stats.reconnects.Add(1)
 			p.remoteConn.Store(newConn)
 			setSocketBuffers(newConn, SocketBufSize)
+			if recvBS.gro {
+				enableGRO(newConn)
+			}
 			recvRaw, err = newConn.SyscallConn()
 			if err != nil {
-				LogError(p.cfg, "remote syscall conn: ", err.Error())
+				p.logError("remote syscall conn: ", err.Error())
 				return
 			}
 			p.lastActive.Store(true)
@@ -380,61 +632,124 @@ func (p *Proxy) serverToClientBatch(listenConn *net.UDPConn, remoteConn *net.UDP
 
 		clientAddr := p.clientAddr.Load()
 		if clientAddr == nil {
-			if p.cfg.LogLevel >= LevelDebug {
+			if p.cfg.logLevel() >= LevelDebug {
 				LogDebug(p.cfg, "s->c: ", strconv.Itoa(nRecv), " pkt(s) dropped, no client addr")
 			}
 			continue
 		}
 
-		// Check IPv4 for batch path.
-		if !clientAddr.Addr().Is4() {
-			// IPv6 fallback: send individually.
-			for i := 0; i < nRecv; i++ {
-				n := int(recvBS.msgs[i].Len)
-				out, valid := TransformInbound(recvBS.bufs[i][:n], n, p.cfg)
-				if valid {
-					listenConn.WriteToUDPAddrPort(out, *clientAddr)
-				}
-			}
-			continue
-		}
-
-		nSend := 0
+		// IPv6 clients are sent to individually; the batch path is IPv4 only.
+		batch := clientAddr.Addr().Is4()
+		drops := 0
 		for i := 0; i < nRecv; i++ {
-			n := int(recvBS.msgs[i].Len)
-			if n <= 0 {
+			total := int(recvBS.msgs[i].Len)
+			if total <= 0 {
 				continue
 			}
 
-			out, valid := TransformInbound(recvBS.bufs[i][:n], n, p.cfg)
-			if !valid {
-				if p.cfg.LogLevel >= LevelDebug {
-					LogDebug(p.cfg, "s->c batch: invalid/junk packet ", strconv.Itoa(n), "B, dropped")
+			// With GRO the message holds several packets of seg bytes.
+			seg := recvBS.segSize(i, total)
+			for off := 0; off < total; off += seg {
+				end := min(off+seg, total)
+				out, valid := p.inboundPacket(recvBS.bufs[i][off:end:end], currentRemote, &capRaw, clientAddr)
+				if !valid {
+					drops++
+				}
+				if out == nil {
+					continue
+				}
+				if !batch {
+					if _, err := listenConn.WriteToUDPAddrPort(out, *clientAddr); err != nil {
+						p.logError("listen write: ", err.Error())
+						continue
+					}
+					p.stats.pktsIn.Add(1)
+					p.stats.bytesIn.Add(uint64(len(out)))
+					if p.capture != nil {
+						p.captureClientSide(captureOut, *clientAddr, out, "")
+					}
+					continue
 				}
-				continue
-			}
 
-			if p.cfg.LogLevel >= LevelDebug && len(out) >= 4 && out[0] != byte(wgTransportData) {
-				LogDebug(p.cfg, "s->c: handshake ", strconv.Itoa(n), "B -> ", strconv.Itoa(len(out)), "B, forwarding to ", clientAddr.String())
+				// Queue the transformed packet for the client.
+				if !sendBS.queue(out, clientAddr) {
+					p.sendToClient(sendRaw, sendBS)
+					sendBS.queue(out, clientAddr)
+				}
 			}
+		}
 
-			// Copy transformed packet into send buffer and set up sockaddr.
-			copy(sendBS.bufs[nSend][:len(out)], out)
-			sendBS.iovecs[nSend].Base = &sendBS.bufs[nSend][0]
-			setIovecLen(&sendBS.iovecs[nSend], uint64(len(out)))
-			sendBS.msgs[nSend].Hdr.Iov = &sendBS.iovecs[nSend]
-			setIovlen(&sendBS.msgs[nSend].Hdr, 1)
-			addrPortToSockaddr(*clientAddr, &sendBS.addrs[nSend])
-			sendBS.msgs[nSend].Hdr.Name = (*byte)(unsafe.Pointer(&sendBS.addrs[nSend]))
-			sendBS.msgs[nSend].Hdr.Namelen = sockaddrInSize
-			nSend++
+		if drops > 0 {
+			p.stats.dropsIn.Add(uint64(drops))
 		}
+		p.sendToClient(sendRaw, sendBS)
+	}
+}
 
-		if nSend > 0 {
-			_, err := sendBatch(sendRaw, sendBS, nSend)
-			if err != nil {
-				LogError(p.cfg, "listen batch write: ", err.Error())
+// inboundPacket transforms a packet from the server for the client at
+// clientAddr, with the capture, diagnostics and handshake bookkeeping of the
+// batch loop. valid is false for packets the transformer drops; out is nil
+// for every packet not to be forwarded. capRaw is scratch space for the
+// pre-transform capture copy (Inbound works in place).
+func (p *Proxy) inboundPacket(pkt []byte, conn *net.UDPConn, capRaw *[]byte, clientAddr *netip.AddrPort) (out []byte, valid bool) {
+	n := len(pkt)
+	if p.capture != nil {
+		*capRaw = append((*capRaw)[:0], pkt...)
+	}
+
+	out, valid = p.transformer().Inbound(pkt, n)
+	if p.capture != nil {
+		comment := ""
+		if !valid {
+			comment = "dropped"
+		}
+		p.captureServerSide(captureIn, conn, *capRaw, comment)
+	}
+	if !valid {
+		p.recordDrop(pkt)
+		if p.cfg.logLevel() >= LevelDebug {
+			LogDebug(p.cfg, "s->c batch: invalid/junk packet ", strconv.Itoa(n), "B, dropped")
+		}
+		return nil, false
+	}
+	if !p.filterInbound(out) {
+		return nil, true
+	}
+
+	if len(out) >= 4 && out[0] == byte(wgHandshakeResponse) {
+		p.stats.lastHandshake.Store(time.Now().UnixNano())
+	}
+	if p.cfg.logLevel() >= LevelDebug && len(out) >= 4 && out[0] != byte(wgTransportData) {
+		LogDebug(p.cfg, "s->c: handshake ", strconv.Itoa(n), "B -> ", strconv.Itoa(len(out)), "B, forwarding to ", clientAddr.String())
+	}
+	return out, true
+}
+
+// sendToClient sends and resets the server -> client queue.
+func (p *Proxy) sendToClient(raw syscall.RawConn, bs *batchState) {
+	if bs.count == 0 {
+		return
+	}
+	defer bs.reset()
+	_, err := sendBatch(raw, bs, bs.count)
+	if p.capture != nil {
+		bs.eachSent(func(pkt []byte, addr netip.AddrPort) {
+			p.captureClientSide(captureOut, addr, pkt, "")
+		})
+	}
+	if err != nil {
+		var capture func([]byte, netip.AddrPort)
+		if p.capture != nil {
+			capture = func(pkt []byte, addr netip.AddrPort) {
+				p.captureClientSide(captureOut, addr, pkt, "")
 			}
 		}
+		sent, sentBytes := bs.sentPackets(), bs.sentBytes(bs.count)
+		retried, retriedBytes := p.batchWriteErr("listen", raw, bs, err, p.cfg.packetBufSize(), true, capture)
+		p.stats.pktsIn.Add(uint64(sent + retried))
+		p.stats.bytesIn.Add(uint64(sentBytes + retriedBytes))
+		return
 	}
+	p.stats.pktsIn.Add(uint64(bs.pkts))
+	p.stats.bytesIn.Add(uint64(bs.bytes))
 }
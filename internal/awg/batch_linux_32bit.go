@@ -28,3 +28,5 @@ const mmsghdrSize = unsafe.Sizeof(mmsghdr{})
 
 func setIovecLen(iov *iovec, n uint64) { iov.Len = uint32(n) }
 func setIovlen(hdr *msghdr, n uint64)  { hdr.Iovlen = uint32(n) }
+func setControllen(hdr *msghdr, n int) { hdr.Controllen = uint32(n) }
+func controllen(hdr *msghdr) int       { return int(hdr.Controllen) }
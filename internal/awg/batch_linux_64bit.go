@@ -31,3 +31,5 @@ const mmsghdrSize = unsafe.Sizeof(mmsghdr{})
 
 func setIovecLen(iov *iovec, n uint64) { iov.Len = n }
 func setIovlen(hdr *msghdr, n uint64)  { hdr.Iovlen = n }
+func setControllen(hdr *msghdr, n int) { hdr.Controllen = uint64(n) }
+func controllen(hdr *msghdr) int       { return int(hdr.Controllen) }
@@ -3,10 +3,13 @@
 package awg
 
 import (
+	"encoding/binary"
 	"net"
 	"net/netip"
+	"path/filepath"
 	"syscall"
 	"testing"
+	"time"
 )
 
 // TestRecvmmsgIPv4Family verifies that a "udp4" socket + recvmmsg
@@ -46,7 +49,7 @@ func TestRecvmmsgIPv4Family(t *testing.T) {
 		t.Fatal("syscall conn: ", err)
 	}
 
-	bs := new(batchState)
+	bs := newBatchState(bufSize)
 	bs.initRecv(true)
 
 	nRecv, err := recvBatch(raw, bs)
@@ -103,3 +106,111 @@ func TestSockaddrAddrPortRoundtrip(t *testing.T) {
 
 	t.Log("sockaddr <-> AddrPort roundtrip passed for all cases")
 }
+
+// TestSendBatchSkipsOversize checks that a packet rejected with EMSGSIZE does
+// not take the rest of the batch with it.
+func TestSendBatchSkipsOversize(t *testing.T) {
+	recv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recv.Close()
+	send, err := net.DialUDP("udp4", nil, recv.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer send.Close()
+	raw, _ := send.SyscallConn()
+
+	bs := newBatchState(70000)
+	bs.initSend(false)
+	sizes := []int{10, 70000, 20} // the middle one exceeds the UDP maximum
+	for i, n := range sizes {
+		setIovecLen(&bs.iovecs[i], uint64(n))
+	}
+
+	sent, err := sendBatch(raw, bs, len(sizes))
+	if !isMsgSizeErr(err) {
+		t.Fatalf("err = %v, want EMSGSIZE", err)
+	}
+	if sent != 2 || bs.sentBytes(len(sizes)) != 30 {
+		t.Fatalf("sent %d packets / %d bytes, want 2 / 30", sent, bs.sentBytes(len(sizes)))
+	}
+	if pkts := readPackets(recv, 500*time.Millisecond, 3); len(pkts) != 2 || len(pkts[1]) != 20 {
+		t.Fatalf("received %d packets", len(pkts))
+	}
+}
+
+// TestServerToClientBatchIPv6 checks that packets for an IPv6 client, sent
+// one by one outside the batch path, get the same capture and handshake
+// bookkeeping as IPv4 clients.
+func TestServerToClientBatchIPv6(t *testing.T) {
+	client, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skip("no IPv6 loopback: ", err)
+	}
+	defer client.Close()
+	listen, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	cfg := proxyTestConfig()
+	path := filepath.Join(t.TempDir(), "awg.pcapng")
+	c, err := OpenCapture(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockServer := startMockServer(t)
+	defer mockServer.Close()
+	remote, err := net.DialUDP("udp4", nil, mockServer.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewProxy(cfg, listen.LocalAddr().(*net.UDPAddr), mockServer.LocalAddr().(*net.UDPAddr))
+	p.SetCapture(c)
+	p.remoteConn.Store(remote)
+	clientAddr := client.LocalAddr().(*net.UDPAddr).AddrPort()
+	p.clientAddr.Store(&clientAddr)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.serverToClientBatch(listen, remote, stop)
+	}()
+
+	junk := make([]byte, WgHandshakeInitSize+cfg.S1+1)
+	resp := make([]byte, cfg.S2+WgHandshakeResponseSize)
+	binary.LittleEndian.PutUint32(resp[cfg.S2:], cfg.H2.Min)
+	remoteAddr := remote.LocalAddr().(*net.UDPAddr)
+	mockServer.WriteToUDP(junk, remoteAddr)
+	mockServer.WriteToUDP(resp, remoteAddr)
+	if pkts := readPackets(client, 2*time.Second, 1); len(pkts) != 1 || len(pkts[0]) != WgHandshakeResponseSize {
+		t.Fatalf("client got %d packets", len(pkts))
+	}
+
+	close(stop)
+	p.stopped.Store(true)
+	remote.Close()
+	<-done
+	c.Close()
+
+	if p.stats.lastHandshake.Load() == 0 {
+		t.Fatal("handshake response did not update lastHandshake")
+	}
+	if p.stats.dropsIn.Load() != 1 {
+		t.Fatalf("%d inbound drops, want 1", p.stats.dropsIn.Load())
+	}
+	var comments []string
+	for _, b := range readPcapng(t, path) {
+		if b.typ == pcapngEPB {
+			_, _, comment := epbInfo(t, b)
+			comments = append(comments, comment)
+		}
+	}
+	if len(comments) != 3 || comments[0] != "dropped" {
+		t.Fatalf("captured %q, want the dropped junk, the response and its forward", comments)
+	}
+}
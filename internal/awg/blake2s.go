@@ -2,7 +2,7 @@ package awg
 
 import "encoding/binary"
 
-// BLAKE2s (RFC 7693) for WireGuard MAC1 recomputation.
+// BLAKE2s (RFC 7693) for WireGuard MAC1/MAC2 recomputation.
 // Only BLAKE2s-256 (unkeyed) and BLAKE2s-128 (keyed MAC) are implemented.
 
 var blake2sIV = [8]uint32{
@@ -152,7 +152,13 @@ func blake2s256(data []byte) [32]byte {
 
 // blake2s128MAC computes keyed BLAKE2s with 16-byte output.
 func blake2s128MAC(key [32]byte, data []byte) [16]byte {
-	s := blake2sInit(16, key[:])
+	return blake2s128MACKey(key[:], data)
+}
+
+// blake2s128MACKey is blake2s128MAC with a key of any length up to 32 bytes
+// (MAC2 is keyed with the 16-byte cookie).
+func blake2s128MACKey(key []byte, data []byte) [16]byte {
+	s := blake2sInit(16, key)
 	s.update(data)
 	full := s.sum()
 	var out [16]byte
@@ -168,6 +174,16 @@ func computeMAC1Key(serverPub [32]byte) [32]byte {
 	return blake2s256(input[:])
 }
 
+// computeCookieKey derives the cookie reply encryption key
+// BLAKE2s-256("cookie--" || pub), pub being the public key of the peer that
+// sends the cookie reply.
+func computeCookieKey(pub [32]byte) [32]byte {
+	var input [40]byte
+	copy(input[:8], "cookie--")
+	copy(input[8:], pub[:])
+	return blake2s256(input[:])
+}
+
 // recomputeMAC1 recalculates mac1 in a handshake init packet.
 // buf must be at least 132 bytes. MAC1 is at bytes [116:132], covers [0:116].
 func recomputeMAC1(buf []byte, mac1key [32]byte) {
@@ -181,3 +197,9 @@ func recomputeMAC1Response(buf []byte, mac1key [32]byte) {
 	mac1 := blake2s128MAC(mac1key, buf[:60])
 	copy(buf[60:76], mac1[:])
 }
+
+// verifyMAC1 reports whether the MAC1 at msg[off:off+16] was computed with
+// mac1key over msg[:off] (off is 116 for inits, 60 for responses).
+func verifyMAC1(msg []byte, off int, mac1key [32]byte) bool {
+	return blake2s128MAC(mac1key, msg[:off]) == [16]byte(msg[off:off+16])
+}
@@ -235,3 +235,41 @@ func TestBLAKE2s256IncrementalUpdate(t *testing.T) {
 		t.Fatalf("incremental vs reference:\n  got  %x\n  want %x", got1, want)
 	}
 }
+
+func TestBLAKE2s128KeyedCookie(t *testing.T) {
+	// MAC2 is keyed with a 16-byte cookie.
+	cookie := []byte("0123456789abcdef")
+	data := make([]byte, 132)
+	for i := range data {
+		data[i] = byte(i * 3)
+	}
+
+	got := blake2s128MACKey(cookie, data)
+
+	ref, _ := blake2s.New128(cookie)
+	ref.Write(data)
+	want := ref.Sum(nil)
+
+	if string(got[:]) != string(want) {
+		t.Fatalf("BLAKE2s-128 16-byte key:\n  got  %x\n  want %x", got, want)
+	}
+}
+
+func TestComputeCookieKey(t *testing.T) {
+	var pub [32]byte
+	for i := range pub {
+		pub[i] = byte(0xf0 - i)
+	}
+
+	got := computeCookieKey(pub)
+
+	ref, _ := blake2s.New256(nil)
+	ref.Write([]byte("cookie--"))
+	ref.Write(pub[:])
+	var want [32]byte
+	copy(want[:], ref.Sum(nil))
+
+	if got != want {
+		t.Fatalf("computeCookieKey:\n  got  %x\n  want %x", got, want)
+	}
+}
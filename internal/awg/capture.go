@@ -0,0 +1,242 @@
+package awg
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Packet capture in pcapng format (opt-in via AWG_CAPTURE).
+//
+// Two interfaces are written to each file: "client" carries packets in
+// WireGuard form (between the router and the proxy), "server" carries packets
+// in AmneziaWG form (between the proxy and the AWG server). Payloads are
+// wrapped in synthetic IPv4+UDP headers (LINKTYPE_RAW) so Wireshark applies its
+// UDP dissectors. Junk and CPS packets are marked with an opt_comment.
+
+// Capture interface IDs.
+const (
+	captureClient uint32 = 0 // WireGuard side
+	captureServer uint32 = 1 // AmneziaWG side
+)
+
+// Capture packet directions (epb_flags inbound/outbound bits), relative to the proxy.
+const (
+	captureIn  uint32 = 1
+	captureOut uint32 = 2
+)
+
+const (
+	pcapngSHB = 0x0A0D0D0A
+	pcapngIDB = 0x00000001
+	pcapngEPB = 0x00000006
+
+	linktypeRaw = 101
+
+	defaultCaptureSize  = 10 * 1024 * 1024
+	defaultCaptureFiles = 3
+)
+
+// Capture writes packets to a size-rotated pcapng file. Safe for concurrent use.
+type Capture struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64 // rotate when the current file would exceed this size
+	files   int   // number of rotated files kept (path.1 ... path.N)
+	f       *os.File
+	size    int64
+	buf     []byte // reusable block buffer
+}
+
+// OpenCapture creates (truncates) the capture file at path. maxSize <= 0 and
+// files <= 0 select the defaults (10 MB, 3 rotated files).
+func OpenCapture(path string, maxSize int64, files int) (*Capture, error) {
+	if maxSize <= 0 {
+		maxSize = defaultCaptureSize
+	}
+	if files <= 0 {
+		files = defaultCaptureFiles
+	}
+	c := &Capture{path: path, maxSize: maxSize, files: files, buf: make([]byte, 0, 2048)}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close flushes and closes the current capture file.
+func (c *Capture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return nil
+	}
+	err := c.f.Close()
+	c.f = nil
+	return err
+}
+
+func (c *Capture) open() error {
+	f, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	c.f = f
+	c.size = 0
+	hdr := appendSHB(nil)
+	hdr = appendIDB(hdr, "client", "WireGuard side (router <-> proxy)")
+	hdr = appendIDB(hdr, "server", "AmneziaWG side (proxy <-> server)")
+	n, err := f.Write(hdr)
+	c.size += int64(n)
+	return err
+}
+
+// rotate shifts path.N-1 -> path.N ... path -> path.1 and opens a fresh file.
+func (c *Capture) rotate() error {
+	c.f.Close()
+	c.f = nil
+	for i := c.files - 1; i >= 1; i-- {
+		os.Rename(c.path+"."+strconv.Itoa(i), c.path+"."+strconv.Itoa(i+1))
+	}
+	os.Rename(c.path, c.path+".1")
+	return c.open()
+}
+
+// record writes one packet. src/dst are used for the synthetic IPv4/UDP header;
+// non-IPv4 addresses are written as 0.0.0.0.
+func (c *Capture) record(iface, dir uint32, src, dst netip.AddrPort, payload []byte, comment string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return
+	}
+	c.buf = appendEPB(c.buf[:0], iface, dir, time.Now(), src, dst, payload, comment)
+	if c.size > 0 && c.size+int64(len(c.buf)) > c.maxSize {
+		if err := c.rotate(); err != nil {
+			c.f = nil
+			return
+		}
+	}
+	n, err := c.f.Write(c.buf)
+	c.size += int64(n)
+	if err != nil {
+		c.f.Close()
+		c.f = nil
+	}
+}
+
+func appendU16(b []byte, v uint16) []byte { return binary.LittleEndian.AppendUint16(b, v) }
+func appendU32(b []byte, v uint32) []byte { return binary.LittleEndian.AppendUint32(b, v) }
+
+// appendOption appends a pcapng option padded to 32 bits.
+func appendOption(b []byte, code uint16, val []byte) []byte {
+	b = appendU16(b, code)
+	b = appendU16(b, uint16(len(val)))
+	b = append(b, val...)
+	for len(b)%4 != 0 { // blocks always start 32-bit aligned
+		b = append(b, 0)
+	}
+	return b
+}
+
+// finishBlock fills in the block total length at start and appends the trailing copy.
+func finishBlock(b []byte, start int) []byte {
+	total := uint32(len(b) - start + 4)
+	binary.LittleEndian.PutUint32(b[start+4:], total)
+	return appendU32(b, total)
+}
+
+func appendSHB(b []byte) []byte {
+	start := len(b)
+	b = appendU32(b, pcapngSHB)
+	b = appendU32(b, 0) // total length, patched
+	b = appendU32(b, 0x1A2B3C4D)
+	b = appendU16(b, 1) // major
+	b = appendU16(b, 0) // minor
+	b = binary.LittleEndian.AppendUint64(b, ^uint64(0))
+	b = appendOption(b, 4, []byte("awg-proxy")) // shb_userappl
+	b = appendU32(b, 0)                         // opt_endofopt
+	return finishBlock(b, start)
+}
+
+func appendIDB(b []byte, name, desc string) []byte {
+	start := len(b)
+	b = appendU32(b, pcapngIDB)
+	b = appendU32(b, 0)
+	b = appendU16(b, linktypeRaw)
+	b = appendU16(b, 0)
+	b = appendU32(b, 0)                  // snaplen: unlimited
+	b = appendOption(b, 2, []byte(name)) // if_name
+	b = appendOption(b, 3, []byte(desc)) // if_description
+	b = appendOption(b, 9, []byte{9})    // if_tsresol: nanoseconds
+	b = appendU32(b, 0)
+	return finishBlock(b, start)
+}
+
+func appendEPB(b []byte, iface, dir uint32, ts time.Time, src, dst netip.AddrPort, payload []byte, comment string) []byte {
+	const hdrLen = 28 // IPv4 (20) + UDP (8)
+	start := len(b)
+	ns := uint64(ts.UnixNano())
+	pktLen := uint32(hdrLen + len(payload))
+	b = appendU32(b, pcapngEPB)
+	b = appendU32(b, 0)
+	b = appendU32(b, iface)
+	b = appendU32(b, uint32(ns>>32))
+	b = appendU32(b, uint32(ns))
+	b = appendU32(b, pktLen)
+	b = appendU32(b, pktLen)
+	b = appendIPv4UDP(b, src, dst, len(payload))
+	b = append(b, payload...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	if comment != "" {
+		b = appendOption(b, 1, []byte(comment)) // opt_comment
+	}
+	b = appendOption(b, 2, binary.LittleEndian.AppendUint32(nil, dir)) // epb_flags
+	b = appendU32(b, 0)
+	return finishBlock(b, start)
+}
+
+// appendIPv4UDP appends a synthetic IPv4 + UDP header (UDP checksum 0).
+func appendIPv4UDP(b []byte, src, dst netip.AddrPort, payloadLen int) []byte {
+	total := 28 + payloadLen
+	start := len(b)
+	b = append(b, 0x45, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(total))
+	b = append(b, 0, 0, 0x40, 0) // id, flags=DF
+	b = append(b, 64, 17, 0, 0)  // ttl, proto=UDP, checksum
+	s, d := captureAddr4(src), captureAddr4(dst)
+	b = append(b, s[:]...)
+	b = append(b, d[:]...)
+	binary.BigEndian.PutUint16(b[start+10:], ipChecksum(b[start:start+20]))
+	b = binary.BigEndian.AppendUint16(b, src.Port())
+	b = binary.BigEndian.AppendUint16(b, dst.Port())
+	b = binary.BigEndian.AppendUint16(b, uint16(8+payloadLen))
+	return append(b, 0, 0)
+}
+
+func captureAddr4(ap netip.AddrPort) [4]byte {
+	if a := ap.Addr().Unmap(); a.Is4() {
+		return a.As4()
+	}
+	return [4]byte{}
+}
+
+// ipChecksum computes the RFC 1071 Internet checksum of b.
+func ipChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
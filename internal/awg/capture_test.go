@@ -0,0 +1,245 @@
+package awg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type pcapngBlock struct {
+	typ  uint32
+	body []byte // block body without type/length fields
+}
+
+// readPcapng splits a pcapng file into blocks, validating both length fields.
+func readPcapng(t *testing.T, path string) []pcapngBlock {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blocks []pcapngBlock
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block: %d bytes left", len(data))
+		}
+		typ := binary.LittleEndian.Uint32(data[0:4])
+		total := binary.LittleEndian.Uint32(data[4:8])
+		if total%4 != 0 || int(total) > len(data) {
+			t.Fatalf("bad block length %d", total)
+		}
+		if tail := binary.LittleEndian.Uint32(data[total-4 : total]); tail != total {
+			t.Fatalf("trailing length %d != %d", tail, total)
+		}
+		blocks = append(blocks, pcapngBlock{typ: typ, body: data[8 : total-4]})
+		data = data[total:]
+	}
+	return blocks
+}
+
+// epbInfo extracts interface, payload (after the synthetic IPv4/UDP header) and comment.
+func epbInfo(t *testing.T, b pcapngBlock) (iface uint32, payload []byte, comment string) {
+	t.Helper()
+	iface = binary.LittleEndian.Uint32(b.body[0:4])
+	capLen := int(binary.LittleEndian.Uint32(b.body[12:16]))
+	pkt := b.body[20 : 20+capLen]
+	if pkt[0] != 0x45 || pkt[9] != 17 {
+		t.Fatalf("expected IPv4/UDP header, got %x", pkt[:20])
+	}
+	if ipChecksum(pkt[:20]) != 0 {
+		t.Fatal("bad IPv4 header checksum")
+	}
+	payload = pkt[28:]
+	opts := b.body[20+(capLen+3)&^3:]
+	for len(opts) >= 4 {
+		code := binary.LittleEndian.Uint16(opts[0:2])
+		l := int(binary.LittleEndian.Uint16(opts[2:4]))
+		if code == 0 {
+			break
+		}
+		if code == 1 {
+			comment = string(opts[4 : 4+l])
+		}
+		opts = opts[4+(l+3)&^3:]
+	}
+	return
+}
+
+func TestCaptureFileFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "awg.pcapng")
+	c, err := OpenCapture(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := netip.MustParseAddrPort("10.0.0.1:51820")
+	dst := netip.MustParseAddrPort("1.2.3.4:443")
+	c.record(captureClient, captureIn, src, dst, []byte{1, 0, 0, 0, 5}, "")
+	c.record(captureServer, captureOut, dst, src, []byte{9, 9, 9}, "junk")
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := readPcapng(t, path)
+	if len(blocks) != 5 {
+		t.Fatalf("expected SHB + 2 IDB + 2 EPB, got %d blocks", len(blocks))
+	}
+	if blocks[0].typ != pcapngSHB || blocks[1].typ != pcapngIDB || blocks[2].typ != pcapngIDB {
+		t.Fatal("unexpected header block types")
+	}
+	if binary.LittleEndian.Uint16(blocks[1].body[0:2]) != linktypeRaw {
+		t.Fatal("expected LINKTYPE_RAW")
+	}
+
+	iface, payload, comment := epbInfo(t, blocks[3])
+	if iface != captureClient || !bytes.Equal(payload, []byte{1, 0, 0, 0, 5}) || comment != "" {
+		t.Fatalf("EPB 1: iface=%d payload=%x comment=%q", iface, payload, comment)
+	}
+	iface, payload, comment = epbInfo(t, blocks[4])
+	if iface != captureServer || !bytes.Equal(payload, []byte{9, 9, 9}) || comment != "junk" {
+		t.Fatalf("EPB 2: iface=%d payload=%x comment=%q", iface, payload, comment)
+	}
+}
+
+func TestCaptureRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "awg.pcapng")
+	c, err := OpenCapture(path, 1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ap := netip.MustParseAddrPort("127.0.0.1:1")
+	pkt := make([]byte, 300)
+	for i := 0; i < 20; i++ {
+		c.record(captureClient, captureIn, ap, ap, pkt, "")
+	}
+	c.Close()
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		st, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("expected %s: %v", name, err)
+		}
+		if st.Size() > 1024 {
+			t.Fatalf("%s exceeds max size: %d", name, st.Size())
+		}
+		// Every rotated file must be a self-contained capture.
+		if blocks := readPcapng(t, name); blocks[0].typ != pcapngSHB {
+			t.Fatalf("%s does not start with SHB", name)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Fatal("expected at most 2 rotated files")
+	}
+}
+
+func TestProxyCaptureHandshake(t *testing.T) {
+	cfg := proxyTestConfig()
+	path := filepath.Join(t.TempDir(), "awg.pcapng")
+	c, err := OpenCapture(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockServer := startMockServer(t)
+	defer mockServer.Close()
+	mockAddr := mockServer.LocalAddr().(*net.UDPAddr)
+
+	_, proxyAddr, stopProxy := startProxySetup(t, cfg, mockAddr, func(p *Proxy) { p.SetCapture(c) })
+
+	clientConn, err := net.DialUDP("udp", nil, proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	establishSession(t, cfg, clientConn, mockServer)
+	time.Sleep(50 * time.Millisecond)
+	stopProxy()
+	c.Close()
+
+	var clientPkts, serverPkts, junk int
+	for _, b := range readPcapng(t, path) {
+		if b.typ != pcapngEPB {
+			continue
+		}
+		iface, payload, comment := epbInfo(t, b)
+		switch {
+		case iface == captureClient:
+			clientPkts++
+			if len(payload) != WgHandshakeInitSize {
+				t.Fatalf("client side: expected WG-form init, got %dB", len(payload))
+			}
+		case comment == "junk":
+			junk++
+		default:
+			serverPkts++
+			if len(payload) != cfg.S1+WgHandshakeInitSize {
+				t.Fatalf("server side: expected AWG-form init, got %dB", len(payload))
+			}
+		}
+	}
+	if clientPkts != 1 || serverPkts != 1 || junk != cfg.Jc {
+		t.Fatalf("expected 1 client, 1 server, %d junk; got %d, %d, %d", cfg.Jc, clientPkts, serverPkts, junk)
+	}
+}
+
+// TestProxyCaptureTransport checks that batched transport packets are
+// recorded once per direction and side, after they were sent.
+func TestProxyCaptureTransport(t *testing.T) {
+	cfg := proxyTestConfig()
+	path := filepath.Join(t.TempDir(), "awg.pcapng")
+	c, err := OpenCapture(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockServer := startMockServer(t)
+	defer mockServer.Close()
+	_, proxyAddr, stopProxy := startProxySetup(t, cfg, mockServer.LocalAddr().(*net.UDPAddr), func(p *Proxy) { p.SetCapture(c) })
+
+	clientConn, err := net.DialUDP("udp", nil, proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	const count = 5
+	for range count {
+		clientConn.Write(makeWGPacket(wgTransportData, 100))
+	}
+	pkts, proxyRemote := readPacketsWithAddr(mockServer, time.Second, count)
+	if len(pkts) != count {
+		t.Fatalf("server got %d packets, want %d", len(pkts), count)
+	}
+	for _, pkt := range pkts {
+		mockServer.WriteToUDP(pkt, proxyRemote)
+	}
+	if got := readPackets(clientConn, time.Second, count); len(got) != count {
+		t.Fatalf("client got %d packets, want %d", len(got), count)
+	}
+	time.Sleep(50 * time.Millisecond)
+	stopProxy()
+	c.Close()
+
+	var sizes [2]map[int]int
+	for _, b := range readPcapng(t, path) {
+		if b.typ != pcapngEPB {
+			continue
+		}
+		iface, payload, _ := epbInfo(t, b)
+		if sizes[iface] == nil {
+			sizes[iface] = map[int]int{}
+		}
+		sizes[iface][len(payload)]++
+	}
+	if n := sizes[captureClient][100]; n != 2*count {
+		t.Fatalf("client side: %d WG-form packets, want %d", n, 2*count)
+	}
+	if n := sizes[captureServer][cfg.S4+100]; n != 2*count {
+		t.Fatalf("server side: %d AWG-form packets, want %d", n, 2*count)
+	}
+}
@@ -0,0 +1,223 @@
+package awg
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Control socket: a line-based admin interface for a running proxy.
+// The client sends one command line, the server writes the reply and closes
+// the connection. Addresses starting with "/" or "unix:" are Unix-domain
+// sockets; anything else is a TCP address that must be on loopback.
+
+const controlTimeout = 5 * time.Second
+
+// ControlCommands lists the commands understood by the control socket.
+const ControlCommands = "status, diag, reconnect, rotate-port, loglevel none|error|info|debug, reload, reset"
+
+// ListenControl opens the control socket at addr.
+func ListenControl(addr string) (net.Listener, error) {
+	if path, ok := controlUnixPath(addr); ok {
+		// Remove a stale socket left over by a previous run.
+		if st, err := os.Lstat(path); err == nil && st.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tcpAddr.IP == nil || !tcpAddr.IP.IsLoopback() {
+		return nil, errors.New("control address must be a Unix socket path or a loopback TCP address")
+	}
+	return net.ListenTCP("tcp", tcpAddr)
+}
+
+// ControlRequest sends cmd to the control socket at addr and returns the reply.
+func ControlRequest(addr, cmd string) (string, error) {
+	network := "tcp"
+	if path, ok := controlUnixPath(addr); ok {
+		network, addr = "unix", path
+	}
+	conn, err := net.DialTimeout(network, addr, controlTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * controlTimeout))
+	if _, err := io.WriteString(conn, cmd+"\n"); err != nil {
+		return "", err
+	}
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	return string(reply), nil
+}
+
+func controlUnixPath(addr string) (string, bool) {
+	if strings.HasPrefix(addr, "unix:") {
+		return addr[len("unix:"):], true
+	}
+	return addr, strings.HasPrefix(addr, "/")
+}
+
+// ServeControl accepts control connections on ln until stop is closed.
+func (p *Proxy) ServeControl(ln net.Listener, stop <-chan struct{}) {
+	go func() {
+		<-stop
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if p.stopped.Load() || isClosedErr(err) {
+				return
+			}
+			LogError(p.cfg, "control accept: ", err.Error())
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go p.handleControl(conn)
+	}
+}
+
+func (p *Proxy) handleControl(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * controlTimeout))
+	line, err := readControlLine(conn)
+	if err != nil {
+		return
+	}
+	reply := p.controlCommand(line)
+	io.WriteString(conn, reply)
+}
+
+// readControlLine reads up to the first newline (max 256 bytes).
+func readControlLine(conn net.Conn) (string, error) {
+	var buf [256]byte
+	n := 0
+	for n < len(buf) {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if i := strings.IndexByte(string(buf[:n]), '\n'); i >= 0 {
+			return strings.TrimSpace(string(buf[:i])), nil
+		}
+		if err != nil {
+			if err == io.EOF && n > 0 {
+				break
+			}
+			return "", err
+		}
+	}
+	return strings.TrimSpace(string(buf[:n])), nil
+}
+
+// controlCommand executes one control command and returns the reply text.
+func (p *Proxy) controlCommand(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "error: empty command; commands: " + ControlCommands + "\n"
+	}
+	LogInfo(p.cfg, "control: ", line)
+	switch fields[0] {
+	case "status":
+		return p.Status()
+
+	case "diag":
+		return p.diag.Report(p.paramConfig())
+
+	case "reconnect":
+		if p.forceReconnect() == nil {
+			return "error: not running\n"
+		}
+		return "ok: reconnect triggered\n"
+
+	case "rotate-port":
+		old := p.forceReconnect()
+		if old == nil {
+			return "error: not running\n"
+		}
+		oldLocal := old.LocalAddr().String()
+		deadline := time.Now().Add(controlTimeout)
+		for time.Now().Before(deadline) {
+			if rc := p.remoteConn.Load(); rc != old {
+				return "ok: " + oldLocal + " -> " + rc.LocalAddr().String() + "\n"
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return "error: reconnect still in progress\n"
+
+	case "loglevel":
+		if len(fields) != 2 {
+			return "error: usage: loglevel none|error|info|debug\n"
+		}
+		level, ok := ParseLogLevel(fields[1])
+		if !ok {
+			return "error: unknown log level " + fields[1] + "\n"
+		}
+		p.cfg.SetLogLevel(level)
+		return "ok: log level " + fields[1] + "\n"
+
+	case "reload":
+		if p.reload == nil {
+			return "error: reload not configured\n"
+		}
+		cfg, err := p.reload()
+		if err != nil {
+			return "error: " + err.Error() + "\n"
+		}
+		applied, err := p.Reload(cfg)
+		if err != nil {
+			return "error: " + err.Error() + "\n"
+		}
+		return "ok: reloaded " + applied + "\n"
+
+	case "reset":
+		// Runtime overrides (loglevel) are dropped and the remote is
+		// re-resolved (DNS) and redialed. Nothing is re-read; see reload.
+		p.cfg.SetLogLevel(-1)
+		if p.forceReconnect() == nil {
+			return "error: not running\n"
+		}
+		return "ok: overrides reset, remote re-resolving (log level " + logLevelName(p.cfg.logLevel()) + ")\n"
+
+	default:
+		return "error: unknown command " + fields[0] + "; commands: " + ControlCommands + "\n"
+	}
+}
+
+// SetReload sets the function the reload command gets the new configuration
+// from, e.g. by re-reading the environment. Must be called before Run.
+func (p *Proxy) SetReload(fn func() (*Config, error)) {
+	p.reload = fn
+}
+
+// Reload applies cfg to the running proxy: H1-H4, S1-S4 and the padding
+// templates, Jc/Jmin/Jmax and the junk template, and the CPS templates and
+// policies take effect through a new AmneziaWG transformer (SetTransformer),
+// which keeps the CPS counter; then the log level of cfg is set as with the
+// loglevel command. A transformer installed with SetTransformer is kept.
+// Parameters that need larger buffers than those sized at start are
+// rejected. It returns a summary of what was applied.
+func (p *Proxy) Reload(cfg *Config) (string, error) {
+	if cfg.packetBufSize() > p.cfg.packetBufSize() || cfg.maxSendSize() > p.cfg.maxSendSize() {
+		return "", errors.New("larger S1-S4, Jmax or CPS packets than at start need a restart")
+	}
+	applied := "log level " + logLevelName(cfg.LogLevel)
+	if p.tr.Load().cfg != nil {
+		p.setTransformer(newAmneziaTransformer(cfg, p.cfg), cfg)
+		applied = "H1-H4, S1-S4, Jc=" + strconv.Itoa(cfg.Jc) + ", CPS, " + applied
+	} else {
+		applied += "; custom transformer kept"
+	}
+	p.cfg.SetLogLevel(cfg.LogLevel)
+	p.logInfo("reload: ", applied)
+	return applied, nil
+}
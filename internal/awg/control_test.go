@@ -0,0 +1,201 @@
+package awg
+
+import (
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startControl serves the proxy's control socket on a Unix socket in a temp dir.
+func startControl(t *testing.T, proxy *Proxy) (string, func()) {
+	t.Helper()
+	addr := filepath.Join(t.TempDir(), "ctl.sock")
+	ln, err := ListenControl(addr)
+	if err != nil {
+		t.Fatal("listen control: ", err)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.ServeControl(ln, stop)
+	}()
+	return addr, func() {
+		close(stop)
+		<-done
+	}
+}
+
+func ctl(t *testing.T, addr, cmd string) string {
+	t.Helper()
+	reply, err := ControlRequest(addr, cmd)
+	if err != nil {
+		t.Fatalf("ctl %q: %v", cmd, err)
+	}
+	return reply
+}
+
+func TestControlStatusCounters(t *testing.T) {
+	cfg := proxyTestConfig()
+	mockServer := startMockServer(t)
+	defer mockServer.Close()
+
+	proxy, proxyAddr, stopProxy := startProxyWithHandle(t, cfg, mockServer.LocalAddr().(*net.UDPAddr))
+	defer stopProxy()
+	addr, stopCtl := startControl(t, proxy)
+	defer stopCtl()
+
+	clientConn, err := net.DialUDP("udp", nil, proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+	establishSession(t, cfg, clientConn, mockServer)
+
+	status := ctl(t, addr, "status")
+	for _, want := range []string{
+		"client=" + clientConn.LocalAddr().String(),
+		"remote=" + mockServer.LocalAddr().String(),
+		"out_packets=1\n",
+		"junk_sent=4\n",
+		"log_level=info\n",
+	} {
+		if !strings.Contains(status, want) {
+			t.Errorf("status missing %q:\n%s", want, status)
+		}
+	}
+}
+
+func TestControlLogLevel(t *testing.T) {
+	cfg := proxyTestConfig()
+	proxy := NewProxy(cfg, &net.UDPAddr{}, &net.UDPAddr{})
+	addr, stopCtl := startControl(t, proxy)
+	defer stopCtl()
+
+	if reply := ctl(t, addr, "loglevel debug"); !strings.HasPrefix(reply, "ok") {
+		t.Fatalf("unexpected reply: %q", reply)
+	}
+	if cfg.logLevel() != LevelDebug {
+		t.Fatalf("expected debug level, got %d", cfg.logLevel())
+	}
+	if reply := ctl(t, addr, "loglevel verbose"); !strings.HasPrefix(reply, "error") {
+		t.Fatalf("expected error for unknown level, got %q", reply)
+	}
+	if reply := ctl(t, addr, "bogus"); !strings.HasPrefix(reply, "error: unknown command") {
+		t.Fatalf("expected unknown command error, got %q", reply)
+	}
+	// reset drops the runtime override (the proxy is not running, so it reports an error).
+	ctl(t, addr, "reset")
+	if cfg.logLevel() != LevelInfo {
+		t.Fatalf("expected configured level after reset, got %d", cfg.logLevel())
+	}
+}
+
+func TestControlRotatePort(t *testing.T) {
+	cfg := proxyTestConfig()
+	mockServer := startMockServer(t)
+	defer mockServer.Close()
+
+	proxy, _, stopProxy := startProxyWithHandle(t, cfg, mockServer.LocalAddr().(*net.UDPAddr))
+	defer stopProxy()
+	addr, stopCtl := startControl(t, proxy)
+	defer stopCtl()
+
+	oldConn := proxy.remoteConn.Load()
+	reply := ctl(t, addr, "rotate-port")
+	if !strings.HasPrefix(reply, "ok: "+oldConn.LocalAddr().String()+" -> ") {
+		t.Fatalf("unexpected reply: %q", reply)
+	}
+	waitForReconnect(t, proxy, oldConn, time.Second)
+	if proxy.stats.reconnects.Load() != 1 {
+		t.Fatalf("expected 1 reconnect, got %d", proxy.stats.reconnects.Load())
+	}
+}
+
+func TestListenControlRejectsNonLoopback(t *testing.T) {
+	if _, err := ListenControl("0.0.0.0:0"); err == nil {
+		t.Fatal("expected error for non-loopback TCP address")
+	}
+	ln, err := ListenControl("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+}
+
+func TestControlReload(t *testing.T) {
+	cfg := proxyTestConfig()
+	mockServer := startMockServer(t)
+	defer mockServer.Close()
+
+	var next *Config
+	proxy, proxyAddr, stopProxy := startProxySetup(t, cfg, mockServer.LocalAddr().(*net.UDPAddr), func(p *Proxy) {
+		p.SetReload(func() (*Config, error) { return next, nil })
+	})
+	defer stopProxy()
+	addr, stopCtl := startControl(t, proxy)
+	defer stopCtl()
+
+	clientConn, err := net.DialUDP("udp", nil, proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+	establishSession(t, cfg, clientConn, mockServer)
+
+	// Larger padding than the buffers were sized for needs a restart.
+	next = proxyTestConfig()
+	next.S4 = 4000
+	next.ComputeFastPath()
+	if reply := ctl(t, addr, "reload"); !strings.HasPrefix(reply, "error: ") {
+		t.Fatalf("expected error for larger S4, got %q", reply)
+	}
+
+	next = proxyTestConfig()
+	next.H4 = HRange{Min: 444, Max: 444}
+	next.LogLevel = LevelDebug
+	next.ComputeFastPath()
+	if reply := ctl(t, addr, "reload"); !strings.HasPrefix(reply, "ok: reloaded ") {
+		t.Fatalf("unexpected reply: %q", reply)
+	}
+	if cfg.logLevel() != LevelDebug {
+		t.Fatalf("expected debug level after reload, got %d", cfg.logLevel())
+	}
+	if tr := proxy.transformer().(*amneziaTransformer); tr.cfg != next || tr.counter != cfg {
+		t.Fatal("reloaded transformer does not use the new parameters and the old CPS counter")
+	}
+
+	if _, err := clientConn.Write(makeWGPacket(wgTransportData, 64)); err != nil {
+		t.Fatal(err)
+	}
+	pkts := readPackets(mockServer, time.Second, 1)
+	if len(pkts) != 1 || binary.LittleEndian.Uint32(pkts[0]) != 444 {
+		t.Fatalf("server got %x, want transport data with H4=444", pkts)
+	}
+}
+
+func TestProxyReloadKeepsCustomTransformer(t *testing.T) {
+	cfg := proxyTestConfig()
+	proxy := NewProxy(cfg, &net.UDPAddr{}, &net.UDPAddr{})
+	addr, stopCtl := startControl(t, proxy)
+	defer stopCtl()
+	if reply := ctl(t, addr, "reload"); !strings.HasPrefix(reply, "error: ") {
+		t.Fatalf("expected error without a reload function, got %q", reply)
+	}
+
+	proxy.SetTransformer(PassthroughTransformer{})
+	next := proxyTestConfig()
+	next.LogLevel = LevelError
+	if _, err := proxy.Reload(next); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := proxy.transformer().(PassthroughTransformer); !ok {
+		t.Fatal("reload replaced a custom transformer")
+	}
+	if cfg.logLevel() != LevelError {
+		t.Fatalf("expected error level after reload, got %d", cfg.logLevel())
+	}
+}
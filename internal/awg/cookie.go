@@ -0,0 +1,135 @@
+package awg
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// WireGuard cookies and MAC2.
+//
+// A peer under load answers a handshake message with a cookie reply instead
+// of processing it. The cookie is encrypted with XChaCha20-Poly1305 under
+// BLAKE2s-256("cookie--" || public key of the replying peer), with the MAC1
+// of the triggering message as additional data, and the other side then puts
+// MAC2 = BLAKE2s-128(cookie, message up to MAC2) on its handshake messages.
+//
+// Rewriting the type and MAC1 breaks both: the local WireGuard cannot decrypt
+// a cookie bound to the rewritten MAC1, and the MAC2 it computes covers the
+// original type. cookieState, kept per remote peer, remembers each MAC1
+// before and after rewriting, moves cookie replies from the peer over to the
+// original MAC1, and recomputes MAC2 with the cookie.
+
+const (
+	cookieTrack    = 8                 // handshake messages remembered per peer
+	cookieLifetime = 120 * time.Second // WireGuard's COOKIE_REFRESH_TIME
+)
+
+type sentMAC1 struct {
+	sender uint32   // sender index of the message
+	orig   [16]byte // MAC1 as received from the local side
+	sent   [16]byte // MAC1 as sent to the peer
+}
+
+// cookieState tracks the handshake messages sent to one peer and the cookie
+// received from it.
+type cookieState struct {
+	mu       sync.Mutex
+	key      [32]byte // cookie encryption key of the peer, zero = unknown
+	sent     [cookieTrack]sentMAC1
+	next     int
+	cookie   [16]byte
+	cookieAt time.Time // zero = no cookie
+}
+
+// newCookieState creates the state for the peer with public key pub
+// (zero = not known yet, see setKey).
+func newCookieState(pub [32]byte) *cookieState {
+	c := &cookieState{}
+	if pub != ([32]byte{}) {
+		c.key = computeCookieKey(pub)
+	}
+	return c
+}
+
+// setKey sets the peer's public key once it is known.
+func (c *cookieState) setKey(pub [32]byte) {
+	key := computeCookieKey(pub)
+	c.mu.Lock()
+	c.key = key
+	c.mu.Unlock()
+}
+
+// signed records that the MAC1 of msg (a handshake message, MAC1 at off) was
+// rewritten from orig, and recomputes MAC2 if a cookie from the peer is
+// still valid. Otherwise MAC2 is left as the local side set it.
+func (c *cookieState) signed(msg []byte, off int, orig [16]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &c.sent[c.next]
+	c.next = (c.next + 1) % cookieTrack
+	e.sender = binary.LittleEndian.Uint32(msg[4:8])
+	e.orig = orig
+	copy(e.sent[:], msg[off:off+16])
+
+	if !c.cookieAt.IsZero() && time.Since(c.cookieAt) < cookieLifetime {
+		mac2 := blake2s128MACKey(c.cookie[:], msg[:off+16])
+		copy(msg[off+16:off+32], mac2[:])
+	}
+}
+
+// reply handles a cookie reply (WireGuard form, 64 bytes) sent by the peer:
+// the cookie is decrypted with the MAC1 the peer saw, kept for MAC2, and
+// re-encrypted under a fresh nonce with the MAC1 the local side sent. Returns
+// false if the reply matches no tracked message; it is then left as is.
+func (c *cookieState) reply(msg []byte) bool {
+	receiver := binary.LittleEndian.Uint32(msg[4:8])
+	var nonce [24]byte
+	copy(nonce[:], msg[8:32])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.key == ([32]byte{}) {
+		return false
+	}
+	for i := 1; i <= cookieTrack; i++ {
+		e := &c.sent[(c.next-i+cookieTrack)%cookieTrack]
+		if e.sender != receiver || e.sent == ([16]byte{}) {
+			continue
+		}
+		var cookie [16]byte
+		if _, ok := xchacha20poly1305Open(cookie[:0], &c.key, &nonce, msg[32:64], e.sent[:]); !ok {
+			continue
+		}
+		c.cookie = cookie
+		c.cookieAt = time.Now()
+
+		rand.Read(nonce[:])
+		copy(msg[8:32], nonce[:])
+		xchacha20poly1305Seal(msg[32:32], &c.key, &nonce, cookie[:], e.orig[:])
+		return true
+	}
+	return false
+}
+
+// apply re-signs msg (a WireGuard handshake message with MAC1 at off) with
+// key; with cookie tracking enabled the rewrite is recorded and MAC2 fixed up.
+func (s mac1Signer) apply(msg []byte, off int, key *[32]byte) {
+	if key == nil {
+		return
+	}
+	orig := [16]byte(msg[off : off+16])
+	mac1 := blake2s128MAC(*key, msg[:off])
+	copy(msg[off:off+16], mac1[:])
+	if s.to != nil {
+		s.to.signed(msg, off, orig)
+	}
+}
+
+// cookieReply fixes up a cookie reply (WireGuard form) passing through.
+func (s mac1Signer) cookieReply(msg []byte) {
+	if s.from != nil {
+		s.from.reply(msg)
+	}
+}
@@ -0,0 +1,171 @@
+package awg
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// sealCookieReply builds a WireGuard cookie reply (type 3) the way a peer
+// with public key pub does, bound to the MAC1 it received.
+func sealCookieReply(msgType, receiver uint32, pub [32]byte, mac1 []byte, cookie [16]byte) []byte {
+	pkt := make([]byte, WgCookieReplySize)
+	binary.LittleEndian.PutUint32(pkt[0:4], msgType)
+	binary.LittleEndian.PutUint32(pkt[4:8], receiver)
+	for i := 8; i < 32; i++ {
+		pkt[i] = byte(i * 5)
+	}
+	key := computeCookieKey(pub)
+	aead, _ := chacha20poly1305.NewX(key[:])
+	aead.Seal(pkt[32:32], pkt[8:32], cookie[:], mac1)
+	return pkt
+}
+
+// openCookieReply decrypts a cookie reply the way the receiving WireGuard does.
+func openCookieReply(t *testing.T, pkt []byte, pub [32]byte, mac1 []byte) [16]byte {
+	t.Helper()
+	key := computeCookieKey(pub)
+	aead, _ := chacha20poly1305.NewX(key[:])
+	plain, err := aead.Open(nil, pkt[8:32], pkt[32:64], mac1)
+	if err != nil {
+		t.Fatal("cookie reply does not decrypt with the MAC1 the receiver sent: ", err)
+	}
+	return [16]byte(plain)
+}
+
+func setMAC2(msg []byte, off int, cookie [16]byte) {
+	mac2 := blake2s128MACKey(cookie[:], msg[:off+16])
+	copy(msg[off+16:off+32], mac2[:])
+}
+
+func checkMAC2(t *testing.T, msg []byte, off int, cookie [16]byte) {
+	t.Helper()
+	if want := blake2s128MACKey(cookie[:], msg[:off+16]); [16]byte(msg[off+16:off+32]) != want {
+		t.Fatalf("MAC2 not valid for the rewritten message:\n  got  %x\n  want %x", msg[off+16:off+32], want)
+	}
+}
+
+// TestProxyCookieFromServer simulates an AmneziaWG server under load: it
+// answers the init with a cookie reply bound to the MAC1 it received. The
+// client must be able to decrypt the cookie, and the MAC2 on its next init
+// must be valid for the transformed init.
+func TestProxyCookieFromServer(t *testing.T) {
+	server := startMockServer(t)
+	defer server.Close()
+	cfg := reverseTestConfig()
+	proxyAddr, stop := startProxy(t, cfg, server.LocalAddr().(*net.UDPAddr))
+	defer stop()
+	client := dialUDP(t, proxyAddr)
+	defer client.Close()
+
+	init := signedWGPacket(wgHandshakeInit, reverseServerPub)
+	origMAC1 := append([]byte(nil), init[116:132]...)
+	client.Write(init)
+	pkts, from := readPacketsWithAddr(server, 500*time.Millisecond, 10)
+	if len(pkts) == 0 {
+		t.Fatal("no init at the server")
+	}
+	awgInit := pkts[len(pkts)-1][cfg.S1:]
+
+	cookie := [16]byte{0xc0, 0x0c, 0x1e}
+	sender := binary.LittleEndian.Uint32(awgInit[4:8])
+	server.WriteToUDP(sealCookieReply(cfg.H3.Min, sender, reverseServerPub, awgInit[116:132], cookie), from)
+
+	pkts = readPackets(client, 500*time.Millisecond, 1)
+	if len(pkts) != 1 || binary.LittleEndian.Uint32(pkts[0][:4]) != wgCookieReply {
+		t.Fatal("client did not get the cookie reply")
+	}
+	if got := openCookieReply(t, pkts[0], reverseServerPub, origMAC1); got != cookie {
+		t.Fatalf("cookie = %x, want %x", got, cookie)
+	}
+
+	// The client retries with MAC2 computed over its WireGuard-form init.
+	init2 := signedWGPacket(wgHandshakeInit, reverseServerPub)
+	setMAC2(init2, 116, cookie)
+	client.Write(init2)
+	pkts = readPackets(server, 500*time.Millisecond, 10)
+	if len(pkts) == 0 {
+		t.Fatal("no second init at the server")
+	}
+	checkMAC2(t, pkts[len(pkts)-1][cfg.S1:], 116, cookie)
+}
+
+// TestProxyCookieFromClient is the mirror image: the client is under load
+// and answers a handshake response from the server with a cookie reply.
+func TestProxyCookieFromClient(t *testing.T) {
+	server := startMockServer(t)
+	defer server.Close()
+	cfg := reverseTestConfig()
+	proxyAddr, stop := startProxy(t, cfg, server.LocalAddr().(*net.UDPAddr))
+	defer stop()
+	client := dialUDP(t, proxyAddr)
+	defer client.Close()
+
+	from := establishSession(t, cfg, client, server)
+
+	// Server response in AWG form, signed over the AWG-form message.
+	resp := makeWGPacket(cfg.H2.Min, WgHandshakeResponseSize)
+	recomputeMAC1Response(resp, computeMAC1Key(reverseClientPub))
+	awgMAC1 := append([]byte(nil), resp[60:76]...)
+	server.WriteToUDP(append(make([]byte, cfg.S2), resp...), from)
+
+	pkts := readPackets(client, 500*time.Millisecond, 1)
+	if len(pkts) != 1 || len(pkts[0]) != WgHandshakeResponseSize {
+		t.Fatal("client did not get the response")
+	}
+	wgResp := pkts[0]
+
+	cookie := [16]byte{0xbe, 0xef}
+	sender := binary.LittleEndian.Uint32(wgResp[4:8])
+	client.Write(sealCookieReply(wgCookieReply, sender, reverseClientPub, wgResp[60:76], cookie))
+
+	pkts = readPackets(server, 500*time.Millisecond, 1)
+	if len(pkts) != 1 || len(pkts[0]) != cfg.cookieTotal {
+		t.Fatal("server did not get the cookie reply")
+	}
+	if got := openCookieReply(t, pkts[0][cfg.S3:], reverseClientPub, awgMAC1); got != cookie {
+		t.Fatalf("cookie = %x, want %x", got, cookie)
+	}
+
+	// The server's next response carries MAC2 over its AWG form.
+	resp2 := makeWGPacket(cfg.H2.Min, WgHandshakeResponseSize)
+	recomputeMAC1Response(resp2, computeMAC1Key(reverseClientPub))
+	setMAC2(resp2, 60, cookie)
+	server.WriteToUDP(append(make([]byte, cfg.S2), resp2...), from)
+	pkts = readPackets(client, 500*time.Millisecond, 1)
+	if len(pkts) != 1 {
+		t.Fatal("client did not get the second response")
+	}
+	checkMAC2(t, pkts[0], 60, cookie)
+}
+
+func TestCookieReplyUnknownReceiverUnchanged(t *testing.T) {
+	c := newCookieState(reverseServerPub)
+	msg := signedWGPacket(wgHandshakeInit, reverseServerPub)
+	c.signed(msg, 116, [16]byte{1})
+
+	pkt := sealCookieReply(wgCookieReply, 0xdeadbeef, reverseServerPub, msg[116:132], [16]byte{2})
+	orig := string(pkt)
+	if c.reply(pkt) {
+		t.Fatal("reply for an untracked receiver index accepted")
+	}
+	if string(pkt) != orig {
+		t.Fatal("untracked cookie reply modified")
+	}
+}
+
+func TestCookieMAC2Expires(t *testing.T) {
+	c := newCookieState(reverseServerPub)
+	c.cookie = [16]byte{7}
+	c.cookieAt = time.Now().Add(-cookieLifetime - time.Second)
+
+	msg := signedWGPacket(wgHandshakeInit, reverseServerPub)
+	mac2 := string(msg[132:148])
+	c.signed(msg, 116, [16]byte{})
+	if string(msg[132:148]) != mac2 {
+		t.Fatal("expired cookie used for MAC2")
+	}
+}
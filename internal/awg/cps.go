@@ -1,7 +1,6 @@
 package awg
 
 import (
-	"encoding/binary"
 	"errors"
 	"math/rand/v2"
 	"strconv"
@@ -26,25 +25,78 @@ func randDigitFill(b []byte) {
 const (
 	cpsStatic       byte = 'b' // static hex bytes
 	cpsRandom       byte = 'r' // random bytes
-	cpsTimestamp    byte = 't' // 4-byte LE unix timestamp
-	cpsCounter      byte = 'c' // 4-byte LE packet counter
+	cpsTimestamp    byte = 't' // unix timestamp, 4-byte LE seconds by default
+	cpsCounter      byte = 'c' // packet counter, 4-byte LE by default
 	cpsRandomChars  byte = 'C' // random alphanumeric ASCII chars (rc tag)
 	cpsRandomDigits byte = 'D' // random decimal digits (rd tag)
+	cpsLength       byte = 'l' // length of a region (see cpsfields.go)
+	cpsCRC32        byte = 'K' // CRC-32 of a region
+	cpsCRC16        byte = 'k' // CRC-16 of a region
+	cpsChecksum     byte = 's' // Internet checksum of a region (csum tag)
+	cpsMarkStart    byte = '[' // region start (ms tag)
+	cpsMarkEnd      byte = ']' // region end (me tag)
 )
 
 type cpsSegment struct {
-	kind byte
-	data []byte // static bytes for 'b'
-	size int    // byte count for 'r'
+	kind  byte
+	data  []byte // static bytes for 'b'
+	size  int    // byte count for 'r'
+	width int    // field width for timestamps, counters and computed fields
+	be    bool   // big-endian field
+	unit  int64  // timestamp resolution in nanoseconds
+	pos   int    // offset of the tag in the template string
+	tag   string // the tag as written, without the angle brackets
 }
 
 // CPSTemplate represents a parsed CPS template (I1-I5).
 type CPSTemplate struct {
 	segments []cpsSegment
+	fields   []cpsField // computed fields in evaluation order
+	size     int        // packet length, computed at parse time
 }
 
-// ParseCPSTemplate parses a CPS template string.
-// Format tags: <b 0xHEX>, <r SIZE>, <rc SIZE>, <rd SIZE>, <t>, <c>
+// CPSError is a syntax error in a CPS template.
+type CPSError struct {
+	Pos int // offset in the template string
+	Msg string
+}
+
+func (e *CPSError) Error() string {
+	return e.Msg + " at position " + strconv.Itoa(e.Pos)
+}
+
+// cpsArgError is an error in a tag argument. rest is the length of the tag
+// from the argument to its end, which locates the argument in the template.
+type cpsArgError struct {
+	rest int
+	msg  string
+}
+
+func (e *cpsArgError) Error() string { return e.msg }
+
+// argError returns an error at the first field of args equal to arg, or at
+// the start of args if there is none. args is a suffix of the tag.
+func argError(args, arg, msg string) error {
+	rest := len(args)
+	for s := trimLeft(args); s != ""; s = trimLeft(s) {
+		i := 0
+		for i < len(s) && s[i] != ' ' && s[i] != '\t' {
+			i++
+		}
+		if s[:i] == arg {
+			rest = len(s)
+			break
+		}
+		s = s[i:]
+	}
+	return &cpsArgError{rest: rest, msg: msg}
+}
+
+// ParseCPSTemplate parses a CPS template string. Syntax errors are *CPSError.
+// Format tags: <b 0xHEX>, <r SIZE>, <rc SIZE>, <rd SIZE>,
+// <t [be|le] [s|ms|us|ns] [4|8]>, <c [be|le] [1|2|4|8]>, and the computed
+// fields <l [be|le] [1-4]>, <crc32 [be|le]>, <crc16 [be|le]> and <csum> with
+// the region markers <ms> and <me> (see cpsfields.go).
 func ParseCPSTemplate(s string) (*CPSTemplate, error) {
 	var segs []cpsSegment
 	i := 0
@@ -55,7 +107,7 @@ func ParseCPSTemplate(s string) (*CPSTemplate, error) {
 			continue
 		}
 		if s[i] != '<' {
-			return nil, errors.New("expected '<' at position " + strconv.Itoa(i))
+			return nil, &CPSError{Pos: i, Msg: "expected '<'"}
 		}
 		// Find closing '>'.
 		end := -1
@@ -66,33 +118,49 @@ func ParseCPSTemplate(s string) (*CPSTemplate, error) {
 			}
 		}
 		if end < 0 {
-			return nil, errors.New("unclosed '<' at position " + strconv.Itoa(i))
+			return nil, &CPSError{Pos: i, Msg: "unclosed '<'"}
 		}
 		inner := s[i+1 : end]
 		seg, err := parseCPSTag(inner)
 		if err != nil {
-			return nil, err
+			pos := i
+			if aerr, ok := err.(*cpsArgError); ok {
+				pos = end - aerr.rest
+			}
+			return nil, &CPSError{Pos: pos, Msg: err.Error()}
 		}
+		seg.pos, seg.tag = i, inner
 		segs = append(segs, seg)
 		i = end + 1
 	}
 	if len(segs) == 0 {
-		return nil, errors.New("empty CPS template")
+		return nil, &CPSError{Pos: 0, Msg: "empty CPS template"}
+	}
+	fields, err := resolveCPSFields(segs)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &CPSTemplate{segments: segs, fields: fields}
+	for _, seg := range segs {
+		tmpl.size += seg.len()
 	}
-	return &CPSTemplate{segments: segs}, nil
+	return tmpl, nil
 }
 
 func parseCPSTag(tag string) (cpsSegment, error) {
 	if len(tag) == 0 {
 		return cpsSegment{}, errors.New("empty tag")
 	}
+	if seg, ok, err := parseCPSFieldTag(tag); ok {
+		return seg, err
+	}
 	kind := tag[0]
 	switch kind {
 	case 'b':
 		// <b 0xHEXDATA>
 		rest := trimLeft(tag[1:])
 		if len(rest) < 3 || rest[0] != '0' || (rest[1] != 'x' && rest[1] != 'X') {
-			return cpsSegment{}, errors.New("expected '0x' prefix in <b> tag")
+			return cpsSegment{}, argError(rest, rest, "expected '0x' prefix in <b> tag")
 		}
 		hex := rest[2:]
 		data, err := decodeHex(hex)
@@ -107,10 +175,10 @@ func parseCPSTag(tag string) (cpsSegment, error) {
 			rest := trimLeft(tag[2:])
 			size, err := strconv.Atoi(rest)
 			if err != nil {
-				return cpsSegment{}, errors.New("invalid size in <rc> tag: " + err.Error())
+				return cpsSegment{}, argError(rest, rest, "invalid size in <rc> tag: "+err.Error())
 			}
 			if size <= 0 {
-				return cpsSegment{}, errors.New("<rc> size must be positive")
+				return cpsSegment{}, argError(rest, rest, "<rc> size must be positive")
 			}
 			return cpsSegment{kind: cpsRandomChars, size: size}, nil
 		}
@@ -118,34 +186,70 @@ func parseCPSTag(tag string) (cpsSegment, error) {
 			rest := trimLeft(tag[2:])
 			size, err := strconv.Atoi(rest)
 			if err != nil {
-				return cpsSegment{}, errors.New("invalid size in <rd> tag: " + err.Error())
+				return cpsSegment{}, argError(rest, rest, "invalid size in <rd> tag: "+err.Error())
 			}
 			if size <= 0 {
-				return cpsSegment{}, errors.New("<rd> size must be positive")
+				return cpsSegment{}, argError(rest, rest, "<rd> size must be positive")
 			}
 			return cpsSegment{kind: cpsRandomDigits, size: size}, nil
 		}
 		rest := trimLeft(tag[1:])
 		size, err := strconv.Atoi(rest)
 		if err != nil {
-			return cpsSegment{}, errors.New("invalid size in <r> tag: " + err.Error())
+			return cpsSegment{}, argError(rest, rest, "invalid size in <r> tag: "+err.Error())
 		}
 		if size <= 0 {
-			return cpsSegment{}, errors.New("<r> size must be positive")
+			return cpsSegment{}, argError(rest, rest, "<r> size must be positive")
 		}
 		return cpsSegment{kind: cpsRandom, size: size}, nil
 
 	case 't':
-		return cpsSegment{kind: cpsTimestamp}, nil
+		return parseCPSIntTag(cpsSegment{kind: cpsTimestamp, width: 4, unit: int64(time.Second)}, tag[1:])
 
 	case 'c':
-		return cpsSegment{kind: cpsCounter}, nil
+		return parseCPSIntTag(cpsSegment{kind: cpsCounter, width: 4}, tag[1:])
 
 	default:
 		return cpsSegment{}, errors.New("unknown tag kind: " + string(kind))
 	}
 }
 
+// parseCPSIntTag applies the attributes of a <t> or <c> tag to seg: the byte
+// order, the width and, for timestamps, the unit. Without attributes the tags
+// write 4-byte little-endian values, as in amneziawg-go.
+func parseCPSIntTag(seg cpsSegment, args string) (cpsSegment, error) {
+	name := string(seg.kind)
+	for _, arg := range splitFields(args) {
+		if seg.kind != cpsTimestamp && (arg == "s" || arg == "ms" || arg == "us" || arg == "ns") {
+			return seg, argError(args, arg, "<c> has no unit")
+		}
+		switch arg {
+		case "be":
+			seg.be = true
+		case "le":
+			seg.be = false
+		case "1", "2":
+			if seg.kind == cpsTimestamp {
+				return seg, argError(args, arg, "<t> width must be 4 or 8")
+			}
+			seg.width = int(arg[0] - '0')
+		case "4", "8":
+			seg.width = int(arg[0] - '0')
+		case "s":
+			seg.unit = int64(time.Second)
+		case "ms":
+			seg.unit = int64(time.Millisecond)
+		case "us":
+			seg.unit = int64(time.Microsecond)
+		case "ns":
+			seg.unit = 1
+		default:
+			return seg, argError(args, arg, "invalid argument \""+arg+"\" in <"+name+"> tag")
+		}
+	}
+	return seg, nil
+}
+
 // trimLeft removes leading spaces/tabs.
 func trimLeft(s string) string {
 	i := 0
@@ -155,76 +259,124 @@ func trimLeft(s string) string {
 	return s[i:]
 }
 
+// Size returns the length of the packets the template generates.
+func (t *CPSTemplate) Size() int {
+	return t.size
+}
+
+// len returns the number of bytes the segment generates.
+func (s cpsSegment) len() int {
+	switch s.kind {
+	case cpsStatic:
+		return len(s.data)
+	case cpsRandom, cpsRandomChars, cpsRandomDigits:
+		return s.size
+	case cpsTimestamp, cpsCounter, cpsLength, cpsCRC32, cpsCRC16, cpsChecksum:
+		return s.width
+	}
+	return 0
+}
+
 // Generate builds a CPS packet from the template.
 func (t *CPSTemplate) Generate(counter uint32) []byte {
-	// Calculate total size.
-	total := 0
-	for _, seg := range t.segments {
-		switch seg.kind {
-		case cpsStatic:
-			total += len(seg.data)
-		case cpsRandom, cpsRandomChars, cpsRandomDigits:
-			total += seg.size
-		case cpsTimestamp:
-			total += 4
-		case cpsCounter:
-			total += 4
-		}
-	}
+	buf := make([]byte, t.size)
+	t.put(buf, counter)
+	return buf
+}
 
-	buf := make([]byte, total)
+// put writes the template into buf, truncated to len(buf), and returns the
+// number of bytes written.
+func (t *CPSTemplate) put(buf []byte, counter uint32) int {
 	off := 0
 	for _, seg := range t.segments {
+		if off >= len(buf) {
+			break
+		}
+		rest := buf[off:]
 		switch seg.kind {
 		case cpsStatic:
-			copy(buf[off:], seg.data)
-			off += len(seg.data)
+			off += copy(rest, seg.data)
 		case cpsRandom:
-			randFill(buf[off : off+seg.size])
-			off += seg.size
+			n := min(seg.size, len(rest))
+			randFill(rest[:n])
+			off += n
 		case cpsRandomChars:
-			randAlphanumFill(buf[off : off+seg.size])
-			off += seg.size
+			n := min(seg.size, len(rest))
+			randAlphanumFill(rest[:n])
+			off += n
 		case cpsRandomDigits:
-			randDigitFill(buf[off : off+seg.size])
-			off += seg.size
+			n := min(seg.size, len(rest))
+			randDigitFill(rest[:n])
+			off += n
 		case cpsTimestamp:
-			binary.LittleEndian.PutUint32(buf[off:], uint32(time.Now().Unix()))
-			off += 4
+			var v [8]byte
+			putUint(v[:seg.width], uint64(time.Now().UnixNano()/seg.unit), seg.be)
+			off += copy(rest, v[:seg.width])
 		case cpsCounter:
-			binary.LittleEndian.PutUint32(buf[off:], counter)
-			off += 4
+			var v [8]byte
+			putUint(v[:seg.width], uint64(counter), seg.be)
+			off += copy(rest, v[:seg.width])
+		case cpsLength, cpsCRC32, cpsCRC16, cpsChecksum:
+			n := min(seg.width, len(rest))
+			clear(rest[:n]) // filled in by computeFields
+			off += n
 		}
 	}
-	return buf
+	if t.fields != nil {
+		t.computeFields(buf[:off])
+	}
+	return off
 }
 
 // GenerateCPSPackets generates all configured CPS packets (I1->I5 order).
 // counter is incremented for each packet sent.
 func GenerateCPSPackets(templates [5]*CPSTemplate, counter *uint32) [][]byte {
-	packets := make([][]byte, 0, 5)
+	pkts := fillCPSPackets(templates, *counter, make([]byte, cpsTotalSize(templates)), make([][]byte, 0, len(templates)))
+	*counter += uint32(len(pkts))
+	return pkts
+}
+
+// fillCPSPackets is GenerateCPSPackets over caller-owned buffers: buf holds
+// cpsTotalSize(templates) bytes and pkts has room for 5 slice headers. The
+// packets get the counter values first, first+1 and so on. Zero allocations
+// per call.
+func fillCPSPackets(templates [5]*CPSTemplate, first uint32, buf []byte, pkts [][]byte) [][]byte {
+	pkts = pkts[:0]
+	off := 0
 	for _, tmpl := range templates {
 		if tmpl == nil {
 			continue
 		}
-		pkt := tmpl.Generate(*counter)
-		*counter++
-		packets = append(packets, pkt)
+		pkt := buf[off : off+tmpl.size]
+		tmpl.put(pkt, first+uint32(len(pkts)))
+		off += tmpl.size
+		pkts = append(pkts, pkt)
+	}
+	return pkts
+}
+
+// cpsTotalSize returns the combined length of the packets of all templates.
+func cpsTotalSize(templates [5]*CPSTemplate) int {
+	total := 0
+	for _, tmpl := range templates {
+		if tmpl != nil {
+			total += tmpl.size
+		}
 	}
-	return packets
+	return total
 }
 
 // decodeHex decodes a hex string to bytes. Hand-written, no encoding/hex dependency.
 func decodeHex(s string) ([]byte, error) {
 	if len(s)%2 != 0 {
-		return nil, errors.New("odd-length hex string")
+		return nil, &cpsArgError{rest: len(s), msg: "odd-length hex string"}
 	}
 	out := make([]byte, len(s)/2)
 	for i := 0; i < len(s); i += 2 {
 		hi := hexVal(s[i])
 		lo := hexVal(s[i+1])
 		if hi < 0 || lo < 0 {
-			return nil, errors.New("invalid hex char at position " + strconv.Itoa(i))
+			return nil, &cpsArgError{rest: len(s) - i, msg: "invalid hex char"}
 		}
 		out[i/2] = byte(hi<<4 | lo)
 	}
@@ -1,8 +1,11 @@
 package awg
 
 import (
+	"bytes"
 	"encoding/binary"
+	"hash/crc32"
 	"testing"
+	"time"
 )
 
 func TestParseCPSStaticBytes(t *testing.T) {
@@ -319,3 +322,213 @@ func TestDecodeHexErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestCPSFieldLength(t *testing.T) {
+	cases := []struct {
+		tmpl string
+		off  int
+		want []byte
+	}{
+		{"<b 0x01><l><r 10>", 1, []byte{0, 10}},
+		{"<l le 4><r 7>", 0, []byte{7, 0, 0, 0}},
+		{"<l 1><r 300>", 0, []byte{300 & 0xff}},
+		{"<l 3><r 5>", 0, []byte{0, 0, 5}},
+		// STUN: the length covers the attributes after the 20-byte header.
+		{"<b 0x0001><l><b 0x2112a442><r 12><ms><b 0x00260004><r 4><me>", 2, []byte{0, 8}},
+		// UDP-like: the length covers its own header.
+		{"<r 4><ms><r 4><l><r 8><me><r 5>", 8, []byte{0, 14}},
+		// TLS-like: a region nested in the enclosing one comes first...
+		{"<ms><b 0x16><l><ms><r 6><me><r 3><me>", 1, []byte{0, 6}},
+		// ...but regions outside the enclosing one are not used.
+		{"<ms><l><r 2><me><ms><r 7><me>", 0, []byte{0, 4}},
+	}
+	for _, tc := range cases {
+		tmpl, err := ParseCPSTemplate(tc.tmpl)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.tmpl, err)
+		}
+		pkt := tmpl.Generate(0)
+		if got := pkt[tc.off : tc.off+len(tc.want)]; !bytes.Equal(got, tc.want) {
+			t.Fatalf("%s: length field %x, want %x", tc.tmpl, got, tc.want)
+		}
+	}
+}
+
+func TestCPSFieldChecksums(t *testing.T) {
+	// IPv4 header: the checksum covers the header, which then sums to zero.
+	tmpl, err := ParseCPSTemplate("<ms><b 0x4500><l><b 0x000040004011><csum><r 8><me><r 16>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := tmpl.Generate(0)
+	if internetChecksum(pkt[:20]) != 0 {
+		t.Fatalf("IPv4 header checksum does not verify: %x", pkt[:20])
+	}
+	if binary.BigEndian.Uint16(pkt[2:4]) != 20 {
+		t.Fatalf("total length %d, want 20", binary.BigEndian.Uint16(pkt[2:4]))
+	}
+
+	// STUN FINGERPRINT-style trailer: the CRC covers everything before it.
+	tmpl, err = ParseCPSTemplate("<b 0x0001><r 30><crc32>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt = tmpl.Generate(0)
+	if got, want := binary.BigEndian.Uint32(pkt[32:]), crc32.ChecksumIEEE(pkt[:32]); got != want {
+		t.Fatalf("crc32 %08x, want %08x", got, want)
+	}
+
+	tmpl, err = ParseCPSTemplate("<ms><b 0x313233343536373839><me><crc16 le>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt = tmpl.Generate(0)
+	if got := binary.LittleEndian.Uint16(pkt[9:]); got != 0x29b1 { // CRC-16/CCITT-FALSE check value
+		t.Fatalf("crc16 %04x, want 29b1", got)
+	}
+}
+
+// TestCPSFieldOrder checks that a checksum covers the final value of a
+// length field inside its region.
+func TestCPSFieldOrder(t *testing.T) {
+	tmpl, err := ParseCPSTemplate("<ms><csum><l><r 9><me>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := tmpl.Generate(0)
+	if binary.BigEndian.Uint16(pkt[2:4]) != 13 || internetChecksum(pkt) != 0 {
+		t.Fatalf("checksum computed before the length: %x", pkt)
+	}
+}
+
+// TestCPSFieldChecksumOrder checks that a trailing CRC covering an earlier
+// checksum is computed after it.
+func TestCPSFieldChecksumOrder(t *testing.T) {
+	tmpl, err := ParseCPSTemplate("<csum><ms><r 10><me><crc32>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := tmpl.Generate(0)
+	if internetChecksum(pkt[2:12]) != binary.BigEndian.Uint16(pkt[:2]) {
+		t.Fatalf("csum %x does not cover its region", pkt[:2])
+	}
+	if got, want := binary.BigEndian.Uint32(pkt[12:]), crc32.ChecksumIEEE(pkt[:12]); got != want {
+		t.Fatalf("crc32 %08x, want %08x over the final csum", got, want)
+	}
+}
+
+func TestCPSFieldTruncated(t *testing.T) {
+	tmpl, err := ParseCPSTemplate("<b 0xaa><l><r 20><crc32>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	if n := tmpl.put(buf, 0); n != 10 {
+		t.Fatalf("put wrote %d bytes, want 10", n)
+	}
+	if binary.BigEndian.Uint16(buf[1:3]) != 7 {
+		t.Fatalf("truncated length %d, want 7", binary.BigEndian.Uint16(buf[1:3]))
+	}
+}
+
+func TestCPSFieldInvalid(t *testing.T) {
+	cases := []string{
+		"<l 5>",
+		"<l xe>",
+		"<csum le>",
+		"<crc32 2>",
+		"<ms><r 4>",
+		"<r 4><me>",
+		"<ms 1><me>",
+	}
+	for _, tc := range cases {
+		if _, err := ParseCPSTemplate(tc); err == nil {
+			t.Fatalf("expected error for %q", tc)
+		}
+	}
+}
+
+// readUint decodes a width-byte integer written by putUint.
+func readUint(b []byte, be bool) uint64 {
+	var v uint64
+	for i := range b {
+		if be {
+			v = v<<8 | uint64(b[i])
+		} else {
+			v |= uint64(b[i]) << (8 * i)
+		}
+	}
+	return v
+}
+
+func TestCPSCounterAttributes(t *testing.T) {
+	cases := []struct {
+		tag   string
+		width int
+		be    bool
+	}{
+		{"<c>", 4, false},
+		{"<c be>", 4, true},
+		{"<c be 2>", 2, true},
+		{"<c 1>", 1, false},
+		{"<c le 8>", 8, false},
+		{"<c 8 be>", 8, true},
+	}
+	const counter = 0x01020304
+	for _, tc := range cases {
+		tmpl, err := ParseCPSTemplate("<b 0xff>" + tc.tag)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.tag, err)
+		}
+		pkt := tmpl.Generate(counter)
+		if len(pkt) != 1+tc.width {
+			t.Fatalf("%s: %d bytes, want %d", tc.tag, len(pkt), 1+tc.width)
+		}
+		want := uint64(counter)
+		if tc.width < 8 {
+			want &= 1<<(8*tc.width) - 1
+		}
+		if got := readUint(pkt[1:], tc.be); got != want {
+			t.Fatalf("%s: counter %#x, want %#x", tc.tag, got, want)
+		}
+	}
+}
+
+func TestCPSTimestampAttributes(t *testing.T) {
+	cases := []struct {
+		tag   string
+		width int
+		be    bool
+		unit  time.Duration
+	}{
+		{"<t>", 4, false, time.Second},
+		{"<t be>", 4, true, time.Second},
+		{"<t be ms 8>", 8, true, time.Millisecond},
+		{"<t us 8>", 8, false, time.Microsecond},
+		{"<t ns be 8>", 8, true, time.Nanosecond},
+	}
+	for _, tc := range cases {
+		tmpl, err := ParseCPSTemplate(tc.tag)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.tag, err)
+		}
+		before := time.Now().UnixNano() / int64(tc.unit)
+		pkt := tmpl.Generate(0)
+		after := time.Now().UnixNano() / int64(tc.unit)
+		if len(pkt) != tc.width {
+			t.Fatalf("%s: %d bytes, want %d", tc.tag, len(pkt), tc.width)
+		}
+		got := int64(readUint(pkt, tc.be))
+		if got < before || got > after {
+			t.Fatalf("%s: timestamp %d not in [%d, %d]", tc.tag, got, before, after)
+		}
+	}
+}
+
+func TestCPSIntTagInvalid(t *testing.T) {
+	for _, tc := range []string{"<c ms>", "<c 3>", "<t 2>", "<t foo>", "<c be le 16>"} {
+		if _, err := ParseCPSTemplate(tc); err == nil {
+			t.Fatalf("expected error for %q", tc)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package awg
+
+import (
+	"errors"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CPS counter state (AWG_CPS_COUNTER, AWG_CPS_STATE).
+//
+// The <c> tags of all CPS packets sent for a Config share one counter: the
+// handshake preludes, idle CPS packets and every server-mode session. Were
+// it to restart at 0 with the process, a container restart would show up as
+// a counter going back to 0, 1, 2... The counter can be seeded randomly and
+// saved to a state file, so that it continues where it stopped. A clean
+// shutdown saves the exact value; while running, the file holds a value
+// cpsReserve ahead of the counter and is rewritten each time the counter
+// reaches it, so that a crash or power loss skips values instead of
+// repeating them.
+
+// cpsReserve is how far ahead of the counter the state file is saved.
+const cpsReserve = 1024
+
+// CPSCounter returns the value the next <c> tag gets.
+func (c *Config) CPSCounter() uint32 {
+	return c.cpsCounter.Load()
+}
+
+// SetCPSCounter sets the value the next <c> tag gets.
+func (c *Config) SetCPSCounter(v uint32) {
+	c.cpsCounter.Store(v)
+}
+
+// SeedCPSCounter sets the counter to a random value.
+func (c *Config) SeedCPSCounter() {
+	c.cpsCounter.Store(rand.Uint32())
+}
+
+// nextCPSCounter reserves n consecutive counter values and returns the first.
+// With a state file, values past the saved limit are only returned once the
+// file has been saved ahead of them.
+func (c *Config) nextCPSCounter(n int) uint32 {
+	next := c.cpsCounter.Add(uint32(n))
+	if c.cpsState != nil && int32(next-c.cpsLimit.Load()) > 0 {
+		c.cpsState.reserve(c)
+	}
+	return next - uint32(n)
+}
+
+// cpsState is the state file counters are saved ahead to.
+type cpsState struct {
+	mu   sync.Mutex
+	path string
+	cfgs []*Config
+}
+
+// reserve saves the counters of all Configs of the file cpsReserve ahead,
+// unless another caller already has past cfg's counter.
+func (s *cpsState) reserve(cfg *Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if int32(cfg.CPSCounter()-cfg.cpsLimit.Load()) <= 0 {
+		return
+	}
+	if err := s.save(); err != nil {
+		// Keep going rather than retry on every packet; a crash before the
+		// next save may repeat values.
+		LogError(cfg, "AWG_CPS_STATE: ", err.Error())
+	}
+}
+
+// save writes the counters cpsReserve ahead and moves the limits there.
+func (s *cpsState) save() error {
+	limits := make([]uint32, len(s.cfgs))
+	for i, c := range s.cfgs {
+		limits[i] = c.CPSCounter() + cpsReserve
+	}
+	err := writeCPSState(s.path, limits)
+	for i, c := range s.cfgs {
+		c.cpsLimit.Store(limits[i])
+	}
+	return err
+}
+
+// ReserveCPSState makes the counters of cfgs saved ahead to the state file
+// while running, see cpsReserve. It saves the file once before returning and
+// must be called before the Configs are in use.
+func ReserveCPSState(path string, cfgs ...*Config) error {
+	s := &cpsState{path: path, cfgs: cfgs}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.save(); err != nil {
+		return err
+	}
+	for _, c := range cfgs {
+		c.cpsState = s
+	}
+	return nil
+}
+
+// LoadCPSState restores the counters of cfgs from the state file written by
+// SaveCPSState, one decimal value per line in the order of cfgs. ok is false
+// if the file does not exist yet; the counters are then left as they are.
+func LoadCPSState(path string, cfgs ...*Config) (ok bool, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	lines := strings.Fields(string(data))
+	if len(lines) != len(cfgs) {
+		return false, errors.New(path + ": expected " + strconv.Itoa(len(cfgs)) + " counters, got " + strconv.Itoa(len(lines)))
+	}
+	for i, line := range lines {
+		v, err := strconv.ParseUint(line, 10, 32)
+		if err != nil {
+			return false, errors.New(path + ": bad counter \"" + line + "\"")
+		}
+		cfgs[i].SetCPSCounter(uint32(v))
+	}
+	return true, nil
+}
+
+// SaveCPSState writes the counters of cfgs to the state file. The file is
+// replaced atomically and synced, so a crash while saving keeps the previous
+// state.
+func SaveCPSState(path string, cfgs ...*Config) error {
+	vals := make([]uint32, len(cfgs))
+	for i, cfg := range cfgs {
+		vals[i] = cfg.CPSCounter()
+	}
+	return writeCPSState(path, vals)
+}
+
+// writeCPSState replaces the state file with vals, one per line.
+func writeCPSState(path string, vals []uint32) error {
+	var b []byte
+	for _, v := range vals {
+		b = strconv.AppendUint(b, uint64(v), 10)
+		b = append(b, '\n')
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
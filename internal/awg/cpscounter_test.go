@@ -0,0 +1,143 @@
+package awg
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestCPSStateRoundtrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cps.state")
+	a, b := proxyTestConfig(), proxyTestConfig()
+
+	ok, err := LoadCPSState(path, a, b)
+	if ok || err != nil {
+		t.Fatalf("missing file: ok=%v err=%v", ok, err)
+	}
+
+	a.SetCPSCounter(7)
+	a.nextCPSCounter(3)
+	b.SetCPSCounter(0xfffffffe)
+	if err := SaveCPSState(path, a, b); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "10\n4294967294\n" {
+		t.Fatalf("state file %q", data)
+	}
+
+	c, d := proxyTestConfig(), proxyTestConfig()
+	if ok, err := LoadCPSState(path, c, d); !ok || err != nil {
+		t.Fatalf("load: ok=%v err=%v", ok, err)
+	}
+	if c.CPSCounter() != 10 || d.CPSCounter() != 0xfffffffe {
+		t.Fatalf("restored %d and %d", c.CPSCounter(), d.CPSCounter())
+	}
+
+	if _, err := LoadCPSState(path, c); err == nil {
+		t.Fatal("expected an error for a counter count mismatch")
+	}
+	os.WriteFile(path, []byte("x\n"), 0o644)
+	if _, err := LoadCPSState(path, c); err == nil {
+		t.Fatal("expected an error for a bad counter")
+	}
+}
+
+// TestCPSStateReserve checks that the state file stays ahead of every value
+// handed out, so that a crash does not repeat values.
+func TestCPSStateReserve(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cps.state")
+	a, b := proxyTestConfig(), proxyTestConfig()
+	a.SetCPSCounter(0xffffff00) // the limit wraps around
+	if err := ReserveCPSState(path, a, b); err != nil {
+		t.Fatal(err)
+	}
+	saved := func() (uint32, uint32) {
+		c, d := proxyTestConfig(), proxyTestConfig()
+		if ok, err := LoadCPSState(path, c, d); !ok || err != nil {
+			t.Fatalf("load: ok=%v err=%v", ok, err)
+		}
+		return c.CPSCounter(), d.CPSCounter()
+	}
+	if sa, sb := saved(); sa != cpsReserve-0x100 || sb != cpsReserve {
+		t.Fatalf("initial reservation %d and %d", sa, sb)
+	}
+
+	for range 3 * cpsReserve {
+		v := a.nextCPSCounter(2)
+		if sa, _ := saved(); int32(v+2-sa) > 0 {
+			t.Fatalf("value %d handed out past the saved %d", v+1, sa)
+		}
+	}
+	if sa, sb := saved(); sa-a.CPSCounter() > cpsReserve || sb != cpsReserve {
+		t.Fatalf("saved %d and %d, counters %d and %d", sa, sb, a.CPSCounter(), b.CPSCounter())
+	}
+
+	if err := SaveCPSState(path, a, b); err != nil {
+		t.Fatal(err)
+	}
+	if sa, _ := saved(); sa != a.CPSCounter() {
+		t.Fatalf("clean shutdown saved %d, want %d", sa, a.CPSCounter())
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file left behind: %v", err)
+	}
+}
+
+func TestCPSCounterSeed(t *testing.T) {
+	cfg := proxyTestConfig()
+	seen := map[uint32]bool{}
+	for range 4 {
+		cfg.SeedCPSCounter()
+		seen[cfg.CPSCounter()] = true
+	}
+	if len(seen) < 3 {
+		t.Fatalf("seeded counters repeat: %v", seen)
+	}
+}
+
+// TestCPSCounterShared checks that preludes of concurrent senders (server
+// sessions) take distinct counter values from the shared counter.
+func TestCPSCounterShared(t *testing.T) {
+	cfg := proxyTestConfig()
+	tmpl, err := ParseCPSTemplate("<c>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.CPS[0], cfg.CPS[3] = tmpl, tmpl
+	cfg.SetCPSCounter(1000)
+
+	const senders, inits = 4, 200
+	values := make([][]uint32, senders)
+	var wg sync.WaitGroup
+	for i := range senders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			j := newJunkState(cfg)
+			for range inits {
+				for _, pkt := range j.cps(cfg, cfg) {
+					values[i] = append(values[i], binary.LittleEndian.Uint32(pkt))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	seen := map[uint32]bool{}
+	for _, vs := range values {
+		for k, v := range vs {
+			if seen[v] {
+				t.Fatalf("counter value %d sent twice", v)
+			}
+			seen[v] = true
+			if k%2 == 1 && v != vs[k-1]+1 {
+				t.Fatalf("I1 and I4 of one prelude got %d and %d", vs[k-1], v)
+			}
+		}
+	}
+	if len(seen) != senders*inits*2 || cfg.CPSCounter() != 1000+senders*inits*2 {
+		t.Fatalf("%d values, counter %d", len(seen), cfg.CPSCounter())
+	}
+}
@@ -0,0 +1,277 @@
+package awg
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"slices"
+	"strconv"
+)
+
+// Computed CPS fields.
+//
+// Real protocol headers carry lengths and checksums of what follows, and a
+// mimicked header with a wrong length or checksum is easy to spot. Computed
+// fields are written as zeros and filled in once the whole packet is
+// generated:
+//
+//	<l [be|le] [1-4]>    length in bytes (default: big-endian, 2 bytes)
+//	<crc32 [be|le]>      CRC-32 (IEEE), default big-endian
+//	<crc16 [be|le]>      CRC-16/CCITT-FALSE, default big-endian
+//	<csum>               Internet checksum (RFC 1071)
+//
+// A field covers the next region between <ms> and <me> after it (e.g. the
+// attributes after a STUN header), looking only inside the region enclosing
+// the field, if any. Failing that it covers the region that encloses it (the
+// field itself counts as zero, as in IPv4 or UDP). Without a region, lengths
+// and <csum> cover the rest of the packet after the field, as headers do,
+// and CRCs the packet before it, as trailers do. Regions may nest, as TLS
+// records and handshake messages do. Lengths are computed first, then each
+// checksum after the checksums inside its region, so that it covers their
+// final values (e.g. a trailing CRC over a header with a <csum>).
+
+// cpsField is a computed field resolved to byte offsets: the field at
+// [off, off+width) covers [start, end).
+type cpsField struct {
+	kind       byte
+	be         bool
+	off, width int
+	start, end int
+}
+
+// parseCPSFieldTag parses a computed field or region marker tag; ok is false
+// for other tags.
+func parseCPSFieldTag(tag string) (seg cpsSegment, ok bool, err error) {
+	name, args := tag, ""
+	for i := 0; i < len(tag); i++ {
+		if tag[i] == ' ' || tag[i] == '\t' {
+			name, args = tag[:i], trimLeft(tag[i:])
+			break
+		}
+	}
+	switch name {
+	case "ms", "me":
+		seg.kind = cpsMarkStart
+		if name == "me" {
+			seg.kind = cpsMarkEnd
+		}
+		if args != "" {
+			return seg, true, argError(args, args, "<"+name+"> takes no arguments")
+		}
+		return seg, true, nil
+	case "l":
+		seg = cpsSegment{kind: cpsLength, width: 2, be: true}
+	case "crc32":
+		seg = cpsSegment{kind: cpsCRC32, width: 4, be: true}
+	case "crc16":
+		seg = cpsSegment{kind: cpsCRC16, width: 2, be: true}
+	case "csum":
+		seg = cpsSegment{kind: cpsChecksum, width: 2, be: true}
+	default:
+		return seg, false, nil
+	}
+
+	for _, arg := range splitFields(args) {
+		switch {
+		case arg == "be" && seg.kind != cpsChecksum:
+			seg.be = true
+		case arg == "le" && seg.kind != cpsChecksum:
+			seg.be = false
+		case seg.kind == cpsLength && len(arg) == 1 && arg[0] >= '1' && arg[0] <= '4':
+			seg.width, _ = strconv.Atoi(arg)
+		default:
+			return seg, true, argError(args, arg, "invalid argument \""+arg+"\" in <"+name+"> tag")
+		}
+	}
+	return seg, true, nil
+}
+
+// splitFields splits s at spaces and tabs.
+func splitFields(s string) []string {
+	var out []string
+	for s = trimLeft(s); s != ""; s = trimLeft(s) {
+		i := 0
+		for i < len(s) && s[i] != ' ' && s[i] != '\t' {
+			i++
+		}
+		out = append(out, s[:i])
+		s = s[i:]
+	}
+	return out
+}
+
+// resolveCPSFields computes the offsets and regions of the computed fields
+// in segs, in evaluation order. It returns nil if there are none.
+func resolveCPSFields(segs []cpsSegment) ([]cpsField, error) {
+	type region struct{ start, end, pos int }
+	var (
+		regions []region // in order of <ms>
+		open    []int    // indices into regions of unclosed <ms>
+		fields  []cpsField
+		inside  []int // enclosing region of each field, -1 = none
+	)
+	off := 0
+	for _, seg := range segs {
+		switch seg.kind {
+		case cpsMarkStart:
+			open = append(open, len(regions))
+			regions = append(regions, region{start: off, pos: seg.pos})
+		case cpsMarkEnd:
+			if len(open) == 0 {
+				return nil, &CPSError{Pos: seg.pos, Msg: "<me> without <ms>"}
+			}
+			regions[open[len(open)-1]].end = off
+			open = open[:len(open)-1]
+		case cpsLength, cpsCRC32, cpsCRC16, cpsChecksum:
+			enc := -1
+			if len(open) > 0 {
+				enc = open[len(open)-1]
+			}
+			fields = append(fields, cpsField{kind: seg.kind, be: seg.be, off: off, width: seg.width})
+			inside = append(inside, enc)
+		}
+		off += seg.len()
+	}
+	if len(open) > 0 {
+		return nil, &CPSError{Pos: regions[open[len(open)-1]].pos, Msg: "<ms> without <me>"}
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	for i := range fields {
+		f := &fields[i]
+		f.start, f.end = f.off+f.width, off
+		if f.kind == cpsCRC32 || f.kind == cpsCRC16 {
+			f.start, f.end = 0, f.off
+		}
+		limit := off
+		if enc := inside[i]; enc >= 0 {
+			f.start, f.end = regions[enc].start, regions[enc].end
+			limit = regions[enc].end
+		}
+		for _, r := range regions {
+			if r.start >= f.off+f.width && r.end <= limit {
+				f.start, f.end = r.start, r.end
+				break
+			}
+		}
+	}
+	// Lengths first: their values do not depend on the bytes they cover.
+	// Then each checksum after the checksums inside its region; fields that
+	// cover each other are computed from the last to the first.
+	slices.SortStableFunc(fields, func(a, b cpsField) int {
+		if (a.kind == cpsLength) != (b.kind == cpsLength) {
+			if a.kind == cpsLength {
+				return -1
+			}
+			return 1
+		}
+		return 0
+	})
+	n := 0
+	for n < len(fields) && fields[n].kind == cpsLength {
+		n++
+	}
+	orderChecksums(fields[n:])
+	return fields, nil
+}
+
+// orderChecksums reorders the checksum fields in fs so that a field whose
+// region contains another field comes after it.
+func orderChecksums(fs []cpsField) {
+	for i := range fs {
+		// Pick the remaining field that covers no other remaining field, or
+		// the last by offset if they all do.
+		pick := -1
+		for j := i; j < len(fs) && pick < 0; j++ {
+			pick = j
+			for k := i; k < len(fs); k++ {
+				if k != j && fs[j].covers(fs[k]) {
+					pick = -1
+					break
+				}
+			}
+		}
+		if pick < 0 {
+			pick = i
+			for j := i + 1; j < len(fs); j++ {
+				if fs[j].off > fs[pick].off {
+					pick = j
+				}
+			}
+		}
+		fs[i], fs[pick] = fs[pick], fs[i]
+	}
+}
+
+// covers reports whether f's region overlaps the bytes of field g.
+func (f cpsField) covers(g cpsField) bool {
+	return f.start < g.off+g.width && g.off < f.end
+}
+
+// computeFields fills in the computed fields of the generated packet b. Fields
+// cut off by truncation are skipped and regions are clipped to b.
+func (t *CPSTemplate) computeFields(b []byte) {
+	for _, f := range t.fields {
+		if f.off+f.width > len(b) {
+			continue
+		}
+		end := min(f.end, len(b))
+		region := b[min(f.start, end):end]
+		var v uint64
+		switch f.kind {
+		case cpsLength:
+			v = uint64(len(region))
+		case cpsCRC32:
+			v = uint64(crc32.ChecksumIEEE(region))
+		case cpsCRC16:
+			v = uint64(crc16CCITT(region))
+		case cpsChecksum:
+			v = uint64(internetChecksum(region))
+		}
+		putUint(b[f.off:f.off+f.width], v, f.be)
+	}
+}
+
+// putUint writes the low len(b) bytes of v into b.
+func putUint(b []byte, v uint64, be bool) {
+	for i := range b {
+		if be {
+			b[len(b)-1-i] = byte(v >> (8 * i))
+		} else {
+			b[i] = byte(v >> (8 * i))
+		}
+	}
+}
+
+// crc16CCITT computes CRC-16/CCITT-FALSE (polynomial 0x1021, initial value
+// 0xffff, not reflected).
+func crc16CCITT(b []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// internetChecksum computes the one's complement checksum of RFC 1071.
+func internetChecksum(b []byte) uint16 {
+	var sum uint32
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(binary.BigEndian.Uint16(b))
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,195 @@
+package awg
+
+import (
+	"errors"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CPS send policies (AWG_I1_POLICY-AWG_I5_POLICY).
+//
+// By default every configured CPS packet precedes every handshake init.
+// Censors differ in what they key on: some only look at the first packets of
+// a flow, others at packets that repeat every two minutes. A policy restricts
+// when a template is sent before handshake inits and can also send it on its
+// own while the client is idle. Policies are comma-separated terms:
+//
+//	always      before every handshake init (the default)
+//	never       never before a handshake init (useful with idle)
+//	first       only before the first init after start or a reconnect
+//	every:N     before the 1st, N+1th, 2N+1th... init after start or a reconnect
+//	prob:P      with probability P (0 < P <= 1), combined with the terms above
+//	idle:S      also every S seconds while the client sends nothing
+//
+// Only inits that carry CPS packets at all are counted (see RetryPolicy.CPS).
+
+// CPSPolicy decides when a CPS template is sent. The zero value sends it
+// before every handshake init.
+type CPSPolicy struct {
+	Never bool          // not sent before handshake inits
+	First bool          // only before the first handshake init after start or a reconnect
+	Every int           // only before every Every-th handshake init (0 or 1 = every one)
+	Prob  float64       // probability of being sent (0 = always)
+	Idle  time.Duration // also sent after this long without client packets (0 = never)
+}
+
+// ParseCPSPolicy parses an AWG_I1_POLICY-AWG_I5_POLICY value such as
+// "first", "every:5,prob:0.5" or "never,idle:60".
+func ParseCPSPolicy(s string) (CPSPolicy, error) {
+	var p CPSPolicy
+	mode := ""
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		name, arg, hasArg := strings.Cut(term, ":")
+		switch name {
+		case "always", "never", "first":
+			if hasArg {
+				return CPSPolicy{}, errors.New("\"" + name + "\" takes no argument")
+			}
+		case "every", "prob", "idle":
+			if !hasArg {
+				return CPSPolicy{}, errors.New("\"" + name + "\" needs an argument, e.g. " + name + ":" + cpsPolicyExample(name))
+			}
+		default:
+			return CPSPolicy{}, errors.New("unknown term \"" + term + "\", expected always, never, first, every:N, prob:P or idle:S")
+		}
+		switch name {
+		case "always", "never", "first", "every":
+			if mode != "" {
+				return CPSPolicy{}, errors.New("\"" + name + "\" conflicts with \"" + mode + "\"")
+			}
+			mode = name
+		}
+
+		switch name {
+		case "never":
+			p.Never = true
+		case "first":
+			p.First = true
+		case "every":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 {
+				return CPSPolicy{}, errors.New("every: expected a count >= 1, got \"" + arg + "\"")
+			}
+			p.Every = n
+		case "prob":
+			v, err := strconv.ParseFloat(arg, 64)
+			if err != nil || !(v > 0 && v <= 1) {
+				return CPSPolicy{}, errors.New("prob: expected 0 < P <= 1, got \"" + arg + "\"")
+			}
+			p.Prob = v
+		case "idle":
+			sec, err := strconv.Atoi(arg)
+			if err != nil || sec < 1 {
+				return CPSPolicy{}, errors.New("idle: expected seconds >= 1, got \"" + arg + "\"")
+			}
+			p.Idle = time.Duration(sec) * time.Second
+		}
+	}
+	return p, nil
+}
+
+// cpsPolicyExample returns an example argument for a policy term.
+func cpsPolicyExample(name string) string {
+	switch name {
+	case "every":
+		return "5"
+	case "prob":
+		return "0.5"
+	}
+	return "60"
+}
+
+// beforeInit reports whether the template goes before the handshake init
+// number n (0-based) since start or the last reconnect.
+func (p *CPSPolicy) beforeInit(n uint64) bool {
+	switch {
+	case p.Never:
+		return false
+	case p.First && n > 0:
+		return false
+	case p.Every > 1 && n%uint64(p.Every) != 0:
+		return false
+	}
+	return p.Prob == 0 || rand.Float64() < p.Prob
+}
+
+// String returns the policy in the ParseCPSPolicy syntax.
+func (p CPSPolicy) String() string {
+	var terms []string
+	switch {
+	case p.Never:
+		terms = append(terms, "never")
+	case p.First:
+		terms = append(terms, "first")
+	case p.Every > 1:
+		terms = append(terms, "every:"+strconv.Itoa(p.Every))
+	default:
+		terms = append(terms, "always")
+	}
+	if p.Prob > 0 {
+		terms = append(terms, "prob:"+strconv.FormatFloat(p.Prob, 'g', -1, 64))
+	}
+	if p.Idle > 0 {
+		terms = append(terms, "idle:"+strconv.Itoa(int(p.Idle/time.Second)))
+	}
+	return strings.Join(terms, ",")
+}
+
+// startIdle stops the idle senders of the previous transformer and, once
+// Run has started, starts those of tr (see IdleSender).
+func (p *Proxy) startIdle(tr Transformer) {
+	p.idleMu.Lock()
+	defer p.idleMu.Unlock()
+	if p.idleStop != nil {
+		close(p.idleStop)
+		p.idleStop = nil
+	}
+	is, ok := tr.(IdleSender)
+	if p.runStop == nil || !ok {
+		return
+	}
+	p.idleStop = make(chan struct{})
+	for _, pkt := range is.IdlePackets() {
+		go p.idleSend(pkt, p.runStop, p.idleStop)
+	}
+}
+
+// idleSend sends pkt every pkt.Interval while no client packet has been
+// sent to the server, so that an idle tunnel keeps showing the mimicked
+// protocol, until stop or replaced is closed.
+func (p *Proxy) idleSend(pkt IdlePacket, stop, replaced <-chan struct{}) {
+	ticker := time.NewTicker(pkt.Interval)
+	defer ticker.Stop()
+	last := p.stats.pktsOut.Load()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-replaced:
+			return
+		case <-ticker.C:
+		}
+		if out := p.stats.pktsOut.Load(); out != last {
+			last = out
+			continue
+		}
+		rc := p.remoteConn.Load()
+		if rc == nil || p.parent != nil && p.clientAddr.Load() == nil {
+			continue // not running, or a lane without a tunnel
+		}
+		b := pkt.Generate()
+		if _, err := rc.Write(b); err != nil {
+			continue // reconnect in progress
+		}
+		p.stats.cpsSent.Add(1)
+		if p.capture != nil {
+			p.captureServerSide(captureOut, rc, b, pkt.Name+" idle")
+		}
+		if p.cfg.logLevel() >= LevelDebug {
+			LogDebug(p.cfg, "c->s: idle ", pkt.Name, " ", strconv.Itoa(len(b)), "B sent")
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package awg
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseCPSPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want CPSPolicy
+	}{
+		{"always", CPSPolicy{}},
+		{"never", CPSPolicy{Never: true}},
+		{"first", CPSPolicy{First: true}},
+		{"every:5", CPSPolicy{Every: 5}},
+		{"prob:0.25", CPSPolicy{Prob: 0.25}},
+		{"every:3, prob:0.5", CPSPolicy{Every: 3, Prob: 0.5}},
+		{"never,idle:60", CPSPolicy{Never: true, Idle: time.Minute}},
+		{"first,idle:30", CPSPolicy{First: true, Idle: 30 * time.Second}},
+	} {
+		got, err := ParseCPSPolicy(tc.in)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.in, err)
+		}
+		if got != tc.want {
+			t.Fatalf("%q: got %+v, want %+v", tc.in, got, tc.want)
+		}
+		back, err := ParseCPSPolicy(got.String())
+		if err != nil || back != got {
+			t.Fatalf("%q: String() = %q does not round-trip", tc.in, got.String())
+		}
+	}
+	for _, in := range []string{"", "sometimes", "first:1", "every", "every:0", "every:x", "prob:0", "prob:1.5",
+		"idle:0", "idle:1s", "first,every:2", "never,always"} {
+		if _, err := ParseCPSPolicy(in); err == nil {
+			t.Fatalf("%q: expected an error", in)
+		}
+	}
+}
+
+func TestCPSPolicyBeforeInit(t *testing.T) {
+	for _, tc := range []struct {
+		policy CPSPolicy
+		want   string // 1 = sent, for inits 0..7
+	}{
+		{CPSPolicy{}, "11111111"},
+		{CPSPolicy{Never: true, Idle: time.Second}, "00000000"},
+		{CPSPolicy{First: true}, "10000000"},
+		{CPSPolicy{Every: 3}, "10010010"},
+		{CPSPolicy{Every: 1}, "11111111"},
+		{CPSPolicy{Prob: 1}, "11111111"},
+	} {
+		var got []byte
+		for n := range uint64(8) {
+			if tc.policy.beforeInit(n) {
+				got = append(got, '1')
+			} else {
+				got = append(got, '0')
+			}
+		}
+		if string(got) != tc.want {
+			t.Fatalf("%s: got %s, want %s", tc.policy, got, tc.want)
+		}
+	}
+
+	p := CPSPolicy{Prob: 0.5}
+	sent := 0
+	for range 1000 {
+		if p.beforeInit(0) {
+			sent++
+		}
+	}
+	if sent < 350 || sent > 650 {
+		t.Fatalf("prob:0.5 sent %d of 1000", sent)
+	}
+}
+
+// cpsPolicyConfig returns a config with three distinguishable CPS templates.
+func cpsPolicyConfig(t *testing.T) *Config {
+	cfg := proxyTestConfig()
+	for i, s := range []string{"<b 0x11>", "<b 0x2222>", "<b 0x333333>"} {
+		tmpl, err := ParseCPSTemplate(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.CPS[i] = tmpl
+	}
+	return cfg
+}
+
+// preludeSizes returns the sizes of the CPS packets of the next prelude, as digits.
+func preludeSizes(tr Transformer) string {
+	cpsPkts, _ := tr.Prelude(true, 0)
+	var b []byte
+	for _, pkt := range cpsPkts {
+		b = append(b, '0'+byte(len(pkt)))
+	}
+	return string(b)
+}
+
+func TestAmneziaPreludeCPSPolicy(t *testing.T) {
+	cfg := cpsPolicyConfig(t)
+	cfg.CPSPolicy[0] = CPSPolicy{First: true}
+	cfg.CPSPolicy[1] = CPSPolicy{Every: 2}
+	tr := NewAmneziaTransformer(cfg)
+
+	want := []string{"123", "3", "23", "3", "23"}
+	for i, w := range want {
+		if got := preludeSizes(tr); got != w {
+			t.Fatalf("init %d: CPS packets of sizes %s, want %s", i, got, w)
+		}
+	}
+	if cpsPkts, _ := tr.Prelude(false, 0); cpsPkts != nil {
+		t.Fatal("CPS packets without cps")
+	}
+
+	tr.Reset()
+	for i, w := range want {
+		if got := preludeSizes(tr); got != w {
+			t.Fatalf("init %d after Reset: CPS packets of sizes %s, want %s", i, got, w)
+		}
+	}
+	if n := testing.AllocsPerRun(100, func() { tr.Prelude(true, cfg.Jc) }); n != 0 {
+		t.Fatalf("Prelude with policies allocates %v times per call", n)
+	}
+}
+
+func TestProxyIdleCPS(t *testing.T) {
+	cfg := cpsPolicyConfig(t)
+	cfg.CPSPolicy[0] = CPSPolicy{Never: true, Idle: time.Second}
+	cfg.CPS[1], cfg.CPS[2] = nil, nil
+
+	server := startMockServer(t)
+	defer server.Close()
+	proxyAddr, stop := startProxy(t, cfg, server.LocalAddr().(*net.UDPAddr))
+	defer stop()
+
+	pkts := readPackets(server, 2500*time.Millisecond, 2)
+	if len(pkts) != 2 {
+		t.Fatalf("got %d idle CPS packets in 2.5s, want 2", len(pkts))
+	}
+	for _, pkt := range pkts {
+		if !bytes.Equal(pkt, []byte{0x11}) {
+			t.Fatalf("idle packet %x, want I1", pkt)
+		}
+	}
+
+	// Client traffic suppresses idle packets.
+	client := dialUDP(t, proxyAddr)
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(200 * time.Millisecond):
+				client.Write(makeWGPacket(wgTransportData, 64))
+			}
+		}
+	}()
+	got := readPackets(server, 2500*time.Millisecond, 100)
+	close(done)
+	for _, pkt := range got {
+		if len(pkt) == 1 {
+			t.Fatal("idle CPS packet sent while the client was active")
+		}
+	}
+	if len(got) == 0 {
+		t.Fatal("no transport packets forwarded")
+	}
+}
@@ -0,0 +1,115 @@
+package awg
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// CPS template preview (awg-proxy cps render).
+
+// cpsHeaderLen is the packet prefix checked for a recognisable header.
+const cpsHeaderLen = 16
+
+// RenderCPS parses the CPS template or preset s as AWG_I1-I5 values are
+// parsed and describes what it sends: the offset and size of each segment,
+// hex dumps of the given number of sample packets, and warnings about
+// packets exceeding pathMTU or lacking a recognisable header.
+func RenderCPS(s string, samples, pathMTU int) (string, error) {
+	tmpl, err := ParseCPSValue(s)
+	if err != nil {
+		return "", err
+	}
+	size := tmpl.Size()
+
+	var b strings.Builder
+	b.WriteString("size: " + strconv.Itoa(size) + " bytes, " + strconv.Itoa(len(tmpl.segments)) + " segments\n")
+	b.WriteString("offset   size  tag\n")
+	off := 0
+	random := 0 // <r> bytes within the first cpsHeaderLen bytes
+	for _, seg := range tmpl.segments {
+		n := seg.len()
+		b.WriteString(padLeft(strconv.Itoa(off), 6) + padLeft(strconv.Itoa(n), 7) + "  <" + seg.tag + ">\n")
+		if seg.kind == cpsRandom {
+			random += max(min(off+n, cpsHeaderLen)-off, 0)
+		}
+		off += n
+	}
+
+	var all []byte
+	for i := range samples {
+		pkt := tmpl.Generate(uint32(i))
+		all = append(all, pkt...)
+		b.WriteString("\nsample " + strconv.Itoa(i+1) + ":\n" + hexDump(pkt))
+	}
+	if samples > 0 {
+		b.WriteString("\nentropy: " + strconv.FormatFloat(byteEntropy(all), 'f', 2, 64) + " bits/byte over " +
+			strconv.Itoa(samples) + " samples\n")
+	}
+
+	if size+udpIPv4Overhead > pathMTU {
+		b.WriteString("warning: " + strconv.Itoa(size) + "-byte packets exceed the path MTU " + strconv.Itoa(pathMTU) +
+			" with the IPv4 and UDP headers and will be fragmented or dropped\n")
+	}
+	if head := min(size, cpsHeaderLen); random*4 >= head*3 {
+		b.WriteString("warning: high-entropy template: " + strconv.Itoa(random) + " of the first " + strconv.Itoa(head) +
+			" bytes are random, so there is no protocol header to recognise\n")
+	}
+	return b.String(), nil
+}
+
+// hexDump formats b as lines of 16 bytes with the offset and printable ASCII.
+func hexDump(b []byte) string {
+	const digits = "0123456789abcdef"
+	var sb strings.Builder
+	for off := 0; off < len(b); off += 16 {
+		line := b[off:min(off+16, len(b))]
+		o := strconv.FormatInt(int64(off), 16)
+		sb.WriteString(strings.Repeat("0", max(4-len(o), 0)) + o + " ")
+		for i := range 16 {
+			if i < len(line) {
+				sb.WriteByte(' ')
+				sb.WriteByte(digits[line[i]>>4])
+				sb.WriteByte(digits[line[i]&0x0f])
+			} else {
+				sb.WriteString("   ")
+			}
+		}
+		sb.WriteString("  |")
+		for _, c := range line {
+			if c < 0x20 || c > 0x7e {
+				c = '.'
+			}
+			sb.WriteByte(c)
+		}
+		sb.WriteString("|\n")
+	}
+	return sb.String()
+}
+
+// byteEntropy returns the Shannon entropy of the bytes in b, in bits per byte.
+func byteEntropy(b []byte) float64 {
+	if len(b) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	e := 0.0
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(b))
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
+
+// padLeft pads s with spaces to width.
+func padLeft(s string, width int) string {
+	if len(s) >= width {
+		return s
+	}
+	return strings.Repeat(" ", width-len(s)) + s
+}
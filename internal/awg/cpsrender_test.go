@@ -0,0 +1,80 @@
+package awg
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCPSErrorPosition(t *testing.T) {
+	cases := []struct {
+		tmpl string
+		pos  int
+	}{
+		{"<b 0xdead> x", 11},
+		{"<b 0xdead><r 16", 10},
+		{"<b 0xdead><r 16><x 1>", 16},
+		{"<b 0x00>  <r 0>", 13},
+		{"<r 16x>", 3},
+		{"<b 0xdeaz>", 7},
+		{"<t be 2>", 6},
+		{"<l le l>", 6},
+		{"<r 4><me>", 5},
+		{"<r 4><ms><ms><me>", 5},
+	}
+	for _, tc := range cases {
+		_, err := ParseCPSTemplate(tc.tmpl)
+		var perr *CPSError
+		if !errors.As(err, &perr) {
+			t.Fatalf("%q: error %v is not a *CPSError", tc.tmpl, err)
+		}
+		if perr.Pos != tc.pos {
+			t.Fatalf("%q: position %d, want %d (%v)", tc.tmpl, perr.Pos, tc.pos, err)
+		}
+	}
+}
+
+func TestRenderCPS(t *testing.T) {
+	report, err := RenderCPS("<b 0x0001><l><b 0x2112a442><r 12>", 2, DefaultPathMTU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"size: 20 bytes, 4 segments",
+		"     2      2  <l>",
+		"     8     12  <r 12>",
+		"sample 2:\n0000  00 01 00 10 21 12 a4 42",
+		"entropy: ",
+	} {
+		if !strings.Contains(report, want) {
+			t.Fatalf("report lacks %q:\n%s", want, report)
+		}
+	}
+	if strings.Contains(report, "warning") {
+		t.Fatalf("unexpected warning:\n%s", report)
+	}
+
+	report, err = RenderCPS("<r 1480>", 0, DefaultPathMTU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(report, "exceed the path MTU") || !strings.Contains(report, "high-entropy") {
+		t.Fatalf("missing warnings:\n%s", report)
+	}
+	if strings.Contains(report, "sample") {
+		t.Fatalf("samples rendered with n=0:\n%s", report)
+	}
+
+	if _, err := RenderCPS("@preset:nope", 1, DefaultPathMTU); err == nil {
+		t.Fatal("unknown preset accepted")
+	}
+}
+
+func TestHexDump(t *testing.T) {
+	got := hexDump([]byte("GET / HTTP/1.1\r\n\x00A"))
+	want := "0000  47 45 54 20 2f 20 48 54 54 50 2f 31 2e 31 0d 0a  |GET / HTTP/1.1..|\n" +
+		"0010  00 41                                            |.A|\n"
+	if got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
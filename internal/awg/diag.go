@@ -0,0 +1,287 @@
+package awg
+
+import (
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Inbound drop diagnostics.
+//
+// When S2/H2 (or S4/H4) do not match the server, TransformInbound rejects
+// every response and the tunnel silently never comes up. inboundDiag keeps
+// a bounded histogram of dropped packets by size and by first-4-byte value,
+// plus a small ring of samples, and derives actionable hints from them.
+
+const (
+	diagMaxBuckets = 64  // distinct sizes / header values tracked
+	diagSamples    = 32  // ring of recent dropped packets
+	diagSampleLen  = 512 // bytes kept per sample
+	diagHintAfter  = 3   // same-size drops before a hint is logged
+	diagMaxPadding = 256 // largest S value considered when inferring
+	diagBudget     = 64  // drops recorded per check interval outside diagnose mode
+)
+
+type diagSample struct {
+	size int
+	data []byte // first diagSampleLen bytes
+}
+
+type inboundDiag struct {
+	mu      sync.Mutex
+	total   uint64
+	sizes   map[int]uint64    // drop count by packet size
+	heads   map[uint32]uint64 // drop count by first 4 bytes (LE)
+	other   uint64            // drops not tracked because the maps are full
+	hinted  map[int]bool      // sizes already hinted about
+	s4Hint  bool              // transport mismatch already hinted about
+	samples [diagSamples]diagSample
+	next    int
+}
+
+func newInboundDiag() *inboundDiag {
+	d := &inboundDiag{
+		sizes:  make(map[int]uint64),
+		heads:  make(map[uint32]uint64),
+		hinted: make(map[int]bool),
+	}
+	for i := range d.samples {
+		d.samples[i].data = make([]byte, 0, diagSampleLen)
+	}
+	return d
+}
+
+// record accounts a dropped inbound packet and returns a hint to log, if any.
+// handshakeSeen reports whether a valid handshake response was received;
+// size-based guesses are only offered before that.
+func (d *inboundDiag) record(pkt []byte, cfg *Config, handshakeSeen bool) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := len(pkt)
+	d.total++
+	if _, ok := d.sizes[n]; ok || len(d.sizes) < diagMaxBuckets {
+		d.sizes[n]++
+	} else {
+		d.other++
+	}
+	if n >= 4 {
+		h := binary.LittleEndian.Uint32(pkt[:4])
+		if _, ok := d.heads[h]; ok || len(d.heads) < diagMaxBuckets {
+			d.heads[h]++
+		}
+	}
+
+	s := &d.samples[d.next]
+	s.size = n
+	s.data = append(s.data[:0], pkt[:min(n, diagSampleLen)]...)
+	d.next = (d.next + 1) % diagSamples
+
+	if !d.s4Hint && (d.total == 16 || d.total%1024 == 0) {
+		if s4, h4, ok := d.inferTransport(cfg); ok && (s4 != cfg.S4 || !cfg.H4.Contains(h4.Min) || !cfg.H4.Contains(h4.Max)) {
+			d.s4Hint = true
+			return "dropped packets look like transport data with S4=" + strconv.Itoa(s4) + ", H4=" + rangeString(h4) +
+				" -- check S4/H4 (configured S4=" + strconv.Itoa(cfg.S4) + ", H4=" + rangeString(cfg.H4) + ")"
+		}
+	}
+	if d.sizes[n] < diagHintAfter || d.hinted[n] {
+		return ""
+	}
+	hint := d.sizeHint(n, cfg, handshakeSeen)
+	if hint != "" {
+		d.hinted[n] = true
+	}
+	return hint
+}
+
+// sizeHint explains why packets of size n are dropped. Caller holds d.mu.
+func (d *inboundDiag) sizeHint(n int, cfg *Config, handshakeSeen bool) string {
+	count := strconv.FormatUint(d.sizes[n], 10)
+	prefix := "received " + count + " packets of " + strconv.Itoa(n) + " bytes"
+
+	check := func(off int, r HRange, name, sName string) string {
+		lo, hi, ok := d.headerSpan(n, off)
+		if !ok {
+			return ""
+		}
+		return prefix + " whose header at offset " + strconv.Itoa(off) + " is " + spanString(lo, hi) +
+			", outside " + name + "=" + rangeString(r) + " -- check " + name + " (size matches " + sName + ")"
+	}
+	switch n {
+	case cfg.respTotal:
+		return check(cfg.S2, cfg.H2, "H2", "S2")
+	case cfg.initTotal:
+		return check(cfg.S1, cfg.H1, "H1", "S1")
+	case cfg.cookieTotal:
+		return check(cfg.S3, cfg.H3, "H3", "S3")
+	}
+	if handshakeSeen {
+		return ""
+	}
+	// A consistent header at n-92 suggests handshake responses with a different S2.
+	if off := n - WgHandshakeResponseSize; off >= 0 && off <= diagMaxPadding {
+		if lo, hi, ok := d.headerSpan(n, off); ok && lo == hi {
+			return prefix + " whose header at offset " + strconv.Itoa(off) + " is " + spanString(lo, hi) +
+				" and in no H range -- if these are handshake responses, check S2/H2 (would fit S2=" +
+				strconv.Itoa(off) + ", H2=" + spanString(lo, hi) + "; configured S2=" + strconv.Itoa(cfg.S2) +
+				", H2=" + rangeString(cfg.H2) + ")"
+		}
+	}
+	return ""
+}
+
+// headerSpan returns the min/max LE uint32 at off across samples of size n.
+func (d *inboundDiag) headerSpan(n, off int) (lo, hi uint32, ok bool) {
+	for i := range d.samples {
+		s := &d.samples[i]
+		if s.size != n || off+4 > len(s.data) {
+			continue
+		}
+		h := binary.LittleEndian.Uint32(s.data[off : off+4])
+		if !ok {
+			lo, hi, ok = h, h, true
+			continue
+		}
+		lo, hi = min(lo, h), max(hi, h)
+	}
+	return
+}
+
+// inferTransport looks for a padding length k such that the samples carry a
+// constant receiver index at k+4 and small, distinct counters at k+8 -- the
+// signature of WireGuard transport data with S4=k. A fixed H4 also makes
+// k-1..k-3 look consistent, so the largest matching k wins. Samples that
+// look like junk (see isJunk) are skipped. Caller holds d.mu.
+func (d *inboundDiag) inferTransport(cfg *Config) (s4 int, h4 HRange, ok bool) {
+	var junk [diagSamples]bool
+	for i := range d.samples {
+		junk[i] = isJunk(&d.samples[i], cfg)
+	}
+	for k := diagMaxPadding; k >= 0; k-- {
+		var idx uint32
+		var counters []uint64
+		matched := 0
+		consistent := true
+		for i := range d.samples {
+			s := &d.samples[i]
+			if junk[i] || s.size < k+WgTransportMinSize || k+16 > len(s.data) {
+				continue
+			}
+			ri := binary.LittleEndian.Uint32(s.data[k+4 : k+8])
+			ctr := binary.LittleEndian.Uint64(s.data[k+8 : k+16])
+			if matched == 0 {
+				idx = ri
+			}
+			if ri != idx || ctr > 1<<40 {
+				consistent = false
+				break
+			}
+			for _, c := range counters {
+				if c == ctr {
+					consistent = false
+				}
+			}
+			counters = append(counters, ctr)
+			h := binary.LittleEndian.Uint32(s.data[k : k+4])
+			if matched == 0 {
+				h4 = HRange{Min: h, Max: h}
+			} else {
+				h4.Min, h4.Max = min(h4.Min, h), max(h4.Max, h)
+			}
+			matched++
+		}
+		if consistent && matched >= diagHintAfter {
+			return k, h4, true
+		}
+	}
+	return 0, HRange{}, false
+}
+
+// isJunk reports whether a sample may be a junk packet from the server: its
+// size is in [Jmin, Jmax] and no configured S offset holds a header in the
+// matching H range.
+func isJunk(s *diagSample, cfg *Config) bool {
+	if cfg.Jc <= 0 || cfg.Jmax <= 0 || s.size < cfg.Jmin || s.size > cfg.Jmax {
+		return false
+	}
+	for _, m := range [...]struct {
+		off int
+		r   HRange
+	}{{cfg.S1, cfg.H1}, {cfg.S2, cfg.H2}, {cfg.S3, cfg.H3}, {cfg.S4, cfg.H4}} {
+		if m.off+4 <= len(s.data) && m.r.Contains(binary.LittleEndian.Uint32(s.data[m.off:])) {
+			return false
+		}
+	}
+	return true
+}
+
+// inferResponse looks for sizes whose header at size-92 is constant across
+// samples, suggesting handshake responses with S2=size-92. Caller holds d.mu.
+func (d *inboundDiag) inferResponse() (s2 int, h2 HRange, ok bool) {
+	best := uint64(0)
+	for n, count := range d.sizes {
+		off := n - WgHandshakeResponseSize
+		if off < 0 || off > diagMaxPadding || count < 2 || count <= best {
+			continue
+		}
+		if lo, hi, found := d.headerSpan(n, off); found && lo == hi {
+			s2, h2, ok, best = off, HRange{Min: lo, Max: hi}, true, count
+		}
+	}
+	return
+}
+
+// report renders the histograms and inferred parameters. Caller holds d.mu.
+func (d *inboundDiag) report(cfg *Config) string {
+	out := "dropped=" + strconv.FormatUint(d.total, 10) + "\n"
+	sizes := make([]int, 0, len(d.sizes))
+	for n := range d.sizes {
+		sizes = append(sizes, n)
+	}
+	sort.Ints(sizes)
+	for _, n := range sizes {
+		out += "size " + strconv.Itoa(n) + ": " + strconv.FormatUint(d.sizes[n], 10) + "\n"
+	}
+	if d.other > 0 {
+		out += "size other: " + strconv.FormatUint(d.other, 10) + "\n"
+	}
+	heads := make([]uint32, 0, len(d.heads))
+	for h := range d.heads {
+		heads = append(heads, h)
+	}
+	sort.Slice(heads, func(i, j int) bool { return d.heads[heads[i]] > d.heads[heads[j]] })
+	for i, h := range heads {
+		if i == 8 {
+			break
+		}
+		out += "head " + strconv.FormatUint(uint64(h), 10) + ": " + strconv.FormatUint(d.heads[h], 10) + "\n"
+	}
+	if s2, h2, ok := d.inferResponse(); ok {
+		out += "inferred: S2=" + strconv.Itoa(s2) + " H2=" + rangeString(h2) +
+			" (configured S2=" + strconv.Itoa(cfg.S2) + " H2=" + rangeString(cfg.H2) + ")\n"
+	}
+	if s4, h4, ok := d.inferTransport(cfg); ok {
+		out += "inferred: S4=" + strconv.Itoa(s4) + " H4=" + rangeString(h4) +
+			" (configured S4=" + strconv.Itoa(cfg.S4) + " H4=" + rangeString(cfg.H4) + ")\n"
+	}
+	return out
+}
+
+// Report returns the drop histogram and inferred parameters (thread-safe).
+func (d *inboundDiag) Report(cfg *Config) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.report(cfg)
+}
+
+func rangeString(r HRange) string {
+	return spanString(r.Min, r.Max)
+}
+
+func spanString(lo, hi uint32) string {
+	if lo == hi {
+		return strconv.FormatUint(uint64(lo), 10)
+	}
+	return strconv.FormatUint(uint64(lo), 10) + "-" + strconv.FormatUint(uint64(hi), 10)
+}
@@ -0,0 +1,149 @@
+package awg
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// paddedPacket builds a packet with pad random-looking bytes, then a 4-byte
+// header h, then body bytes up to total size.
+func paddedPacket(pad int, h uint32, total int, seed byte) []byte {
+	pkt := make([]byte, total)
+	for i := range pkt {
+		pkt[i] = byte(i)*31 + seed
+	}
+	binary.LittleEndian.PutUint32(pkt[pad:], h)
+	return pkt
+}
+
+func TestDiagHintWrongH2(t *testing.T) {
+	cfg := testConfig() // S2=20
+	d := newInboundDiag()
+	var hint string
+	for i := 0; i < diagHintAfter; i++ {
+		hint = d.record(paddedPacket(cfg.S2, 777, cfg.respTotal, byte(i)), cfg, false)
+	}
+	if !strings.Contains(hint, "offset 20 is 777") || !strings.Contains(hint, "check H2") {
+		t.Fatalf("unexpected hint: %q", hint)
+	}
+	// Hinted once per size.
+	if again := d.record(paddedPacket(cfg.S2, 777, cfg.respTotal, 9), cfg, false); again != "" {
+		t.Fatalf("expected no repeated hint, got %q", again)
+	}
+}
+
+func TestDiagHintWrongS2(t *testing.T) {
+	cfg := testConfig() // S2=20, server uses S2=40
+	d := newInboundDiag()
+	var hint string
+	for i := 0; i < diagHintAfter; i++ {
+		hint = d.record(paddedPacket(40, cfg.H2.Min, 40+WgHandshakeResponseSize, byte(i)), cfg, false)
+	}
+	if !strings.Contains(hint, "would fit S2=40") {
+		t.Fatalf("unexpected hint: %q", hint)
+	}
+
+	// After a successful handshake, size-based guesses are suppressed.
+	d = newInboundDiag()
+	for i := 0; i < diagHintAfter; i++ {
+		hint = d.record(paddedPacket(40, cfg.H2.Min, 40+WgHandshakeResponseSize, byte(i)), cfg, true)
+	}
+	if hint != "" {
+		t.Fatalf("expected no hint after handshake, got %q", hint)
+	}
+}
+
+// transportSize is the size of the i-th transport sample in the inference
+// tests, above Jmax so that it is not taken for junk.
+func transportSize(cfg *Config, i int) int {
+	return cfg.Jmax + 8 + WgTransportMinSize + i*7
+}
+
+func TestDiagInferTransport(t *testing.T) {
+	cfg := testConfig() // S4=0
+	d := newInboundDiag()
+	var hints []string
+	for i := 0; i < 16; i++ {
+		pkt := paddedPacket(8, 5000+uint32(i%3), transportSize(cfg, i), byte(i))
+		binary.LittleEndian.PutUint32(pkt[12:16], 0xCAFE)    // receiver index
+		binary.LittleEndian.PutUint64(pkt[16:24], uint64(i)) // counter
+		if h := d.record(pkt, cfg, true); h != "" {
+			hints = append(hints, h)
+		}
+	}
+	if len(hints) != 1 || !strings.Contains(hints[0], "S4=8, H4=5000-5002") {
+		t.Fatalf("unexpected hints: %q", hints)
+	}
+	report := d.Report(cfg)
+	if !strings.Contains(report, "inferred: S4=8 H4=5000-5002") || !strings.Contains(report, "dropped=16") {
+		t.Fatalf("unexpected report:\n%s", report)
+	}
+}
+
+// TestDiagInferTransportJunk checks that junk-sized packets in no H range,
+// interleaved with the transport data, do not hide it.
+func TestDiagInferTransportJunk(t *testing.T) {
+	cfg := testConfig() // S4=0, Jmin=30, Jmax=500
+	d := newInboundDiag()
+	for i := 0; i < diagSamples/2; i++ {
+		junk := make([]byte, cfg.Jmin+i*29)
+		randFill(junk)
+		d.record(junk, cfg, true)
+		pkt := paddedPacket(8, 5000, transportSize(cfg, i), byte(i))
+		binary.LittleEndian.PutUint32(pkt[12:16], 0xCAFE)
+		binary.LittleEndian.PutUint64(pkt[16:24], uint64(i))
+		d.record(pkt, cfg, true)
+	}
+	if report := d.Report(cfg); !strings.Contains(report, "inferred: S4=8 H4=5000") {
+		t.Fatalf("transport not inferred between junk packets:\n%s", report)
+	}
+
+	// Junk-sized packets with a configured header are still classified.
+	d = newInboundDiag()
+	for i := 0; i < diagHintAfter; i++ {
+		pkt := paddedPacket(8, 5000, cfg.Jmax, byte(i))
+		binary.LittleEndian.PutUint32(pkt[:4], cfg.H4.Min)
+		binary.LittleEndian.PutUint32(pkt[12:16], 0xCAFE)
+		binary.LittleEndian.PutUint64(pkt[16:24], uint64(i))
+		d.record(pkt, cfg, true)
+	}
+	if !strings.Contains(d.Report(cfg), "inferred: S4=8") {
+		t.Fatal("junk-sized packets with an H4 header skipped")
+	}
+}
+
+func TestDiagRandomJunkNoInference(t *testing.T) {
+	cfg := testConfig()
+	d := newInboundDiag()
+	for i := 0; i < 32; i++ {
+		pkt := make([]byte, 40+i*13)
+		randFill(pkt)
+		if h := d.record(pkt, cfg, true); h != "" {
+			t.Fatalf("unexpected hint for random junk: %q", h)
+		}
+	}
+	if strings.Contains(d.Report(cfg), "inferred") {
+		t.Fatal("expected no inference from random junk")
+	}
+}
+
+func TestRecordDropBudget(t *testing.T) {
+	cfg := proxyTestConfig()
+	p := NewProxy(cfg, nil, nil)
+	junk := make([]byte, 100)
+	for range 3 * diagBudget {
+		p.recordDrop(junk)
+	}
+	if total := p.diag.total; total != diagBudget {
+		t.Fatalf("recorded %d drops, want the budget of %d", total, diagBudget)
+	}
+
+	p.SetDiagnose(true)
+	for range diagBudget {
+		p.recordDrop(junk)
+	}
+	if total := p.diag.total; total != 2*diagBudget {
+		t.Fatalf("diagnose mode: recorded %d drops, want %d", total, 2*diagBudget)
+	}
+}
@@ -0,0 +1,161 @@
+package awg
+
+import (
+	"encoding/binary"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Session-aware inbound filtering.
+//
+// With wide H4 ranges TransformInbound accepts any packet whose bytes at
+// offset S4 happen to fall inside H4, so junk and stray packets would reach
+// the client's WireGuard. Every WireGuard message from the server names the
+// client's session in its receiver index, which the client announced as the
+// sender index of its init or response. sessionFilter drops inbound messages
+// addressed to any other index. Until the first index is seen (e.g. after a
+// proxy restart mid-session) all packets pass.
+//
+// Announced indices are pending until the server confirms the handshake:
+// with a response to the client's init, or with transport data after the
+// client's response to a server init. Like WireGuard's keypairs, the two
+// latest confirmed indices stay valid until the next confirmation, however
+// many inits are retransmitted in between; retransmissions only replace
+// older pending indices.
+
+const sessionPending = 8 // unconfirmed local indices: handshakes in flight and their retransmissions
+
+// sessionFilter is written by the client -> server goroutine (pending) and
+// the server -> client goroutine (confirmation), and read by the latter.
+type sessionFilter struct {
+	mu          sync.Mutex
+	pending     [sessionPending]uint64 // 1<<32 | sender index of a client init/response, 0 = empty
+	nextPending int
+
+	current  atomic.Uint64 // 1<<32 | index of the latest confirmed handshake
+	previous atomic.Uint64 // 1<<32 | index of the one before it
+	latest   atomic.Uint64 // 1<<32 | last index the client announced
+	remote   atomic.Uint64 // 1<<32 | server's sender index from its last init/response
+}
+
+const sessionValid = 1 << 32
+
+// outbound records the sender index of a client handshake message (WireGuard
+// form, before transformation).
+func (f *sessionFilter) outbound(msg []byte) {
+	if !isHandshakeMsg(msg) {
+		return
+	}
+	v := sessionValid | uint64(binary.LittleEndian.Uint32(msg[4:8]))
+	f.mu.Lock()
+	f.pending[f.nextPending] = v
+	f.nextPending = (f.nextPending + 1) % sessionPending
+	f.mu.Unlock()
+	f.latest.Store(v)
+}
+
+// inbound reports whether a message from the server (WireGuard form, after
+// transformation) may be forwarded to the client.
+func (f *sessionFilter) inbound(msg []byte) bool {
+	if len(msg) < 8 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(msg[:4]) {
+	case wgHandshakeInit:
+		// Server-initiated handshake: not addressed to a client index yet.
+		f.remote.Store(sessionValid | uint64(binary.LittleEndian.Uint32(msg[4:8])))
+		return true
+	case wgHandshakeResponse:
+		// sender (server) | receiver (client)
+		if len(msg) < 12 || !f.known(binary.LittleEndian.Uint32(msg[8:12]), true) {
+			return false
+		}
+		f.remote.Store(sessionValid | uint64(binary.LittleEndian.Uint32(msg[4:8])))
+		return true
+	case wgTransportData:
+		return f.known(binary.LittleEndian.Uint32(msg[4:8]), true)
+	}
+	// Cookie reply: receiver (client) right after the type.
+	return f.known(binary.LittleEndian.Uint32(msg[4:8]), false)
+}
+
+// known reports whether idx is a confirmed or pending local index, or
+// nothing is remembered yet. With confirm a pending idx becomes the current
+// confirmed index.
+func (f *sessionFilter) known(idx uint32, confirm bool) bool {
+	v := sessionValid | uint64(idx)
+	if f.current.Load() == v || f.previous.Load() == v {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	empty := f.current.Load() == 0
+	for i, p := range f.pending {
+		if p == v {
+			if confirm {
+				f.pending[i] = 0
+				f.previous.Store(f.current.Load())
+				f.current.Store(v)
+			}
+			return true
+		}
+		if p != 0 {
+			empty = false
+		}
+	}
+	return empty
+}
+
+// String describes the latest session for the status output: the client's
+// and the server's index.
+func (f *sessionFilter) String() string {
+	local, remote := f.latest.Load(), f.remote.Load()
+	if local == 0 {
+		return "none"
+	}
+	s := strconv.FormatUint(local&0xffffffff, 16) + "/"
+	if remote == 0 {
+		return s + "?"
+	}
+	return s + strconv.FormatUint(remote&0xffffffff, 16)
+}
+
+// isHandshakeMsg reports whether msg is a WireGuard init or response.
+func isHandshakeMsg(msg []byte) bool {
+	switch len(msg) {
+	case WgHandshakeInitSize:
+		return binary.LittleEndian.Uint32(msg[:4]) == wgHandshakeInit
+	case WgHandshakeResponseSize:
+		return binary.LittleEndian.Uint32(msg[:4]) == wgHandshakeResponse
+	}
+	return false
+}
+
+// SetSessionFilter enables dropping inbound packets that do not carry a
+// receiver index announced by the client. Must be called before Run.
+func (p *Proxy) SetSessionFilter(on bool) {
+	if on {
+		p.filter = new(sessionFilter)
+	}
+}
+
+// filterOutbound records the indices of a client message; msg is in WireGuard form.
+func (p *Proxy) filterOutbound(msg []byte) {
+	if p.filter != nil {
+		p.filter.outbound(msg)
+	}
+}
+
+// filterInbound reports whether the transformed server message msg may go to
+// the client, counting it otherwise.
+func (p *Proxy) filterInbound(msg []byte) bool {
+	if p.filter == nil || p.filter.inbound(msg) {
+		return true
+	}
+	p.stats.filteredIn.Add(1)
+	if p.cfg.logLevel() >= LevelDebug {
+		LogDebug(p.cfg, "s->c: ", strconv.Itoa(len(msg)), "B for unknown receiver index, dropped")
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package awg
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func wgMsg(typ uint32, size int, idx ...uint32) []byte {
+	msg := make([]byte, size)
+	binary.LittleEndian.PutUint32(msg, typ)
+	for i, v := range idx {
+		binary.LittleEndian.PutUint32(msg[4+4*i:], v)
+	}
+	return msg
+}
+
+func TestSessionFilter(t *testing.T) {
+	var f sessionFilter
+	if !f.inbound(wgMsg(wgTransportData, 64, 7)) {
+		t.Fatal("transport dropped before any handshake")
+	}
+	if f.String() != "none" {
+		t.Fatalf("String() = %q, want none", f.String())
+	}
+
+	f.outbound(wgMsg(wgHandshakeInit, WgHandshakeInitSize, 0x11))
+	if f.inbound(wgMsg(wgTransportData, 64, 7)) {
+		t.Fatal("transport for an unknown index passed")
+	}
+	if f.inbound(wgMsg(wgHandshakeResponse, WgHandshakeResponseSize, 0x22, 7)) {
+		t.Fatal("response for an unknown index passed")
+	}
+	if !f.inbound(wgMsg(wgHandshakeResponse, WgHandshakeResponseSize, 0x22, 0x11)) {
+		t.Fatal("response for the client's index dropped")
+	}
+	if !f.inbound(wgMsg(wgTransportData, 64, 0x11)) {
+		t.Fatal("transport for the client's index dropped")
+	}
+	if !f.inbound(wgMsg(wgCookieReply, WgCookieReplySize, 0x11)) {
+		t.Fatal("cookie reply for the client's index dropped")
+	}
+	if f.String() != "11/22" {
+		t.Fatalf("String() = %q, want 11/22", f.String())
+	}
+
+	// Retransmitted inits do not displace the confirmed index.
+	for i := uint32(0); i < 3*sessionPending; i++ {
+		f.outbound(wgMsg(wgHandshakeInit, WgHandshakeInitSize, 0x100+i))
+	}
+	if !f.inbound(wgMsg(wgTransportData, 64, 0x11)) {
+		t.Fatal("confirmed index forgotten after retransmitted inits")
+	}
+	// Only the latest sessionPending unconfirmed indices are remembered.
+	if f.inbound(wgMsg(wgTransportData, 64, 0x100)) {
+		t.Fatal("old pending index still valid")
+	}
+
+	// A new handshake keeps the previous index valid until the next one.
+	confirm := func(idx uint32) {
+		t.Helper()
+		f.outbound(wgMsg(wgHandshakeInit, WgHandshakeInitSize, idx))
+		if !f.inbound(wgMsg(wgHandshakeResponse, WgHandshakeResponseSize, 0x22, idx)) {
+			t.Fatalf("response for %x dropped", idx)
+		}
+	}
+	confirm(0x200)
+	if !f.inbound(wgMsg(wgTransportData, 64, 0x11)) || !f.inbound(wgMsg(wgTransportData, 64, 0x200)) {
+		t.Fatal("current or previous index dropped")
+	}
+	confirm(0x300)
+	if f.inbound(wgMsg(wgTransportData, 64, 0x11)) {
+		t.Fatal("index still valid two handshakes later")
+	}
+
+	// Server-initiated handshake: the client's response index is confirmed
+	// by transport data from the server.
+	f.inbound(wgMsg(wgHandshakeInit, WgHandshakeInitSize, 0x33))
+	f.outbound(wgMsg(wgHandshakeResponse, WgHandshakeResponseSize, 0x400, 0x33))
+	if !f.inbound(wgMsg(wgTransportData, 64, 0x400)) {
+		t.Fatal("transport for the client's response index dropped")
+	}
+	if !f.inbound(wgMsg(wgTransportData, 64, 0x300)) || f.inbound(wgMsg(wgTransportData, 64, 0x200)) {
+		t.Fatal("response index not confirmed by transport data")
+	}
+
+	// Transport data from the client carries no index of its own.
+	f.outbound(wgMsg(wgTransportData, WgHandshakeInitSize, 0x500))
+	if f.inbound(wgMsg(wgTransportData, 64, 0x500)) {
+		t.Fatal("index taken from a transport packet")
+	}
+}
+
+func TestProxySessionFilter(t *testing.T) {
+	cfg := proxyTestConfig()
+	server := startMockServer(t)
+	defer server.Close()
+	proxy, proxyAddr, stop := startProxySetup(t, cfg, server.LocalAddr().(*net.UDPAddr), func(p *Proxy) {
+		p.SetSessionFilter(true)
+	})
+	defer stop()
+	client := dialUDP(t, proxyAddr)
+	defer client.Close()
+
+	init := makeWGPacket(wgHandshakeInit, WgHandshakeInitSize)
+	binary.LittleEndian.PutUint32(init[4:8], 0x1234)
+	client.Write(init)
+	_, from := readPacketsWithAddr(server, 300*time.Millisecond, cfg.Jc+1)
+
+	transport := func(receiver uint32) []byte {
+		msg := makeWGPacket(cfg.H4.Min, 64)
+		binary.LittleEndian.PutUint32(msg[4:8], receiver)
+		return msg
+	}
+	server.WriteToUDP(transport(0x9999), from)
+	server.WriteToUDP(transport(0x1234), from)
+	got := readPackets(client, 300*time.Millisecond, 2)
+	if len(got) != 1 || binary.LittleEndian.Uint32(got[0][4:8]) != 0x1234 {
+		t.Fatalf("client got %d packets, want only the one for its index", len(got))
+	}
+	if n := proxy.stats.filteredIn.Load(); n != 1 {
+		t.Fatalf("filteredIn = %d, want 1", n)
+	}
+}
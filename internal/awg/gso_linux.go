@@ -0,0 +1,184 @@
+//go:build linux
+
+package awg
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+)
+
+// UDP segmentation offload (SetOffload).
+//
+// With UDP_GRO the kernel hands a socket consecutive packets of one flow as
+// a single buffer of equal-size segments (the last may be shorter), and with
+// UDP_SEGMENT one send of such a buffer becomes several packets. Transport
+// packets of a busy tunnel mostly have the same size, so a 64 KB buffer
+// carries dozens of them through one system call. The batch loops split
+// received buffers into packets, transform each one (H4, S4) and coalesce the
+// results again when queueing them for sendmmsg.
+
+const (
+	solUDP     = 17  // SOL_UDP
+	udpSegment = 103 // UDP_SEGMENT: segment size of a send
+	udpGRO     = 104 // UDP_GRO: receive coalesced segments
+
+	gsoBufSize     = 65535 // coalesced buffer, the largest UDP payload
+	gsoMaxMessage  = 65507 // largest coalesced send: 65535 - IPv4 and UDP headers
+	gsoBatchSize   = 8     // coalesced buffers per recvmmsg/sendmmsg
+	gsoMaxSegments = 64    // UDP_MAX_SEGMENTS of older kernels
+)
+
+// enableGRO turns on UDP_GRO for conn. It reports false if the kernel does
+// not support it (before Linux 5.0).
+func enableGRO(conn *net.UDPConn) bool {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var sysErr error
+	if err := raw.Control(func(fd uintptr) {
+		sysErr = syscall.SetsockoptInt(int(fd), solUDP, udpGRO, 1)
+	}); err != nil {
+		return false
+	}
+	return sysErr == nil
+}
+
+// gsoSupported reports whether the kernel accepts UDP_SEGMENT on conn
+// (Linux 4.18 and later).
+func gsoSupported(conn *net.UDPConn) bool {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var sysErr error
+	if err := raw.Control(func(fd uintptr) {
+		_, sysErr = syscall.GetsockoptInt(int(fd), solUDP, udpSegment)
+	}); err != nil {
+		return false
+	}
+	return sysErr == nil
+}
+
+// isGSOErr reports a send error caused by segmentation offload, e.g. EIO
+// when the route cannot checksum segments (IPsec) or EINVAL for more
+// segments than the kernel allows.
+func isGSOErr(err error) bool {
+	return errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EINVAL)
+}
+
+// resendPlain sends the packets of the messages the last sendBatch of bs did
+// not send, one packet per message without UDP_SEGMENT, through plain, a
+// batchState without offload. fn, if not nil, is called for every packet
+// sent. It returns the packets and bytes sent and the last send error.
+func resendPlain(raw syscall.RawConn, bs, plain *batchState, fn func([]byte, netip.AddrPort)) (pkts, bytes int, err error) {
+	flush := func() {
+		if plain.count == 0 {
+			return
+		}
+		if _, sendErr := sendBatch(raw, plain, plain.count); sendErr != nil {
+			err = sendErr
+		}
+		pkts += plain.sentPackets()
+		bytes += plain.sentBytes(plain.count)
+		if fn != nil {
+			plain.eachSent(fn)
+		}
+		plain.reset()
+	}
+	for k := 0; k < bs.count; k++ {
+		if bs.msgs[k].Len > 0 {
+			continue
+		}
+		var addr *netip.AddrPort
+		if bs.msgs[k].Hdr.Name != nil {
+			ap := sockaddrToAddrPort(&bs.addrs[k])
+			addr = &ap
+		}
+		buf := bs.bufs[k][:bs.lens[k]]
+		for off := 0; off < len(buf); off += bs.seg[k] {
+			pkt := buf[off:min(off+bs.seg[k], len(buf))]
+			if !plain.queue(pkt, addr) {
+				flush()
+				plain.queue(pkt, addr)
+			}
+		}
+	}
+	flush()
+	return pkts, bytes, err
+}
+
+// newOffloadBatchState allocates a batchState of gsoBatchSize coalesced
+// buffers. gro receives with UDP_GRO control messages, gso coalesces queued
+// packets with UDP_SEGMENT.
+func newOffloadBatchState(gro, gso bool) *batchState {
+	bs := new(batchState)
+	bs.size = gsoBatchSize
+	mem := make([]byte, gsoBatchSize*gsoBufSize)
+	for i := range bs.size {
+		bs.bufs[i] = mem[i*gsoBufSize : (i+1)*gsoBufSize : (i+1)*gsoBufSize]
+	}
+	bs.gro, bs.gso = gro, gso
+	return bs
+}
+
+// resetControl prepares the control buffers for a recvmmsg with UDP_GRO;
+// the kernel shortens Controllen to what it writes.
+func (bs *batchState) resetControl() {
+	for i := range bs.size {
+		bs.msgs[i].Hdr.Control = (*byte)(unsafe.Pointer(&bs.ctrl[i]))
+		setControllen(&bs.msgs[i].Hdr, len(bs.ctrl[i])*8)
+	}
+}
+
+// segSize returns the size of the packets in received message i of total
+// bytes: the UDP_GRO segment size, or total for a single packet.
+func (bs *batchState) segSize(i, total int) int {
+	if !bs.gro || controllen(&bs.msgs[i].Hdr) < syscall.CmsgLen(4) {
+		return total
+	}
+	c := (*syscall.Cmsghdr)(unsafe.Pointer(&bs.ctrl[i]))
+	if c.Level != solUDP || c.Type != udpGRO {
+		return total
+	}
+	if seg := int(*(*int32)(unsafe.Add(unsafe.Pointer(c), syscall.CmsgLen(0)))); seg > 0 {
+		return seg
+	}
+	return total
+}
+
+// setSegment marks queued message k as a run of seg-byte segments.
+func (bs *batchState) setSegment(k, seg int) {
+	c := (*syscall.Cmsghdr)(unsafe.Pointer(&bs.ctrl[k]))
+	c.Level = solUDP
+	c.Type = udpSegment
+	c.SetLen(syscall.CmsgLen(2))
+	*(*uint16)(unsafe.Add(unsafe.Pointer(c), syscall.CmsgLen(0))) = uint16(seg)
+	bs.msgs[k].Hdr.Control = (*byte)(unsafe.Pointer(c))
+	setControllen(&bs.msgs[k].Hdr, syscall.CmsgSpace(2))
+}
+
+// coalesce appends out to the last queued message as another segment if the
+// message is a run of segments of at least len(out) bytes that has room for
+// it within gsoMaxMessage. A shorter packet ends the run.
+func (bs *batchState) coalesce(out []byte) bool {
+	if !bs.gso || bs.count == 0 {
+		return false
+	}
+	k := bs.count - 1
+	seg, used := bs.seg[k], bs.lens[k]
+	if used != bs.segs[k]*seg || len(out) > seg || bs.segs[k] >= gsoMaxSegments || used+len(out) > min(len(bs.bufs[k]), gsoMaxMessage) {
+		return false
+	}
+	copy(bs.bufs[k][used:], out)
+	bs.lens[k] += len(out)
+	setIovecLen(&bs.iovecs[k], uint64(bs.lens[k]))
+	bs.segs[k]++
+	if bs.segs[k] == 2 {
+		bs.setSegment(k, seg)
+	}
+	return true
+}
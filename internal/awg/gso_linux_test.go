@@ -0,0 +1,266 @@
+//go:build linux
+
+package awg
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// writeGSO sends pkts, all but the last of equal size, as one UDP_SEGMENT send.
+func writeGSO(conn *net.UDPConn, addr *net.UDPAddr, pkts [][]byte) error {
+	var buf []byte
+	for _, pkt := range pkts {
+		buf = append(buf, pkt...)
+	}
+	oob := make([]byte, syscall.CmsgSpace(2))
+	c := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	c.Level, c.Type = solUDP, udpSegment
+	c.SetLen(syscall.CmsgLen(2))
+	binary.NativeEndian.PutUint16(oob[syscall.CmsgLen(0):], uint16(len(pkts[0])))
+	_, _, err := conn.WriteMsgUDP(buf, oob, addr)
+	return err
+}
+
+// skipWithoutOffload skips the test if the kernel lacks UDP GSO or GRO.
+func skipWithoutOffload(t testing.TB) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !gsoSupported(conn) || !enableGRO(conn) {
+		t.Skip("UDP GSO/GRO not supported by the kernel")
+	}
+}
+
+func TestBatchQueueCoalesce(t *testing.T) {
+	bs := newOffloadBatchState(false, true)
+	bs.initSend(false)
+	for _, n := range []int{100, 100, 100, 60, 100, 200} {
+		if !bs.queue(make([]byte, n), nil) {
+			t.Fatalf("queue full after %d packets", bs.pkts)
+		}
+	}
+	if bs.count != 3 || bs.pkts != 6 || bs.bytes != 660 {
+		t.Fatalf("%d messages, %d packets, %d bytes; want 3, 6, 660", bs.count, bs.pkts, bs.bytes)
+	}
+	for k, want := range [][2]int{{4, 360}, {1, 100}, {1, 200}} {
+		if bs.segs[k] != want[0] || bs.lens[k] != want[1] {
+			t.Fatalf("message %d: %d segments / %d bytes, want %d / %d", k, bs.segs[k], bs.lens[k], want[0], want[1])
+		}
+		if hasCtrl := controllen(&bs.msgs[k].Hdr) > 0; hasCtrl != (want[0] > 1) {
+			t.Fatalf("message %d: UDP_SEGMENT control message %v", k, hasCtrl)
+		}
+	}
+
+	// Without GSO every packet is a message of its own, until the queue is full.
+	bs = newBatchState(200)
+	bs.initSend(false)
+	for range batchSize {
+		bs.queue(make([]byte, 100), nil)
+	}
+	if bs.count != batchSize || bs.queue(make([]byte, 100), nil) {
+		t.Fatalf("%d messages, queue not full", bs.count)
+	}
+	bs.reset()
+	if !bs.queue(make([]byte, 100), nil) || bs.count != 1 {
+		t.Fatal("queue not empty after reset")
+	}
+
+	// A run stops at gsoMaxSegments.
+	bs = newOffloadBatchState(false, true)
+	for range gsoMaxSegments + 1 {
+		bs.queue(make([]byte, 10), nil)
+	}
+	if bs.count != 2 || bs.segs[0] != gsoMaxSegments {
+		t.Fatalf("%d messages, %d segments in the first", bs.count, bs.segs[0])
+	}
+
+	// A run stops before it exceeds the largest IPv4 UDP payload.
+	for _, size := range []int{1092, 1365, 1394} {
+		bs = newOffloadBatchState(false, true)
+		for range gsoMaxSegments {
+			bs.queue(make([]byte, size), nil)
+		}
+		for k := range bs.count {
+			if bs.lens[k] > gsoMaxMessage {
+				t.Fatalf("%dB packets: message %d of %d bytes", size, k, bs.lens[k])
+			}
+		}
+		if bs.lens[0] != gsoMaxMessage/size*size {
+			t.Fatalf("%dB packets: first message of %d bytes", size, bs.lens[0])
+		}
+	}
+}
+
+// TestBatchWriteErrGSOFallback checks that a GSO failure resends the batch
+// without segmentation and leaves a plain send state behind only if that
+// works.
+func TestBatchWriteErrGSOFallback(t *testing.T) {
+	recv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recv.Close()
+	dst := recv.LocalAddr().(*net.UDPAddr).AddrPort()
+	send, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := send.SyscallConn()
+
+	cfg := proxyTestConfig()
+	p := NewProxy(cfg, recv.LocalAddr().(*net.UDPAddr), recv.LocalAddr().(*net.UDPAddr))
+	failed := func() *batchState {
+		bs := newOffloadBatchState(false, true)
+		bs.initSend(true)
+		for _, n := range []int{100, 100, 100, 60, 60} {
+			bs.queue(make([]byte, n), &dst)
+		}
+		if bs.count != 2 {
+			t.Fatalf("%d messages queued, want 2", bs.count)
+		}
+		return bs // never sent: every msgs[k].Len is 0
+	}
+
+	bs := failed()
+	var captured int
+	pkts, bytes := p.batchWriteErr("listen", raw, bs, syscall.EINVAL, 1500, true, func([]byte, netip.AddrPort) { captured++ })
+	if pkts != 5 || bytes != 420 || captured != 5 {
+		t.Fatalf("retry sent %d packets / %d bytes, captured %d; want 5 / 420 / 5", pkts, bytes, captured)
+	}
+	if got := readPackets(recv, 500*time.Millisecond, 6); len(got) != 5 || len(got[3]) != 60 {
+		t.Fatalf("received %d packets, want the 5 of the batch", len(got))
+	}
+	if bs.gso || bs.size != batchSize || len(bs.bufs[batchSize-1]) != 1500 {
+		t.Fatalf("gso=%v, %d messages of %d bytes", bs.gso, bs.size, len(bs.bufs[0]))
+	}
+	if bs.msgs[0].Hdr.Name == nil || bs.msgs[0].Hdr.Iov != &bs.iovecs[0] {
+		t.Fatal("send state not set up")
+	}
+
+	// A failing retry keeps GSO on.
+	send.Close()
+	bs = failed()
+	if pkts, _ := p.batchWriteErr("listen", raw, bs, syscall.EINVAL, 1500, true, nil); pkts != 0 {
+		t.Fatalf("retry on a closed socket sent %d packets", pkts)
+	}
+	if !bs.gso || bs.size != gsoBatchSize {
+		t.Fatal("GSO disabled although the retry failed")
+	}
+}
+
+func TestRecvBatchGRO(t *testing.T) {
+	recv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recv.Close()
+	skipWithoutOffload(t)
+	enableGRO(recv)
+	send, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer send.Close()
+
+	pkts := [][]byte{make([]byte, 300), make([]byte, 300), make([]byte, 300), make([]byte, 120)}
+	for i, pkt := range pkts {
+		pkt[0] = byte(i)
+	}
+	if err := writeGSO(send, recv.LocalAddr().(*net.UDPAddr), pkts); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := recv.SyscallConn()
+	bs := newOffloadBatchState(true, false)
+	bs.initRecv(true)
+	recv.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := recvBatch(raw, bs)
+	if err != nil || n < 1 {
+		t.Fatalf("recvBatch: %d, %v", n, err)
+	}
+	var got [][]byte
+	for i := range n {
+		total := int(bs.msgs[i].Len)
+		seg := bs.segSize(i, total)
+		for off := 0; off < total; off += seg {
+			got = append(got, bs.bufs[i][off:min(off+seg, total)])
+		}
+	}
+	if len(got) != len(pkts) {
+		t.Fatalf("split into %d packets, want %d", len(got), len(pkts))
+	}
+	for i, pkt := range got {
+		if len(pkt) != len(pkts[i]) || pkt[0] != byte(i) {
+			t.Fatalf("packet %d: %d bytes, first byte %d", i, len(pkt), pkt[0])
+		}
+	}
+}
+
+// TestProxyOffloadRoundtrip sends coalesced transport packets through the
+// proxy in both directions with offload enabled.
+func TestProxyOffloadRoundtrip(t *testing.T) {
+	cfg := proxyTestConfig()
+	cfg.S4 = 8
+	cfg.ComputeFastPath()
+
+	server := startMockServer(t)
+	defer server.Close()
+	skipWithoutOffload(t)
+	_, proxyAddr, stop := startProxySetup(t, cfg, server.LocalAddr().(*net.UDPAddr), func(p *Proxy) {
+		p.SetOffload(true)
+	})
+	defer stop()
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Client -> server: 20 full-size packets and a short one in one send.
+	var burst [][]byte
+	for i := range 21 {
+		size := 400
+		if i == 20 {
+			size = 64
+		}
+		pkt := makeWGPacket(wgTransportData, size)
+		pkt[8] = byte(i)
+		burst = append(burst, pkt)
+	}
+	if err := writeGSO(client, proxyAddr, burst); err != nil {
+		t.Fatal(err)
+	}
+	got, proxyRemote := readPacketsWithAddr(server, 2*time.Second, len(burst))
+	if len(got) != len(burst) {
+		t.Fatalf("server got %d packets, want %d", len(got), len(burst))
+	}
+	for i, pkt := range got {
+		if len(pkt) != cfg.S4+len(burst[i]) || binary.LittleEndian.Uint32(pkt[cfg.S4:]) != cfg.H4.Min || pkt[cfg.S4+8] != byte(i) {
+			t.Fatalf("server packet %d: %d bytes, not the transformed client packet", i, len(pkt))
+		}
+	}
+
+	// Server -> client: echo them back coalesced.
+	if err := writeGSO(server, proxyRemote, got); err != nil {
+		t.Fatal(err)
+	}
+	back := readPackets(client, 2*time.Second, len(burst))
+	if len(back) != len(burst) {
+		t.Fatalf("client got %d packets, want %d", len(back), len(burst))
+	}
+	for i, pkt := range back {
+		if len(pkt) != len(burst[i]) || binary.LittleEndian.Uint32(pkt) != wgTransportData || pkt[8] != byte(i) {
+			t.Fatalf("client packet %d: %d bytes, not the original", i, len(pkt))
+		}
+	}
+}
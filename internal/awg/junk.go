@@ -0,0 +1,285 @@
+package awg
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Junk packet content (AWG_JUNK_TEMPLATE).
+//
+// Uniformly random junk is a signal of its own. A JunkTemplate makes junk
+// packets look like the start of another UDP protocol: a QUIC Initial, a DNS
+// query, a STUN binding request, or any CPS template. The server only looks
+// at the count and sizes of junk packets, so sizes still follow Jc/Jmin/Jmax
+// and each generator fills exactly the size it is given, truncating its
+// header or padding the packet as needed. Two generators adjust the size
+// first (packetSize) where a packet of the drawn size would be malformed,
+// without leaving [Jmin, Jmax]: QUIC Initials are padded to the 1200 bytes
+// clients must send (RFC 9000, section 14.1), and STUN messages are rounded
+// up to a multiple of 4 bytes (RFC 8489, section 5). CheckSizes rejects the
+// ranges where this is impossible.
+
+// Junk template kinds.
+const (
+	junkQUIC byte = 'q'
+	junkDNS  byte = 'd'
+	junkSTUN byte = 's'
+	junkCPS  byte = 'c'
+)
+
+// JunkTemplate generates the content of junk packets.
+type JunkTemplate struct {
+	kind byte
+	cps  *CPSTemplate // for junkCPS
+}
+
+// ParseJunkTemplate parses a junk template: one of the built-in generators
+// quic, dns or stun, or a CPS template such as "<b 0x1700><r 16>" or
+// "@preset:dns-query" whose output is truncated or followed by random bytes
+// to fit each packet.
+func ParseJunkTemplate(s string) (*JunkTemplate, error) {
+	switch s {
+	case "quic":
+		return &JunkTemplate{kind: junkQUIC}, nil
+	case "dns":
+		return &JunkTemplate{kind: junkDNS}, nil
+	case "stun":
+		return &JunkTemplate{kind: junkSTUN}, nil
+	}
+	if t := trimLeft(s); !strings.HasPrefix(t, "<") && !strings.HasPrefix(t, cpsPresetPrefix) {
+		return nil, errors.New("expected quic, dns, stun, a CPS template or preset, got \"" + s + "\"")
+	}
+	tmpl, err := ParseCPSValue(trimLeft(s))
+	if err != nil {
+		return nil, err
+	}
+	return &JunkTemplate{kind: junkCPS, cps: tmpl}, nil
+}
+
+// CheckSizes reports whether the template can generate well-formed packets
+// with sizes in [jmin, jmax]: QUIC needs jmax of at least 1200, STUN a
+// multiple of 4 in the range. t may be nil.
+func (t *JunkTemplate) CheckSizes(jmin, jmax int) error {
+	if t == nil {
+		return nil
+	}
+	switch t.kind {
+	case junkQUIC:
+		if jmax < quicMinInitial {
+			return errors.New("quic needs Jmax of at least " + strconv.Itoa(quicMinInitial) + ", got " + strconv.Itoa(jmax))
+		}
+	case junkSTUN:
+		if (max(jmin, 0)+3)&^3 > jmax {
+			return errors.New("stun needs a multiple of 4 in [Jmin, Jmax], got [" + strconv.Itoa(jmin) + ", " + strconv.Itoa(jmax) + "]")
+		}
+	}
+	return nil
+}
+
+// packetSize returns the size of a junk packet for which n was drawn from
+// [jmin, jmax]; see the comment at the top of the file. The result stays in
+// [jmin, jmax] even if CheckSizes fails. t may be nil.
+func (t *JunkTemplate) packetSize(n, jmin, jmax int) int {
+	if t == nil {
+		return n
+	}
+	switch t.kind {
+	case junkQUIC:
+		return min(max(n, quicMinInitial), jmax)
+	case junkSTUN:
+		if up := (n + 3) &^ 3; up <= jmax {
+			return up
+		}
+		if down := n &^ 3; down >= jmin {
+			return down
+		}
+	}
+	return n
+}
+
+// fill writes junk packet number index of a burst into b.
+func (t *JunkTemplate) fill(b []byte, index int) {
+	switch t.kind {
+	case junkQUIC:
+		fillQUIC(b)
+	case junkDNS:
+		fillDNS(b)
+	case junkSTUN:
+		fillSTUN(b)
+	case junkCPS:
+		n := t.cps.put(b, uint32(index))
+		randFill(b[n:])
+	}
+}
+
+// junkState holds the pre-allocated CPS and junk buffers for one sender, so
+// the handshake prelude does not allocate; it must only be used by one
+// goroutine.
+type junkState struct {
+	buf      []byte   // Jc * junkMax() bytes for junk packets
+	pkts     [][]byte // Jc slice headers for junk packets
+	cpsBuf   []byte   // the CPS packets of all templates
+	cpsPkts  [][]byte // up to 5 slice headers for CPS packets
+	cpsInits uint64   // handshake inits with CPS packets since start or a reconnect
+}
+
+func newJunkState(cfg *Config) junkState {
+	var j junkState
+	if cfg.Jc > 0 && cfg.Jmax > 0 {
+		j.buf = make([]byte, cfg.Jc*cfg.junkMax())
+		j.pkts = make([][]byte, cfg.Jc)
+	}
+	if n := cpsTotalSize(cfg.CPS); n > 0 {
+		j.cpsBuf = make([]byte, n)
+		j.cpsPkts = make([][]byte, 0, len(cfg.CPS))
+	}
+	return j
+}
+
+// cps generates the CPS packets of cfg that its policies send before this
+// handshake init into the pre-allocated buffers, numbered from counter's
+// CPS counter.
+func (j *junkState) cps(cfg, counter *Config) [][]byte {
+	templates := cfg.CPS
+	for i := range templates {
+		if templates[i] != nil && !cfg.CPSPolicy[i].beforeInit(j.cpsInits) {
+			templates[i] = nil
+		}
+	}
+	j.cpsInits++
+	n := 0
+	for _, tmpl := range templates {
+		if tmpl != nil {
+			n++
+		}
+	}
+	return fillCPSPackets(templates, counter.nextCPSCounter(n), j.cpsBuf, j.cpsPkts)
+}
+
+// junk generates the junk packets of cfg into the pre-allocated buffers.
+func (j *junkState) junk(cfg *Config) [][]byte {
+	return fillJunk(cfg, j.buf, j.pkts)
+}
+
+// fillJunkPackets fills junk packets with random bytes, or from tmpl if set.
+func fillJunkPackets(tmpl *JunkTemplate, pkts [][]byte) {
+	for i, pkt := range pkts {
+		if tmpl != nil {
+			tmpl.fill(pkt, i)
+		} else {
+			randFill(pkt)
+		}
+	}
+}
+
+// quicMinInitial is the smallest UDP payload carrying a client Initial.
+const quicMinInitial = 1200
+
+// quicHeaderLen is the long header written by fillQUIC: first byte, version,
+// 8-byte DCID, empty SCID and token, 2-byte length.
+const quicHeaderLen = 1 + 4 + 1 + 8 + 1 + 1 + 2
+
+// fillQUIC writes a QUIC v1 Initial packet: a long header as sent by
+// browsers, followed by random bytes standing in for the protected packet
+// number and payload.
+func fillQUIC(b []byte) {
+	randFill(b)
+	var h [quicHeaderLen]byte
+	randFill(h[:])
+	h[0] = 0xc0 | h[0]&0x0f // long header, fixed bit, Initial; low bits header-protected
+	binary.BigEndian.PutUint32(h[1:5], 1)
+	h[5] = 8 // DCID length, h[6:14] random
+	h[14] = 0
+	h[15] = 0
+	length := min(max(len(b)-quicHeaderLen, 0), 0x3fff)
+	binary.BigEndian.PutUint16(h[16:18], 0x4000|uint16(length)) // 2-byte varint
+	copy(b, h[:])
+}
+
+const (
+	dnsHeaderLen = 12
+	dnsQuestion  = 4          // QTYPE + QCLASS after the name
+	dnsMinPacket = 12 + 4 + 3 // header, question, one-character name
+	dnsOPTLen    = 11 + 4     // OPT record and padding option header
+	dnsMaxName   = 255
+)
+
+// fillDNS writes a recursive A query for a random name. Packets too large for
+// a name alone carry an EDNS0 padding option (RFC 7830), as DNS clients that
+// pad their queries do.
+func fillDNS(b []byte) {
+	if len(b) < dnsMinPacket {
+		var tmp [dnsMinPacket]byte
+		fillDNS(tmp[:])
+		copy(b, tmp[:])
+		return
+	}
+	clear(b)
+	randFill(b[0:2])                           // ID
+	binary.BigEndian.PutUint16(b[2:4], 0x0100) // RD
+	binary.BigEndian.PutUint16(b[4:6], 1)      // QDCOUNT
+
+	nameLen := len(b) - dnsHeaderLen - dnsQuestion
+	pad := -1
+	if nameLen > dnsMaxName {
+		nameLen = 8 + len(b)%24 // ordinary-looking name, the rest is padding
+		pad = len(b) - dnsHeaderLen - nameLen - dnsQuestion - dnsOPTLen
+	}
+	off := dnsHeaderLen
+	putDNSName(b[off : off+nameLen])
+	off += nameLen
+	binary.BigEndian.PutUint16(b[off:], 1)   // QTYPE A
+	binary.BigEndian.PutUint16(b[off+2:], 1) // QCLASS IN
+	off += dnsQuestion
+	if pad < 0 {
+		return
+	}
+
+	binary.BigEndian.PutUint16(b[10:12], 1) // ARCOUNT
+	// OPT: root name, type 41, UDP payload size 1232, TTL 0, then the padding option.
+	b[off] = 0
+	binary.BigEndian.PutUint16(b[off+1:], 41)
+	binary.BigEndian.PutUint16(b[off+3:], 1232)
+	binary.BigEndian.PutUint16(b[off+9:], uint16(4+pad))
+	binary.BigEndian.PutUint16(b[off+11:], 12) // Padding
+	binary.BigEndian.PutUint16(b[off+13:], uint16(pad))
+}
+
+// putDNSName fills b (at least 3 bytes) with an encoded domain name of
+// exactly len(b) bytes: random alphanumeric labels and the root label.
+func putDNSName(b []byte) {
+	off := 0
+	rest := len(b) - 1 // without the root label
+	for rest > 0 {
+		l := min(rest-1, 63)
+		if rest-1-l == 1 {
+			l-- // a single byte cannot hold another label
+		}
+		b[off] = byte(l)
+		randAlphanumFill(b[off+1 : off+1+l])
+		off += 1 + l
+		rest -= 1 + l
+	}
+	b[off] = 0
+}
+
+const stunHeaderLen = 20
+
+// fillSTUN writes a STUN binding request (RFC 8489) whose attributes are a
+// single PADDING attribute filling the packet. b is well-formed STUN if its
+// size is a multiple of 4 of at least 20 bytes, see packetSize.
+func fillSTUN(b []byte) {
+	var h [stunHeaderLen]byte
+	binary.BigEndian.PutUint16(h[0:2], 0x0001) // Binding Request
+	binary.BigEndian.PutUint16(h[2:4], uint16(max(len(b)-stunHeaderLen, 0)))
+	binary.BigEndian.PutUint32(h[4:8], 0x2112A442) // magic cookie
+	randFill(h[8:20])                              // transaction ID
+	clear(b)
+	copy(b, h[:])
+	if len(b) >= stunHeaderLen+4 {
+		binary.BigEndian.PutUint16(b[20:22], 0x0026) // PADDING
+		binary.BigEndian.PutUint16(b[22:24], uint16(len(b)-stunHeaderLen-4))
+	}
+}
@@ -0,0 +1,238 @@
+package awg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestParseJunkTemplate(t *testing.T) {
+	for _, s := range []string{"quic", "dns", "stun", "<b 0x1703030000><r 32>", " <c>"} {
+		if _, err := ParseJunkTemplate(s); err != nil {
+			t.Fatalf("%q: %v", s, err)
+		}
+	}
+	for _, s := range []string{"", "QUIC", "random", "<x 1>"} {
+		if _, err := ParseJunkTemplate(s); err == nil {
+			t.Fatalf("%q accepted", s)
+		}
+	}
+}
+
+// junkSizes covers tiny packets, header boundaries and the DNS name limit.
+var junkSizes = []int{1, 2, 17, 18, 19, 20, 23, 24, 64, 270, 271, 272, 500, 1280, 1500}
+
+func TestJunkQUIC(t *testing.T) {
+	tmpl, _ := ParseJunkTemplate("quic")
+	for _, n := range junkSizes {
+		b := make([]byte, n)
+		tmpl.fill(b, 0)
+		if b[0]&0xf0 != 0xc0 {
+			t.Fatalf("%dB: first byte %#x is not a long-header Initial", n, b[0])
+		}
+		if n < quicHeaderLen {
+			continue
+		}
+		if v := binary.BigEndian.Uint32(b[1:5]); v != 1 || b[5] != 8 || b[14] != 0 || b[15] != 0 {
+			t.Fatalf("%dB: bad header %x", n, b[:quicHeaderLen])
+		}
+		if l := int(binary.BigEndian.Uint16(b[16:18]) & 0x3fff); l != n-quicHeaderLen {
+			t.Fatalf("%dB: length %d, want %d", n, l, n-quicHeaderLen)
+		}
+	}
+}
+
+func TestJunkDNS(t *testing.T) {
+	tmpl, _ := ParseJunkTemplate("dns")
+	for _, n := range junkSizes {
+		b := make([]byte, n)
+		tmpl.fill(b, 0)
+		if n < dnsMinPacket {
+			continue
+		}
+		if binary.BigEndian.Uint16(b[2:4]) != 0x0100 || binary.BigEndian.Uint16(b[4:6]) != 1 {
+			t.Fatalf("%dB: bad header %x", n, b[:12])
+		}
+		// Walk the name.
+		off := dnsHeaderLen
+		for b[off] != 0 {
+			l := int(b[off])
+			if l > 63 {
+				t.Fatalf("%dB: label of %d bytes", n, l)
+			}
+			off += 1 + l
+		}
+		off++
+		if off-dnsHeaderLen > dnsMaxName {
+			t.Fatalf("%dB: name of %d bytes", n, off-dnsHeaderLen)
+		}
+		if binary.BigEndian.Uint16(b[off:]) != 1 || binary.BigEndian.Uint16(b[off+2:]) != 1 {
+			t.Fatalf("%dB: question is not A/IN", n)
+		}
+		off += dnsQuestion
+		if binary.BigEndian.Uint16(b[10:12]) == 1 {
+			if binary.BigEndian.Uint16(b[off+1:]) != 41 {
+				t.Fatalf("%dB: additional record is not OPT", n)
+			}
+			off += 11 + int(binary.BigEndian.Uint16(b[off+9:]))
+		}
+		if off != n {
+			t.Fatalf("%dB: message ends at %d", n, off)
+		}
+	}
+}
+
+func TestJunkSTUN(t *testing.T) {
+	tmpl, _ := ParseJunkTemplate("stun")
+	for _, n := range junkSizes {
+		b := make([]byte, n)
+		tmpl.fill(b, 0)
+		if n < stunHeaderLen {
+			continue
+		}
+		if binary.BigEndian.Uint16(b[0:2]) != 1 || binary.BigEndian.Uint32(b[4:8]) != 0x2112A442 {
+			t.Fatalf("%dB: not a binding request: %x", n, b[:stunHeaderLen])
+		}
+		if l := int(binary.BigEndian.Uint16(b[2:4])); l != n-stunHeaderLen {
+			t.Fatalf("%dB: length %d", n, l)
+		}
+		if n >= stunHeaderLen+4 && int(binary.BigEndian.Uint16(b[22:24])) != n-stunHeaderLen-4 {
+			t.Fatalf("%dB: PADDING attribute does not fill the message", n)
+		}
+	}
+}
+
+func TestJunkCPSTemplate(t *testing.T) {
+	tmpl, _ := ParseJunkTemplate("<b 0x170303><c>")
+	b := make([]byte, 40)
+	tmpl.fill(b, 2)
+	if !bytes.Equal(b[:7], []byte{0x17, 0x03, 0x03, 2, 0, 0, 0}) {
+		t.Fatalf("prefix %x", b[:7])
+	}
+	short := make([]byte, 2)
+	tmpl.fill(short, 0)
+	if !bytes.Equal(short, []byte{0x17, 0x03}) {
+		t.Fatalf("truncated %x", short)
+	}
+}
+
+// TestGenerateJunkTemplateSizes checks that templates keep the Jc/Jmin/Jmax
+// semantics for both junk generators.
+func TestGenerateJunkTemplateSizes(t *testing.T) {
+	cfg := proxyTestConfig()
+	cfg.Jc, cfg.Jmin, cfg.Jmax = 8, 40, 300
+	cfg.JunkTemplate, _ = ParseJunkTemplate("stun")
+	buf := make([]byte, cfg.Jc*cfg.Jmax)
+	pkts := make([][]byte, cfg.Jc)
+	for _, got := range [][][]byte{GenerateJunkPackets(cfg), fillJunk(cfg, buf, pkts)} {
+		if len(got) != cfg.Jc {
+			t.Fatalf("%d packets, want %d", len(got), cfg.Jc)
+		}
+		for _, p := range got {
+			if len(p) < cfg.Jmin || len(p) > cfg.Jmax {
+				t.Fatalf("size %d outside [%d,%d]", len(p), cfg.Jmin, cfg.Jmax)
+			}
+			if binary.BigEndian.Uint32(p[4:8]) != 0x2112A442 {
+				t.Fatal("packet not generated from the template")
+			}
+		}
+	}
+}
+
+// TestJunkPacketSize checks the sizes the QUIC and STUN generators need for
+// well-formed packets.
+func TestJunkPacketSize(t *testing.T) {
+	cfg := proxyTestConfig()
+	cfg.Jc, cfg.Jmin, cfg.Jmax = 16, 41, 301
+
+	cfg.JunkTemplate, _ = ParseJunkTemplate("stun")
+	for _, p := range GenerateJunkPackets(cfg) {
+		if len(p)%4 != 0 || len(p) < 44 || len(p) > 300 {
+			t.Fatalf("STUN junk of %d bytes", len(p))
+		}
+		if l := binary.BigEndian.Uint16(p[2:4]); l%4 != 0 {
+			t.Fatalf("STUN message length %d not a multiple of 4", l)
+		}
+	}
+	for _, c := range []struct{ n, jmin, jmax, want int }{
+		{41, 41, 301, 44},
+		{300, 41, 301, 300},
+		{301, 41, 301, 300}, // rounding up would leave the range
+		{41, 41, 43, 41},    // no multiple of 4, rejected by CheckSizes
+	} {
+		if got := cfg.JunkTemplate.packetSize(c.n, c.jmin, c.jmax); got != c.want {
+			t.Fatalf("STUN packetSize(%d, %d, %d) = %d, want %d", c.n, c.jmin, c.jmax, got, c.want)
+		}
+	}
+
+	cfg.JunkTemplate, _ = ParseJunkTemplate("quic")
+	cfg.Jmax = 1500
+	if cfg.junkMax() != cfg.Jmax {
+		t.Fatalf("junkMax %d, want Jmax %d", cfg.junkMax(), cfg.Jmax)
+	}
+	j := newJunkState(cfg)
+	for _, p := range j.junk(cfg) {
+		if len(p) < quicMinInitial || len(p) > cfg.Jmax {
+			t.Fatalf("QUIC Initial of %d bytes, want %d-%d", len(p), quicMinInitial, cfg.Jmax)
+		}
+	}
+}
+
+func TestJunkCheckSizes(t *testing.T) {
+	for _, c := range []struct {
+		tmpl       string
+		jmin, jmax int
+		ok         bool
+	}{
+		{"quic", 40, 1200, true},
+		{"quic", 40, 1199, false},
+		{"quic", 1300, 1400, true},
+		{"stun", 41, 43, false},
+		{"stun", 41, 44, true},
+		{"stun", 40, 40, true},
+		{"dns", 10, 11, true},
+		{"<r 8>", 1, 2, true},
+	} {
+		tmpl, err := ParseJunkTemplate(c.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tmpl.CheckSizes(c.jmin, c.jmax); (err == nil) != c.ok {
+			t.Fatalf("%s in [%d, %d]: err = %v, want ok=%v", c.tmpl, c.jmin, c.jmax, err, c.ok)
+		}
+	}
+	var none *JunkTemplate
+	if err := none.CheckSizes(5, 6); err != nil {
+		t.Fatal("random junk rejected: ", err)
+	}
+}
+
+// TestJunkSizesInRange checks Jmin <= len <= Jmax for every generator and
+// both junk paths, over the ranges CheckSizes accepts.
+func TestJunkSizesInRange(t *testing.T) {
+	ranges := [][2]int{{1, 1}, {20, 20}, {41, 45}, {30, 500}, {1199, 1203}, {1000, 1500}}
+	for _, name := range []string{"", "quic", "dns", "stun", "<b 0x170303><c>", "@preset:dns-query"} {
+		var tmpl *JunkTemplate
+		if name != "" {
+			var err error
+			if tmpl, err = ParseJunkTemplate(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, r := range ranges {
+			if tmpl.CheckSizes(r[0], r[1]) != nil {
+				continue
+			}
+			cfg := proxyTestConfig()
+			cfg.Jc, cfg.Jmin, cfg.Jmax, cfg.JunkTemplate = 32, r[0], r[1], tmpl
+			j := newJunkState(cfg)
+			for _, got := range [][][]byte{GenerateJunkPackets(cfg), j.junk(cfg)} {
+				for _, p := range got {
+					if len(p) < cfg.Jmin || len(p) > cfg.Jmax {
+						t.Fatalf("%q: %d bytes outside [%d, %d]", name, len(p), cfg.Jmin, cfg.Jmax)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package awg
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Log rate limiting for the packet loops.
+//
+// Errors such as "remote write: ..." repeat once per packet during outages.
+// logLimiter gives every distinct message a token bucket; messages over the
+// limit are counted and later reported as a single
+// "N similar messages suppressed" line.
+
+const (
+	defaultLogRate  = 1.0 // messages per second per distinct message
+	defaultLogBurst = 5
+	logLimitMaxKeys = 256 // distinct messages tracked
+	logLimitIdle    = time.Minute
+)
+
+type logEntry struct {
+	prefix     string // "INFO: ", "ERROR: "
+	msg        string
+	tokens     float64
+	last       time.Time
+	suppressed uint64
+}
+
+type logLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second; < 0 disables limiting
+	burst   float64
+	entries map[string]*logEntry
+	now     func() time.Time
+}
+
+// newLogLimiter creates a limiter. rate 0 and burst <= 0 select the defaults,
+// a negative rate disables limiting.
+func newLogLimiter(rate float64, burst int) *logLimiter {
+	if rate == 0 {
+		rate = defaultLogRate
+	}
+	if burst <= 0 {
+		burst = defaultLogBurst
+	}
+	return &logLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		entries: make(map[string]*logEntry),
+		now:     time.Now,
+	}
+}
+
+// allow reports whether msg may be written now. When it may and earlier
+// copies were suppressed, their count is returned so the caller can report it.
+func (l *logLimiter) allow(prefix, msg string) (ok bool, suppressed uint64) {
+	if l.rate < 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	key := prefix + msg
+	e := l.entries[key]
+	if e == nil {
+		if len(l.entries) >= logLimitMaxKeys {
+			l.evict(now)
+		}
+		e = &logEntry{prefix: prefix, msg: msg, tokens: l.burst, last: now}
+		l.entries[key] = e
+	} else {
+		e.tokens += now.Sub(e.last).Seconds() * l.rate
+		if e.tokens > l.burst {
+			e.tokens = l.burst
+		}
+		e.last = now
+	}
+	if e.tokens < 1 {
+		e.suppressed++
+		return false, 0
+	}
+	e.tokens--
+	suppressed, e.suppressed = e.suppressed, 0
+	return true, suppressed
+}
+
+// flush returns summaries (prefix, line) for messages with suppressed copies
+// and forgets idle entries. Called periodically so that a burst which stops
+// is still reported.
+func (l *logLimiter) flush() [][2]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var out [][2]string
+	for key, e := range l.entries {
+		if e.suppressed > 0 {
+			out = append(out, [2]string{e.prefix, suppressedLine(e.suppressed, e.msg)})
+			e.suppressed = 0
+		} else if now.Sub(e.last) > logLimitIdle {
+			delete(l.entries, key)
+		}
+	}
+	return out
+}
+
+// evict drops idle entries, or all of them if none are idle. Caller holds l.mu.
+func (l *logLimiter) evict(now time.Time) {
+	for key, e := range l.entries {
+		if e.suppressed == 0 && now.Sub(e.last) > logLimitIdle {
+			delete(l.entries, key)
+		}
+	}
+	if len(l.entries) >= logLimitMaxKeys {
+		clear(l.entries)
+	}
+}
+
+func suppressedLine(n uint64, msg string) string {
+	return strconv.FormatUint(n, 10) + " similar messages suppressed: " + msg
+}
+
+// log writes a message through the limiter.
+func (l *logLimiter) log(prefix string, parts []string) {
+	msg := ""
+	for _, s := range parts {
+		msg += s
+	}
+	ok, suppressed := l.allow(prefix, msg)
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		writeLog(prefix, []string{suppressedLine(suppressed, msg)})
+	}
+	writeLog(prefix, []string{msg})
+}
+
+// writeSuppressed reports messages suppressed since the last call.
+func (l *logLimiter) writeSuppressed() {
+	for _, e := range l.flush() {
+		writeLog(e[0], []string{e[1]})
+	}
+}
+
+// logInfo is LogInfo with rate limiting of repeated messages.
+func (p *Proxy) logInfo(parts ...string) {
+	if p.cfg.logLevel() < LevelInfo {
+		return
+	}
+	p.logLim.log("INFO: ", parts)
+}
+
+// logError is LogError with rate limiting of repeated messages.
+func (p *Proxy) logError(parts ...string) {
+	if p.cfg.logLevel() < LevelError {
+		return
+	}
+	p.logLim.log("ERROR: ", parts)
+}
+
+// flushLogs reports messages suppressed since the last flush.
+func (p *Proxy) flushLogs() {
+	if p.cfg.logLevel() < LevelError {
+		return
+	}
+	p.logLim.writeSuppressed()
+}
@@ -0,0 +1,95 @@
+package awg
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock returns a limiter clock that only advances when told to.
+func fakeClock(l *logLimiter) func(time.Duration) {
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+	return func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestLogLimiterBurstAndSuppress(t *testing.T) {
+	l := newLogLimiter(1, 3)
+	advance := fakeClock(l)
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if ok, _ := l.allow("ERROR: ", "remote write: refused"); ok {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Fatalf("expected burst of 3, got %d", allowed)
+	}
+
+	// After a refill the next message carries the suppressed count.
+	advance(time.Second)
+	ok, suppressed := l.allow("ERROR: ", "remote write: refused")
+	if !ok || suppressed != 7 {
+		t.Fatalf("expected ok with 7 suppressed, got ok=%v suppressed=%d", ok, suppressed)
+	}
+}
+
+func TestLogLimiterDistinctMessages(t *testing.T) {
+	l := newLogLimiter(1, 1)
+	fakeClock(l)
+	if ok, _ := l.allow("ERROR: ", "a"); !ok {
+		t.Fatal("first a denied")
+	}
+	if ok, _ := l.allow("ERROR: ", "b"); !ok {
+		t.Fatal("first b denied: messages must be limited independently")
+	}
+	if ok, _ := l.allow("INFO: ", "a"); !ok {
+		t.Fatal("INFO a denied: levels must be limited independently")
+	}
+	if ok, _ := l.allow("ERROR: ", "a"); ok {
+		t.Fatal("second a allowed")
+	}
+}
+
+func TestLogLimiterFlush(t *testing.T) {
+	l := newLogLimiter(1, 1)
+	advance := fakeClock(l)
+	for i := 0; i < 4; i++ {
+		l.allow("ERROR: ", "listen write: no buffer space")
+	}
+	out := l.flush()
+	if len(out) != 1 || out[0][0] != "ERROR: " ||
+		!strings.HasPrefix(out[0][1], "3 similar messages suppressed: listen write") {
+		t.Fatalf("unexpected flush output: %q", out)
+	}
+	if out := l.flush(); len(out) != 0 {
+		t.Fatalf("expected nothing to flush, got %q", out)
+	}
+	// Idle entries are forgotten.
+	advance(2 * logLimitIdle)
+	l.flush()
+	if len(l.entries) != 0 {
+		t.Fatalf("expected idle entries to be dropped, have %d", len(l.entries))
+	}
+}
+
+func TestLogLimiterDisabled(t *testing.T) {
+	l := newLogLimiter(-1, 1)
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.allow("ERROR: ", "x"); !ok {
+			t.Fatal("limiter with negative rate must allow everything")
+		}
+	}
+}
+
+func TestLogLimiterBoundedKeys(t *testing.T) {
+	l := newLogLimiter(1, 1)
+	fakeClock(l)
+	for i := 0; i < 3*logLimitMaxKeys; i++ {
+		l.allow("ERROR: ", "client: 10.0.0."+string(rune('a'+i%26))+string(rune('a'+i/26)))
+	}
+	if len(l.entries) > logLimitMaxKeys {
+		t.Fatalf("expected at most %d entries, have %d", logLimitMaxKeys, len(l.entries))
+	}
+}
@@ -0,0 +1,102 @@
+package awg
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// MTU accounting.
+//
+// S1-S4 padding makes every packet sent to the server larger than the one
+// WireGuard handed to the proxy. With an interface MTU chosen for a bare
+// tunnel, padded transport packets no longer fit the path: they are
+// fragmented, or with path MTU discovery enabled rejected with EMSGSIZE.
+
+const (
+	// DefaultPathMTU is the path MTU assumed when none is configured.
+	DefaultPathMTU = 1500
+
+	wgMTUOverhead   = 80   // what wg-quick subtracts: IPv6 (40) + UDP (8) + WireGuard transport (32)
+	udpIPv4Overhead = 28   // IPv4 + UDP headers
+	minWGMTU        = 1280 // IPv6 minimum link MTU
+)
+
+// MaxPadding returns the largest of S1-S4.
+func (c *Config) MaxPadding() int {
+	return max(c.S1, c.S2, c.S3, c.S4)
+}
+
+// packetBufSize returns the size of a per-packet buffer: the largest
+// WireGuard packet plus the largest padding, so that padded packets from the
+// server are never truncated on read.
+func (c *Config) packetBufSize() int {
+	return bufSize + c.MaxPadding()
+}
+
+// maxSendSize returns the largest packet sent to the server: a padded
+// WireGuard packet, a junk packet or a CPS packet.
+func (c *Config) maxSendSize() int {
+	size := max(c.S4+c.packetBufSize(), c.junkMax())
+	for _, t := range c.CPS {
+		if t != nil {
+			size = max(size, t.Size())
+		}
+	}
+	return size
+}
+
+// junkMax returns the largest junk packet. Junk templates keep sizes in
+// [Jmin, Jmax] (see JunkTemplate.packetSize).
+func (c *Config) junkMax() int {
+	return max(c.Jmax, c.Jmin, 0)
+}
+
+// RecommendedMTU returns the largest WireGuard interface MTU whose transport
+// packets still fit a path MTU of pathMTU after S4 padding.
+func (c *Config) RecommendedMTU(pathMTU int) int {
+	return pathMTU - wgMTUOverhead - c.S4
+}
+
+// MTUWarnings lists the packets this configuration makes too large for an
+// IPv4 path with MTU pathMTU. Such packets are fragmented on the way.
+func (c *Config) MTUWarnings(pathMTU int) []string {
+	limit := pathMTU - udpIPv4Overhead
+	var warns []string
+	check := func(what string, size int) {
+		if size > limit {
+			warns = append(warns, what+" is "+strconv.Itoa(size)+"B, over the "+strconv.Itoa(limit)+"B UDP payload limit")
+		}
+	}
+	check("handshake init (148+S1)", WgHandshakeInitSize+c.S1)
+	check("handshake response (92+S2)", WgHandshakeResponseSize+c.S2)
+	check("cookie reply (64+S3)", WgCookieReplySize+c.S3)
+	check("junk packet (Jmax)", c.junkMax())
+	for i, t := range c.CPS {
+		if t != nil {
+			check("CPS packet I"+strconv.Itoa(i+1), t.Size())
+		}
+	}
+	if mtu := c.RecommendedMTU(pathMTU); mtu < minWGMTU {
+		warns = append(warns, "S4="+strconv.Itoa(c.S4)+" leaves a WireGuard MTU of "+strconv.Itoa(mtu)+
+			", below the IPv6 minimum of "+strconv.Itoa(minWGMTU))
+	}
+	return warns
+}
+
+// isMsgSizeErr reports whether a write failed because the packet exceeds the
+// path MTU (only reported with path MTU discovery enabled) or the socket limit.
+func isMsgSizeErr(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE)
+}
+
+// oversizeHint returns the log message for a write to conn rejected with
+// EMSGSIZE, with the WireGuard MTU that would fit the current path MTU.
+func oversizeHint(conn *net.UDPConn, cfg *Config) string {
+	msg := "remote write: packet exceeds the path MTU"
+	if mtu := pathMTU(conn); mtu > 0 {
+		msg += " of " + strconv.Itoa(mtu) + ", set the WireGuard MTU to " + strconv.Itoa(cfg.RecommendedMTU(mtu)) + " or lower"
+	}
+	return msg
+}
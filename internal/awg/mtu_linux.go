@@ -0,0 +1,42 @@
+//go:build linux
+
+package awg
+
+import (
+	"net"
+	"syscall"
+)
+
+// setPMTUDiscover sets the don't-fragment bit on packets sent over conn, so
+// the kernel tracks the path MTU and oversized writes fail with EMSGSIZE
+// instead of being fragmented.
+func setPMTUDiscover(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sysErr error
+	err = raw.Control(func(fd uintptr) {
+		sysErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+	})
+	if err != nil {
+		return err
+	}
+	return sysErr
+}
+
+// pathMTU returns the kernel's current path MTU estimate for the connected
+// socket conn, or 0 if unknown.
+func pathMTU(conn *net.UDPConn) int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	mtu := 0
+	raw.Control(func(fd uintptr) {
+		if v, err := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU); err == nil {
+			mtu = v
+		}
+	})
+	return mtu
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package awg
+
+import (
+	"errors"
+	"net"
+)
+
+func setPMTUDiscover(_ *net.UDPConn) error {
+	return errors.New("path MTU discovery is only supported on Linux")
+}
+
+func pathMTU(_ *net.UDPConn) int { return 0 }
@@ -0,0 +1,89 @@
+package awg
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecommendedMTU(t *testing.T) {
+	cfg := proxyTestConfig()
+	if got := cfg.RecommendedMTU(1500); got != 1420 {
+		t.Fatalf("S4=0: got %d, want 1420 (wg-quick default)", got)
+	}
+	cfg.S4 = 32
+	if got := cfg.RecommendedMTU(1492); got != 1380 {
+		t.Fatalf("S4=32, PPPoE: got %d, want 1380", got)
+	}
+}
+
+func TestMTUWarnings(t *testing.T) {
+	cfg := proxyTestConfig()
+	if w := cfg.MTUWarnings(1500); len(w) != 0 {
+		t.Fatalf("unexpected warnings for the default config: %q", w)
+	}
+
+	cfg.S1 = 1400 // init = 1548B
+	cfg.S4 = 300  // WireGuard MTU 1120
+	cfg.Jmax = 1480
+	tmpl, err := ParseCPSTemplate("<r 1600>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.CPS[1] = tmpl
+	w := strings.Join(cfg.MTUWarnings(1500), "\n")
+	for _, want := range []string{"handshake init (148+S1) is 1548B", "junk packet (Jmax) is 1480B", "CPS packet I2 is 1600B", "WireGuard MTU of 1120"} {
+		if !strings.Contains(w, want) {
+			t.Fatalf("missing %q in:\n%s", want, w)
+		}
+	}
+	if strings.Contains(w, "response") || strings.Contains(w, "cookie") {
+		t.Fatalf("unexpected warning in:\n%s", w)
+	}
+}
+
+func TestMaxSendSize(t *testing.T) {
+	cfg := proxyTestConfig()
+	cfg.S4 = 64
+	if got, want := cfg.maxSendSize(), 64+bufSize+122; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+	tmpl, _ := ParseCPSTemplate("<r 4000>")
+	cfg.CPS[0] = tmpl
+	if got := cfg.maxSendSize(); got != 4000 {
+		t.Fatalf("with a 4000B CPS packet: got %d", got)
+	}
+}
+
+// TestProxyLargeS4 checks that transport packets padded beyond the old fixed
+// headroom pass in both directions without truncation.
+func TestProxyLargeS4(t *testing.T) {
+	cfg := proxyTestConfig()
+	cfg.S4 = 600
+	cfg.ComputeFastPath()
+
+	server := startMockServer(t)
+	defer server.Close()
+	proxyAddr, stop := startProxy(t, cfg, server.LocalAddr().(*net.UDPAddr))
+	defer stop()
+	client, err := net.DialUDP("udp", nil, proxyAddr)
+	if err != nil {
+		t.Fatal("dial: ", err)
+	}
+	defer client.Close()
+	from := establishSession(t, cfg, client, server)
+
+	const size = 1400
+	client.Write(makeWGPacket(wgTransportData, size))
+	pkts := readPackets(server, 2*time.Second, 1)
+	if len(pkts) != 1 || len(pkts[0]) != cfg.S4+size {
+		t.Fatalf("server got %d packets, want one of %dB", len(pkts), cfg.S4+size)
+	}
+
+	server.WriteToUDP(pkts[0], from) // same form works in the other direction (H4 fixed)
+	pkts = readPackets(client, 2*time.Second, 1)
+	if len(pkts) != 1 || len(pkts[0]) != size {
+		t.Fatalf("client got %d packets, want one of %dB", len(pkts), size)
+	}
+}
@@ -0,0 +1,149 @@
+package awg
+
+import (
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Handshake burst pacing.
+//
+// Without pacing the CPS packets, the junk packets and the handshake init
+// leave back to back within microseconds, which is easy to recognise. With
+// pacing, the read loop hands each init to a dedicated emitter goroutine that
+// sends the preamble and the init with the configured gaps, so transport data
+// keeps flowing meanwhile. Inits are emitted in the order they were read.
+
+// hsQueueLen is the number of inits waiting for the emitter; further inits
+// are dropped (WireGuard retransmits after 5 seconds).
+const hsQueueLen = 4
+
+// Pacing configures delays within the handshake burst. The zero value sends
+// the burst back to back.
+type Pacing struct {
+	Gap       time.Duration // pause after each CPS and junk packet
+	Jitter    time.Duration // random extra pause, up to Jitter, added to each Gap
+	InitDelay time.Duration // extra pause between the last junk packet and the init
+}
+
+func (pc Pacing) enabled() bool {
+	return pc.Gap > 0 || pc.Jitter > 0 || pc.InitDelay > 0
+}
+
+// pause returns the pause after a preamble packet.
+func (pc Pacing) pause() time.Duration {
+	d := pc.Gap
+	if pc.Jitter > 0 {
+		d += time.Duration(rand.Int64N(int64(pc.Jitter) + 1))
+	}
+	return d
+}
+
+// String describes the pacing for the startup log.
+func (pc Pacing) String() string {
+	return "gap=" + pc.Gap.String() + " jitter=" + pc.Jitter.String() + " init_delay=" + pc.InitDelay.String()
+}
+
+// handshakeJob is a transformed handshake init waiting for its preamble.
+type handshakeJob struct {
+	conn *net.UDPConn
+	init []byte // owned by the job
+	cps  bool   // send the CPS packets
+	jc   int    // junk packets to send
+}
+
+// SetPacing enables pacing of the handshake burst. Must be called before Run.
+func (p *Proxy) SetPacing(pc Pacing) {
+	p.pacing = pc
+}
+
+// queueHandshake hands a transformed init to the emitter. init is copied, as
+// it points into the read buffer.
+func (p *Proxy) queueHandshake(conn *net.UDPConn, init []byte, cps bool, jc int) {
+	job := handshakeJob{conn: conn, init: append([]byte(nil), init...), cps: cps, jc: jc}
+	select {
+	case p.hsQueue <- job:
+	default:
+		p.logInfo("c->s: handshake emitter busy, init dropped")
+	}
+}
+
+// handshakeEmitter sends queued inits with their paced preamble until stop is closed.
+func (p *Proxy) handshakeEmitter(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case job := <-p.hsQueue:
+			if !p.emitHandshake(job, stop) {
+				return
+			}
+		}
+	}
+}
+
+// emitHandshake sends the CPS and junk packets and then the init, pausing as
+// configured. Returns false if stop was closed meanwhile.
+func (p *Proxy) emitHandshake(job handshakeJob, stop <-chan struct{}) bool {
+	conn := job.conn
+	cpsPackets, junkPackets := p.transformer().Prelude(job.cps, job.jc)
+	for ci, pkt := range cpsPackets {
+		if _, err := conn.Write(pkt); err != nil {
+			return true // connection replaced, WG will retransmit
+		}
+		p.stats.cpsSent.Add(1)
+		if p.capture != nil {
+			p.captureServerSide(captureOut, conn, pkt, "cps "+strconv.Itoa(ci+1))
+		}
+		if !sleepStop(p.pacing.pause(), stop) {
+			return false
+		}
+	}
+	for _, junk := range junkPackets {
+		if _, err := conn.Write(junk); err != nil {
+			return true
+		}
+		p.stats.junkSent.Add(1)
+		if p.capture != nil {
+			p.captureServerSide(captureOut, conn, junk, "junk")
+		}
+		if !sleepStop(p.pacing.pause(), stop) {
+			return false
+		}
+	}
+	if !sleepStop(p.pacing.InitDelay, stop) {
+		return false
+	}
+
+	if _, err := conn.Write(job.init); err != nil {
+		if !isClosedErr(err) {
+			p.remoteWriteErr(conn, err, 1)
+		}
+		return true
+	}
+	p.stats.pktsOut.Add(1)
+	p.stats.bytesOut.Add(uint64(len(job.init)))
+	if p.capture != nil {
+		p.captureServerSide(captureOut, conn, job.init, "")
+	}
+	if p.cfg.logLevel() >= LevelDebug {
+		LogDebug(p.cfg, "c->s: paced handshake init ", strconv.Itoa(len(job.init)), "B sent")
+	}
+	return true
+}
+
+// sleepStop sleeps for d. Returns false if stop was closed first.
+func sleepStop(d time.Duration, stop <-chan struct{}) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,137 @@
+package awg
+
+import (
+	"errors"
+	"time"
+)
+
+// Padding content (AWG_S1_TEMPLATE-AWG_S4_TEMPLATE).
+//
+// The S1-S4 padding bytes are random by default, so every obfuscated packet
+// starts with pure noise. A padding template is a CPS template or preset
+// whose output replaces the random bytes: it is truncated to S bytes, or
+// repeated until S bytes are filled, so packet sizes stay what the peer's
+// size-based dispatch expects. Computed fields cover only the copy of the
+// template they are in, and <c> counts the copies within the padding.
+//
+// The S1-S4 sizes are fixed, so ComputeFastPath lays each template out once
+// (paddingFill): per packet the padding is copied from that image and only
+// the random and timestamp segments, and the computed fields depending on
+// them, are filled in.
+
+// ParsePaddingTemplate parses an S1-S4 padding template: a CPS template or
+// "@preset:name" generating at least one byte.
+func ParsePaddingTemplate(s string) (*CPSTemplate, error) {
+	tmpl, err := ParseCPSValue(s)
+	if err != nil {
+		return nil, err
+	}
+	if tmpl.Size() == 0 {
+		return nil, errors.New("template generates no bytes")
+	}
+	return tmpl, nil
+}
+
+// fillPadding fills the padding b from tmpl, or with random bytes if tmpl is nil.
+func fillPadding(b []byte, tmpl *CPSTemplate) {
+	if tmpl == nil {
+		randFill(b)
+		return
+	}
+	for i := uint32(0); len(b) > 0; i++ {
+		b = b[tmpl.put(b, i):]
+	}
+}
+
+// paddingFill is a padding template laid out for one padding size.
+type paddingFill struct {
+	tmpl   *CPSTemplate
+	image  []byte        // the padding with the random segments left zero
+	spans  []paddingSpan // segments filled per packet
+	copies [][2]int      // copies whose computed fields are filled per packet
+}
+
+// paddingSpan is a segment of the image filled per packet.
+type paddingSpan struct {
+	off, n int
+	seg    *cpsSegment
+}
+
+// newPaddingFill lays out tmpl for a padding of size bytes. tmpl may be nil.
+func newPaddingFill(tmpl *CPSTemplate, size int) *paddingFill {
+	if tmpl == nil || size <= 0 {
+		return nil
+	}
+	f := &paddingFill{tmpl: tmpl, image: make([]byte, size)}
+	fillPadding(f.image, tmpl)
+	var fields []paddingSpan
+	for base := 0; base < size; {
+		off := base
+		for i := range tmpl.segments {
+			seg := &tmpl.segments[i]
+			if off >= size {
+				break
+			}
+			n := min(seg.len(), size-off)
+			switch seg.kind {
+			case cpsRandom, cpsRandomChars, cpsRandomDigits, cpsTimestamp:
+				f.spans = append(f.spans, paddingSpan{off: off, n: n, seg: seg})
+			case cpsLength, cpsCRC32, cpsCRC16, cpsChecksum:
+				fields = append(fields, paddingSpan{off: off, n: n, seg: seg})
+			}
+			off += n
+		}
+		if off == base {
+			return nil // generates no bytes, see ParsePaddingTemplate
+		}
+		if tmpl.fields != nil {
+			f.copies = append(f.copies, [2]int{base, off})
+		}
+		base = off
+	}
+	if len(f.spans) == 0 {
+		f.copies = nil // the fields in the image are final
+	}
+	for _, sp := range f.spans {
+		clear(f.image[sp.off : sp.off+sp.n])
+	}
+	if f.copies != nil {
+		for _, sp := range fields {
+			clear(f.image[sp.off : sp.off+sp.n])
+		}
+	}
+	return f
+}
+
+// fill writes the padding into b, which must have the laid-out size.
+func (f *paddingFill) fill(b []byte) {
+	copy(b, f.image)
+	for _, sp := range f.spans {
+		r := b[sp.off : sp.off+sp.n]
+		switch sp.seg.kind {
+		case cpsRandom:
+			randFill(r)
+		case cpsRandomChars:
+			randAlphanumFill(r)
+		case cpsRandomDigits:
+			randDigitFill(r)
+		case cpsTimestamp:
+			var v [8]byte
+			putUint(v[:sp.seg.width], uint64(time.Now().UnixNano()/sp.seg.unit), sp.seg.be)
+			copy(r, v[:sp.seg.width])
+		}
+	}
+	for _, c := range f.copies {
+		f.tmpl.computeFields(b[c[0]:c[1]])
+	}
+}
+
+// fillPadding fills padding i (S1-S4) into b, from the layout computed by
+// ComputeFastPath if it is still current.
+func (c *Config) fillPadding(i int, b []byte) {
+	if f := c.padFill[i]; f != nil && f.tmpl == c.Padding[i] && len(f.image) == len(b) {
+		f.fill(b)
+		return
+	}
+	fillPadding(b, c.Padding[i])
+}
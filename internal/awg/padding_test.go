@@ -0,0 +1,133 @@
+package awg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+func TestFillPadding(t *testing.T) {
+	tmpl, err := ParsePaddingTemplate("<b 0xaabb><c 1>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		size int
+		want []byte
+	}{
+		{1, []byte{0xaa}},
+		{3, []byte{0xaa, 0xbb, 0}},
+		{8, []byte{0xaa, 0xbb, 0, 0xaa, 0xbb, 1, 0xaa, 0xbb}},
+	} {
+		b := make([]byte, tc.size)
+		fillPadding(b, tmpl)
+		if !bytes.Equal(b, tc.want) {
+			t.Fatalf("size %d: got %x, want %x", tc.size, b, tc.want)
+		}
+	}
+
+	if _, err := ParsePaddingTemplate("<ms><me>"); err == nil {
+		t.Fatal("expected an error for an empty template")
+	}
+	if _, err := ParsePaddingTemplate("@preset:stun-binding"); err != nil {
+		t.Fatal("preset: ", err)
+	}
+}
+
+func TestPaddingTemplateRoundtrip(t *testing.T) {
+	cfg := testConfig()
+	cfg.S3, cfg.S4 = 11, 17
+	header := []byte{0x17, 0x03, 0x03}
+	for i := range cfg.Padding {
+		tmpl, err := ParsePaddingTemplate("<b 0x170303><l>")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Padding[i] = tmpl
+	}
+	cfg.ComputeFastPath()
+
+	for _, tc := range []struct {
+		msgType  uint32
+		size     int
+		pad      int
+		headroom int
+	}{
+		{wgHandshakeInit, WgHandshakeInitSize, cfg.S1, 0},
+		{wgHandshakeResponse, WgHandshakeResponseSize, cfg.S2, 0},
+		{wgCookieReply, WgCookieReplySize, cfg.S3, 0},
+		{wgTransportData, 100, cfg.S4, 0},
+		{wgTransportData, 100, cfg.S4, cfg.S4},
+	} {
+		original := makePacket(tc.msgType, tc.size)
+		buf := make([]byte, tc.headroom+tc.size)
+		copy(buf[tc.headroom:], original)
+		out, _ := TransformOutbound(buf, tc.headroom, tc.size, cfg)
+		if len(out) != tc.pad+tc.size {
+			t.Fatalf("type %d: %d bytes, want %d", tc.msgType, len(out), tc.pad+tc.size)
+		}
+		if !bytes.HasPrefix(out, header) {
+			t.Fatalf("type %d: padding %x does not start with the template", tc.msgType, out[:tc.pad])
+		}
+
+		in := make([]byte, len(out))
+		copy(in, out)
+		wg, valid := TransformInbound(in, len(in), cfg)
+		if !valid || len(wg) != tc.size {
+			t.Fatalf("type %d: inbound valid=%v, %d bytes", tc.msgType, valid, len(wg))
+		}
+		if tc.msgType == wgTransportData && !bytes.Equal(wg, original) {
+			t.Fatalf("type %d: roundtrip mismatch", tc.msgType)
+		}
+	}
+}
+
+// TestPaddingFill checks that the laid-out padding matches fillPadding and
+// fills transport padding without allocating.
+func TestPaddingFill(t *testing.T) {
+	// Static bytes and counters come from the image.
+	tmpl, _ := ParsePaddingTemplate("<b 0xaabb><c 1><l>")
+	f := newPaddingFill(tmpl, 11)
+	got, want := make([]byte, 11), make([]byte, 11)
+	f.fill(got)
+	fillPadding(want, tmpl)
+	if !bytes.Equal(got, want) || len(f.spans) != 0 || f.copies != nil {
+		t.Fatalf("got %x, want %x (%d spans, %d copies)", got, want, len(f.spans), len(f.copies))
+	}
+
+	// Random segments are refilled and the fields over them recomputed, per copy.
+	tmpl, _ = ParsePaddingTemplate("<b 0x0001><r 30><crc32>")
+	f = newPaddingFill(tmpl, 2*36+10)
+	b := make([]byte, 2*36+10)
+	f.fill(b)
+	prev := append([]byte(nil), b...)
+	f.fill(b)
+	if bytes.Equal(b[2:32], prev[2:32]) {
+		t.Fatal("random segment not refilled")
+	}
+	for _, pkt := range [][]byte{b[:36], b[36:72]} {
+		if got, want := binary.BigEndian.Uint32(pkt[32:]), crc32.ChecksumIEEE(pkt[:32]); got != want {
+			t.Fatalf("crc32 %08x, want %08x", got, want)
+		}
+	}
+	if b[72] != 0 || b[73] != 1 {
+		t.Fatalf("truncated copy %x", b[72:])
+	}
+
+	cfg := testConfig()
+	cfg.S4 = 64
+	cfg.Padding[3] = tmpl
+	cfg.ComputeFastPath()
+	if cfg.padFill[3] == nil {
+		t.Fatal("S4 padding not laid out")
+	}
+	buf := make([]byte, cfg.S4+100)
+	copy(buf[cfg.S4:], makePacket(wgTransportData, 100))
+	if n := testing.AllocsPerRun(100, func() {
+		binary.LittleEndian.PutUint32(buf[cfg.S4:], wgTransportData)
+		TransformOutbound(buf, cfg.S4, 100, cfg)
+	}); n != 0 {
+		t.Fatalf("transport padding allocates %v times per packet", n)
+	}
+}
@@ -0,0 +1,95 @@
+package awg
+
+import (
+	"errors"
+	"strings"
+)
+
+// Built-in CPS presets.
+//
+// Hand-written I1-I5 hex blobs are easy to get wrong. A preset is a CPS
+// template mimicking the first packet of a common UDP protocol, selected
+// with "@preset:name" instead of a template. Random parts (IDs, nonces,
+// names) are regenerated for every packet; lengths are computed fields.
+
+// cpsPresetPrefix selects a preset in AWG_I1-I5 and junk template values.
+const cpsPresetPrefix = "@preset:"
+
+// cpsPresetNames lists the presets in the order shown in error messages.
+var cpsPresetNames = []string{"quic-initial", "dns-query", "stun-binding", "sip-options", "dtls-hello"}
+
+// cpsPreset returns the template of a preset, or "" if there is none.
+func cpsPreset(name string) string {
+	switch name {
+	case "quic-initial":
+		// QUIC v1 Initial padded to 1200 bytes as browsers send it: long
+		// header, 8-byte DCID, no SCID or token, 2-byte varint length 1182.
+		return "<b 0xc30000000108><r 8><b 0x0000449e><r 1182>"
+
+	case "dns-query":
+		// Recursive A query for www.<random>.com with an EDNS0 OPT record.
+		return "<r 2><b 0x01000001000000000001>" +
+			"<b 0x03777777><b 0x0a><rc 10><b 0x03636f6d00><b 0x00010001>" +
+			"<b 0x00002904d0000000000000>"
+
+	case "stun-binding":
+		// ICE connectivity check: USERNAME (padded to 4 bytes), PRIORITY
+		// and ICE-CONTROLLING.
+		return "<b 0x0001><l><b 0x2112a442><r 12><ms>" +
+			"<b 0x00060009><rc 4>" + cpsText(":") + "<rc 4><b 0x000000>" +
+			"<b 0x00240004><r 4>" +
+			"<b 0x802a0008><r 8><me>"
+
+	case "sip-options":
+		// SIP keepalive probe over UDP.
+		return cpsText("OPTIONS sip:") + "<rc 8>" + cpsText(".com SIP/2.0\r\n"+
+			"Via: SIP/2.0/UDP 192.168.") + "<rd 1>" + cpsText(".1") + "<rd 2>" + cpsText(":5060;branch=z9hG4bK") + "<rc 10>" + cpsText("\r\n"+
+			"Max-Forwards: 70\r\n"+
+			"From: <sip:") + "<rc 6>" + cpsText("@") + "<rc 8>" + cpsText(".com>;tag=") + "<rd 8>" + cpsText("\r\n"+
+			"To: <sip:") + "<rc 8>" + cpsText(".com>\r\n"+
+			"Call-ID: ") + "<rc 16>" + cpsText("\r\n"+
+			"CSeq: 1 OPTIONS\r\n"+
+			"Content-Length: 0\r\n\r\n")
+
+	case "dtls-hello":
+		// DTLS 1.2 ClientHello as sent by WebRTC: record header, handshake
+		// header with 3-byte lengths, cipher suites and extensions
+		// (extended_master_secret, renegotiation_info, supported_groups,
+		// ec_point_formats, signature_algorithms, use_srtp).
+		return "<b 0x16feff0000000000000000><l><ms>" +
+			"<b 0x01><l 3><b 0x0000000000><l 3><ms>" +
+			"<b 0xfefd><r 32><b 0x0000>" +
+			"<b 0x0010c02bc02fcca9cca8c009c013c00ac014><b 0x0100>" +
+			"<l><ms>" +
+			"<b 0x00170000><b 0xff01000100><b 0x000a00080006001d00170018><b 0x000b00020100>" +
+			"<b 0x000d00140012040308040401050308050501080606010201>" +
+			"<b 0x000e000b0008000100020007000800>" +
+			"<me><me><me>"
+	}
+	return ""
+}
+
+// cpsText returns a static CPS tag for the ASCII text s.
+func cpsText(s string) string {
+	const digits = "0123456789abcdef"
+	b := make([]byte, 0, 2*len(s)+5)
+	b = append(b, "<b 0x"...)
+	for i := 0; i < len(s); i++ {
+		b = append(b, digits[s[i]>>4], digits[s[i]&0x0f])
+	}
+	return string(append(b, '>'))
+}
+
+// ParseCPSValue parses an AWG_I1-I5 value: a CPS template, or
+// "@preset:name" for a built-in preset such as @preset:quic-initial.
+func ParseCPSValue(s string) (*CPSTemplate, error) {
+	name, ok := strings.CutPrefix(s, cpsPresetPrefix)
+	if !ok {
+		return ParseCPSTemplate(s)
+	}
+	tmpl := cpsPreset(name)
+	if tmpl == "" {
+		return nil, errors.New("unknown preset \"" + name + "\", expected one of " + strings.Join(cpsPresetNames, ", "))
+	}
+	return ParseCPSTemplate(tmpl)
+}
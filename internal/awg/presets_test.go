@@ -0,0 +1,269 @@
+package awg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// generatePreset returns a few packets of a preset.
+func generatePreset(t *testing.T, name string) [][]byte {
+	t.Helper()
+	tmpl, err := ParseCPSValue(cpsPresetPrefix + name)
+	if err != nil {
+		t.Fatal(name, ": ", err)
+	}
+	var pkts [][]byte
+	for i := range 3 {
+		pkt := tmpl.Generate(uint32(i))
+		if len(pkt) != tmpl.Size() {
+			t.Fatalf("%s: %d bytes, Size() = %d", name, len(pkt), tmpl.Size())
+		}
+		pkts = append(pkts, pkt)
+	}
+	return pkts
+}
+
+func TestCPSPresetsParse(t *testing.T) {
+	for _, name := range cpsPresetNames {
+		generatePreset(t, name)
+	}
+	_, err := ParseCPSValue("@preset:nope")
+	if err == nil || !strings.Contains(err.Error(), "quic-initial") {
+		t.Fatalf("unknown preset: %v", err)
+	}
+	if _, err := ParseJunkTemplate("@preset:dns-query"); err != nil {
+		t.Fatal("junk template preset: ", err)
+	}
+}
+
+// quicVarint decodes a QUIC variable-length integer (RFC 9000, 16).
+func quicVarint(b []byte) (v uint64, n int, err error) {
+	if len(b) == 0 {
+		return 0, 0, errors.New("short varint")
+	}
+	n = 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0, errors.New("short varint")
+	}
+	v = uint64(b[0] & 0x3f)
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, n, nil
+}
+
+func parseQUICInitial(b []byte) error {
+	if len(b) < 7 || b[0]&0xc0 != 0xc0 || b[0]&0x30 != 0 {
+		return errors.New("not a long header Initial packet")
+	}
+	if binary.BigEndian.Uint32(b[1:5]) != 1 {
+		return errors.New("not QUIC v1")
+	}
+	off := 5
+	for _, what := range []string{"DCID", "SCID"} {
+		l := int(b[off])
+		if l > 20 || off+1+l > len(b) {
+			return errors.New("bad " + what + " length")
+		}
+		off += 1 + l
+	}
+	token, n, err := quicVarint(b[off:])
+	if err != nil || off+n+int(token) > len(b) {
+		return errors.New("bad token length")
+	}
+	off += n + int(token)
+	length, n, err := quicVarint(b[off:])
+	if err != nil || off+n+int(length) != len(b) {
+		return errors.New("length does not match the packet")
+	}
+	if len(b) < 1200 {
+		return errors.New("Initial shorter than 1200 bytes")
+	}
+	return nil
+}
+
+// parseDNSName skips an uncompressed domain name and returns the offset after it.
+func parseDNSName(b []byte, off int) (int, error) {
+	for off < len(b) {
+		l := int(b[off])
+		if l == 0 {
+			return off + 1, nil
+		}
+		if l > 63 || off+1+l > len(b) {
+			return 0, errors.New("bad label")
+		}
+		for _, c := range b[off+1 : off+1+l] {
+			if !isAlphanumeric(c) && c != '-' {
+				return 0, errors.New("bad character in label")
+			}
+		}
+		off += 1 + l
+	}
+	return 0, errors.New("unterminated name")
+}
+
+func parseDNSQuery(b []byte) error {
+	if len(b) < 12 {
+		return errors.New("short header")
+	}
+	if b[2]&0x80 != 0 || binary.BigEndian.Uint16(b[4:6]) != 1 || binary.BigEndian.Uint16(b[6:8]) != 0 ||
+		binary.BigEndian.Uint16(b[8:10]) != 0 {
+		return errors.New("not a query with one question")
+	}
+	off, err := parseDNSName(b, 12)
+	if err != nil {
+		return err
+	}
+	off += 4 // QTYPE, QCLASS
+	for range binary.BigEndian.Uint16(b[10:12]) {
+		if off+11 > len(b) || b[off] != 0 || binary.BigEndian.Uint16(b[off+1:]) != 41 {
+			return errors.New("additional record is not OPT")
+		}
+		off += 11 + int(binary.BigEndian.Uint16(b[off+9:]))
+	}
+	if off != len(b) {
+		return errors.New("trailing bytes after the records")
+	}
+	return nil
+}
+
+func parseSTUN(b []byte) error {
+	if len(b) < 20 || binary.BigEndian.Uint16(b) != 0x0001 || binary.BigEndian.Uint32(b[4:]) != 0x2112a442 {
+		return errors.New("not a STUN binding request")
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if length%4 != 0 || 20+length != len(b) {
+		return errors.New("length does not match the attributes")
+	}
+	for off := 20; off < len(b); {
+		if off+4 > len(b) {
+			return errors.New("short attribute header")
+		}
+		l := int(binary.BigEndian.Uint16(b[off+2:]))
+		off += 4 + (l+3)&^3
+		if off > len(b) {
+			return errors.New("attribute exceeds the message")
+		}
+	}
+	return nil
+}
+
+func parseSIPOptions(b []byte) error {
+	msg := string(b)
+	head, body, ok := strings.Cut(msg, "\r\n\r\n")
+	if !ok || body != "" {
+		return errors.New("missing header end or unexpected body")
+	}
+	lines := strings.Split(head, "\r\n")
+	if !strings.HasPrefix(lines[0], "OPTIONS sip:") || !strings.HasSuffix(lines[0], " SIP/2.0") {
+		return errors.New("bad request line " + lines[0])
+	}
+	headers := map[string]string{}
+	for _, l := range lines[1:] {
+		name, value, ok := strings.Cut(l, ": ")
+		if !ok {
+			return errors.New("bad header line " + l)
+		}
+		headers[name] = value
+	}
+	for _, name := range []string{"Via", "From", "To", "Call-ID", "CSeq", "Max-Forwards"} {
+		if headers[name] == "" {
+			return errors.New("missing " + name)
+		}
+	}
+	if headers["CSeq"] != "1 OPTIONS" || headers["Content-Length"] != "0" {
+		return errors.New("bad CSeq or Content-Length")
+	}
+	// The Via host must be a private address in canonical form: "<rd 2>"
+	// may start with 0, so the last octet is written as "1" + two digits.
+	host, _, _ := strings.Cut(strings.TrimPrefix(headers["Via"], "SIP/2.0/UDP "), ":")
+	if addr, err := netip.ParseAddr(host); err != nil || !addr.Is4() || !addr.IsPrivate() {
+		return errors.New("bad Via host " + host)
+	}
+	return nil
+}
+
+func parseDTLSClientHello(b []byte) error {
+	if len(b) < 13 || b[0] != 22 || b[1] != 0xfe {
+		return errors.New("not a DTLS handshake record")
+	}
+	if 13+int(binary.BigEndian.Uint16(b[11:])) != len(b) {
+		return errors.New("record length does not match")
+	}
+	hs := b[13:]
+	u24 := func(b []byte) int { return int(b[0])<<16 | int(b[1])<<8 | int(b[2]) }
+	if len(hs) < 12 || hs[0] != 1 {
+		return errors.New("not a ClientHello")
+	}
+	if u24(hs[1:]) != len(hs)-12 || u24(hs[6:]) != 0 || u24(hs[9:]) != len(hs)-12 {
+		return errors.New("handshake or fragment length does not match")
+	}
+	body := hs[12:]
+	if len(body) < 35 || !bytes.Equal(body[:2], []byte{0xfe, 0xfd}) {
+		return errors.New("not DTLS 1.2")
+	}
+	off := 34
+	vec := func(lenSize int) ([]byte, error) {
+		if off+lenSize > len(body) {
+			return nil, errors.New("short vector length")
+		}
+		l := 0
+		for _, c := range body[off : off+lenSize] {
+			l = l<<8 | int(c)
+		}
+		off += lenSize
+		if off+l > len(body) {
+			return nil, errors.New("vector exceeds the message")
+		}
+		off += l
+		return body[off-l : off], nil
+	}
+	for _, lenSize := range []int{1, 1, 2, 1} { // session_id, cookie, cipher_suites, compression_methods
+		if _, err := vec(lenSize); err != nil {
+			return err
+		}
+	}
+	exts, err := vec(2)
+	if err != nil {
+		return err
+	}
+	if off != len(body) {
+		return errors.New("trailing bytes after the extensions")
+	}
+	for len(exts) > 0 {
+		if len(exts) < 4 || 4+int(binary.BigEndian.Uint16(exts[2:])) > len(exts) {
+			return errors.New("bad extension")
+		}
+		exts = exts[4+int(binary.BigEndian.Uint16(exts[2:])):]
+	}
+	return nil
+}
+
+func TestCPSPresetsDecode(t *testing.T) {
+	parsers := map[string]func([]byte) error{
+		"quic-initial": parseQUICInitial,
+		"dns-query":    parseDNSQuery,
+		"stun-binding": parseSTUN,
+		"sip-options":  parseSIPOptions,
+		"dtls-hello":   parseDTLSClientHello,
+	}
+	for _, name := range cpsPresetNames {
+		parse := parsers[name]
+		if parse == nil {
+			t.Fatalf("no parser for preset %s", name)
+		}
+		pkts := generatePreset(t, name)
+		for _, pkt := range pkts {
+			if err := parse(pkt); err != nil {
+				t.Fatalf("%s: %v\n%x", name, err, pkt)
+			}
+		}
+		if bytes.Equal(pkts[0], pkts[1]) {
+			t.Fatalf("%s: identical packets, random parts missing", name)
+		}
+	}
+}
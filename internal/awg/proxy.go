@@ -14,7 +14,7 @@ import (
 	"time"
 )
 
-const bufSize = 1500 // standard MTU
+const bufSize = 1500 // largest WireGuard packet read; padding is added on top (see packetBufSize)
 
 const defaultSocketBuf = 16 * 1024 * 1024 // 16 MB request; kernel clamps to rmem_max
 
@@ -29,10 +29,33 @@ type Proxy struct {
 	clientAddr atomic.Pointer[netip.AddrPort]
 	remoteConn atomic.Pointer[net.UDPConn]
 	stopped    atomic.Bool
-	lastActive atomic.Bool // activity flag; set on recv, cleared by timeout checker
-	cpsCounter uint32      // counter for CPS <c> tags
-	junkBuf    []byte      // pre-allocated: Jc * Jmax bytes for junk generation
-	junkPkts   [][]byte    // pre-allocated: Jc slice headers for junk packets
+	lastActive atomic.Bool  // activity flag; set on recv, cleared by timeout checker
+	capture    *Capture     // packet capture, nil = disabled
+	started    atomic.Int64 // unix nanos when Run started
+	stats      proxyStats
+	diag       *inboundDiag      // dropped inbound packet histogram and hints
+	diagBudget atomic.Int32      // drops recorded this check interval, see recordDrop
+	diagnose   bool              // periodically log the inferred parameters
+	pmtu       bool              // path MTU discovery on the remote socket
+	offload    bool              // UDP GSO/GRO in the batch loops, see SetOffload
+	pacing     Pacing            // handshake burst pacing, see SetPacing
+	hsQueue    chan handshakeJob // inits for the handshake emitter, nil = no pacing
+	retry      RetryPolicy       // reduced burst for retransmitted inits, see SetRetryPolicy
+	retryState retryState        // used by the client -> server goroutine
+	filter     *sessionFilter    // receiver index check for inbound packets, nil = disabled
+	logLim     *logLimiter       // collapses repeated INFO/ERROR messages
+
+	tr       atomic.Pointer[activeTransformer] // packet transformation, AmneziaWG by default
+	reload   func() (*Config, error)           // re-reads the configuration, see SetReload
+	idleMu   sync.Mutex
+	runStop  <-chan struct{} // stop channel of Run, nil before Run
+	idleStop chan struct{}   // stops the idle senders of the transformer in use
+
+	workers int      // listen sockets, see SetWorkers
+	lanes   []*Proxy // the other workers while Run runs, guarded by idleMu
+	parent  *Proxy   // the proxy a lane belongs to, nil for the proxy itself
+
+	statsInterval time.Duration // periodic stats summary, 0 = disabled
 }
 
 // NewProxy creates a new Proxy instance.
@@ -41,39 +64,127 @@ func NewProxy(cfg *Config, listenAddr, remoteAddr *net.UDPAddr) *Proxy {
 		cfg:        cfg,
 		listenAddr: listenAddr,
 		remoteAddr: remoteAddr,
+		diag:       newInboundDiag(),
+		logLim:     newLogLimiter(cfg.LogRate, cfg.LogBurst),
 	}
-	if cfg.Jc > 0 && cfg.Jmax > 0 {
-		p.junkBuf = make([]byte, cfg.Jc*cfg.Jmax)
-		p.junkPkts = make([][]byte, cfg.Jc)
-	}
+	p.setTransformer(NewAmneziaTransformer(cfg), cfg)
 	return p
 }
 
-// generateJunk fills pre-allocated junk buffers with random data and returns
-// slices of random sizes in [Jmin, Jmax]. Zero allocations per call.
-func (p *Proxy) generateJunk() [][]byte {
-	if p.cfg.Jc <= 0 || p.cfg.Jmax <= 0 {
+// SetCapture enables pcapng capture of both sides of the proxy. Must be called before Run.
+func (p *Proxy) SetCapture(c *Capture) {
+	p.capture = c
+}
+
+// SetDiagnose enables diagnose mode: parameters inferred from dropped inbound
+// traffic are logged every 30 seconds while drops keep arriving.
+func (p *Proxy) SetDiagnose(on bool) {
+	p.diagnose = on
+}
+
+// SetPathMTUDiscovery enables path MTU discovery on the remote socket: packets
+// are sent with the don't-fragment bit, and those exceeding the path MTU are
+// counted and logged instead of being fragmented. Linux only. Must be called
+// before Run.
+func (p *Proxy) SetPathMTUDiscovery(on bool) {
+	p.pmtu = on
+}
+
+// SetOffload enables UDP segmentation offload in the batch loops: UDP_GRO
+// on the receiving sockets and UDP_SEGMENT (GSO) on sends, each only where
+// the kernel supports it. Linux only. Must be called before Run.
+func (p *Proxy) SetOffload(on bool) {
+	p.offload = on
+}
+
+// prepareRemote applies the socket options to a newly dialed remote connection.
+func (p *Proxy) prepareRemote(conn *net.UDPConn) {
+	if !p.pmtu {
+		return
+	}
+	if err := setPMTUDiscover(conn); err != nil {
+		p.logError("path MTU discovery: ", err.Error())
+	}
+}
+
+// remoteWriteErr logs a failed write to the remote; packets rejected for
+// exceeding the path MTU are counted and logged with a suggested MTU.
+func (p *Proxy) remoteWriteErr(conn *net.UDPConn, err error, pkts int) {
+	if isMsgSizeErr(err) {
+		p.stats.tooBig.Add(uint64(pkts))
+		p.logError(oversizeHint(conn, p.cfg))
+		return
+	}
+	p.logError("remote write: ", err.Error())
+}
+
+// recordDrop feeds a packet rejected by TransformInbound to the diagnostics
+// and logs a parameter-mismatch hint when one becomes apparent. Outside
+// diagnose mode only diagBudget drops per check interval are recorded, so a
+// flood of junk costs an atomic add per packet; that is enough for the hints.
+func (p *Proxy) recordDrop(pkt []byte) {
+	if !p.diagnose && p.diagBudget.Add(1) > diagBudget {
+		return
+	}
+	if hint := p.diag.record(pkt, p.paramConfig(), p.stats.lastHandshake.Load() != 0); hint != "" {
+		p.logInfo("diag: ", hint)
+	}
+}
+
+// captureClientSide records a WireGuard-form packet exchanged with the client.
+func (p *Proxy) captureClientSide(dir uint32, client netip.AddrPort, pkt []byte, comment string) {
+	local := p.listenAddr.AddrPort()
+	if dir == captureIn {
+		p.capture.record(captureClient, dir, client, local, pkt, comment)
+	} else {
+		p.capture.record(captureClient, dir, local, client, pkt, comment)
+	}
+}
+
+// captureServerSide records an AmneziaWG-form packet exchanged with the server over conn.
+func (p *Proxy) captureServerSide(dir uint32, conn *net.UDPConn, pkt []byte, comment string) {
+	var local netip.AddrPort
+	if conn != nil {
+		if la, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			local = la.AddrPort()
+		}
+	}
+	remote := p.remoteAddr.AddrPort()
+	if dir == captureIn {
+		p.capture.record(captureServer, dir, remote, local, pkt, comment)
+	} else {
+		p.capture.record(captureServer, dir, local, remote, pkt, comment)
+	}
+}
+
+// fillJunk fills caller-owned junk buffers (random data or JunkTemplate) and
+// returns slices of random sizes in [Jmin, Jmax], as adjusted by the template:
+// buf holds Jc*junkMax() bytes and pkts Jc slice headers. Zero allocations
+// per call.
+func fillJunk(cfg *Config, buf []byte, pkts [][]byte) [][]byte {
+	if cfg.Jc <= 0 || cfg.Jmax <= 0 {
 		return nil
 	}
-	jmin := p.cfg.Jmin
+	jmin := cfg.Jmin
 	if jmin <= 0 {
 		jmin = 1
 	}
-	jmax := p.cfg.Jmax
+	jmax := cfg.Jmax
 	if jmax < jmin {
 		jmax = jmin
 	}
-	randFill(p.junkBuf)
 	off := 0
-	for i := 0; i < p.cfg.Jc; i++ {
+	for i := 0; i < cfg.Jc; i++ {
 		size := jmin
 		if jmax > jmin {
 			size = jmin + rand.IntN(jmax-jmin+1)
 		}
-		p.junkPkts[i] = p.junkBuf[off : off+size]
+		size = cfg.JunkTemplate.packetSize(size, jmin, jmax)
+		pkts[i] = buf[off : off+size]
 		off += size
 	}
-	return p.junkPkts[:p.cfg.Jc]
+	fillJunkPackets(cfg.JunkTemplate, pkts[:cfg.Jc])
+	return pkts[:cfg.Jc]
 }
 
 func setSocketBuffers(conn *net.UDPConn, size int) {
@@ -84,7 +195,7 @@ func setSocketBuffers(conn *net.UDPConn, size int) {
 func setSocketBuffersLog(conn *net.UDPConn, size int, cfg *Config, label string) {
 	conn.SetReadBuffer(size)
 	conn.SetWriteBuffer(size)
-	if cfg.LogLevel >= LevelDebug {
+	if cfg.logLevel() >= LevelDebug {
 		actualR, actualW := getSocketBufSizes(conn)
 		LogDebug(cfg, label, " socket buf: requested=", strconv.Itoa(size/1024), "KB, actual read=", strconv.Itoa(actualR/1024), "KB write=", strconv.Itoa(actualW/1024), "KB")
 	}
@@ -93,19 +204,48 @@ func setSocketBuffersLog(conn *net.UDPConn, size int, cfg *Config, label string)
 // Run starts the proxy and blocks until stop is called or a fatal error occurs.
 // The stop channel is closed to signal shutdown.
 func (p *Proxy) Run(stop <-chan struct{}) error {
-	listenConn, err := net.ListenUDP("udp4", p.listenAddr)
+	listenConns, err := p.listen()
 	if err != nil {
 		return err
 	}
-	defer listenConn.Close()
-	setSocketBuffersLog(listenConn, SocketBufSize, p.cfg, "listen")
+	remoteConns := make([]*net.UDPConn, 0, len(listenConns))
+	for _, listenConn := range listenConns {
+		setSocketBuffersLog(listenConn, SocketBufSize, p.cfg, "listen")
+		remoteConn, err := net.DialUDP("udp4", nil, p.remoteAddr)
+		if err != nil {
+			for _, c := range listenConns {
+				c.Close()
+			}
+			for _, c := range remoteConns {
+				c.Close()
+			}
+			return err
+		}
+		setSocketBuffersLog(remoteConn, SocketBufSize, p.cfg, "remote")
+		p.prepareRemote(remoteConn)
+		remoteConns = append(remoteConns, remoteConn)
+	}
+	p.started.Store(time.Now().UnixNano())
 
-	remoteConn, err := net.DialUDP("udp4", nil, p.remoteAddr)
-	if err != nil {
-		return err
+	lanes := p.startLanes(len(listenConns) - 1)
+	var wg sync.WaitGroup
+	for i, lane := range lanes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lane.serve(listenConns[i+1], remoteConns[i+1], stop)
+		}()
 	}
-	setSocketBuffersLog(remoteConn, SocketBufSize, p.cfg, "remote")
+	p.serve(listenConns[0], remoteConns[0], stop)
+	wg.Wait()
+	p.flushLogs()
+	return nil
+}
 
+// serve runs the loops of one worker on listenConn and remoteConn until stop
+// is closed: the proxy itself, or one of its lanes (see SetWorkers).
+func (p *Proxy) serve(listenConn, remoteConn *net.UDPConn, stop <-chan struct{}) {
+	defer listenConn.Close()
 	p.remoteConn.Store(remoteConn)
 	p.lastActive.Store(true)
 
@@ -138,17 +278,31 @@ func (p *Proxy) Run(stop <-chan struct{}) error {
 			checksNeeded = 1
 		}
 		inactiveCount := 0
+		ticks := 0
+		var reportedDrops uint64
 		for {
 			select {
 			case <-stop:
 				return
 			case <-ticker.C:
-				if p.lastActive.CompareAndSwap(true, false) {
+				ticks++
+				p.diagBudget.Store(0)
+				if p.parent == nil {
+					p.flushLogs()
+				}
+				if p.diagnose && ticks%6 == 0 {
+					if drops := p.statsTotal().dropsIn.Load(); drops != reportedDrops {
+						reportedDrops = drops
+						p.logInfo("diagnose:\n", p.diag.Report(p.paramConfig()))
+					}
+				}
+				if p.lastActive.CompareAndSwap(true, false) || (p.parent != nil && p.clientAddr.Load() == nil) {
+					// Lanes without a client keep their socket as it is.
 					inactiveCount = 0
 				} else {
 					inactiveCount++
 					if inactiveCount >= checksNeeded {
-						LogInfo(p.cfg, "remote timeout, triggering reconnect")
+						p.logInfo("remote timeout, triggering reconnect")
 						if rc := p.remoteConn.Load(); rc != nil {
 							rc.Close()
 						}
@@ -159,11 +313,42 @@ func (p *Proxy) Run(stop <-chan struct{}) error {
 		}
 	}()
 
+	if p.pacing.enabled() {
+		p.hsQueue = make(chan handshakeJob, hsQueueLen)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.handshakeEmitter(stop)
+		}()
+	}
+
+	p.idleMu.Lock()
+	p.runStop = stop
+	p.idleMu.Unlock()
+	p.startIdle(p.transformer())
+
+	if p.statsInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(p.statsInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+					p.LogStats()
+				}
+			}
+		}()
+	}
+
 	useBatch := batchAvailable()
-	if useBatch {
-		LogDebug(p.cfg, "batch I/O: enabled (recvmmsg/sendmmsg)")
-	} else {
-		LogDebug(p.cfg, "batch I/O: unavailable, using single-packet mode")
+	if p.parent == nil {
+		if useBatch {
+			LogDebug(p.cfg, "batch I/O: enabled (recvmmsg/sendmmsg)")
+		} else {
+			LogDebug(p.cfg, "batch I/O: unavailable, using single-packet mode")
+		}
 	}
 
 	go func() {
@@ -188,21 +373,21 @@ func (p *Proxy) Run(stop <-chan struct{}) error {
 	if rc := p.remoteConn.Load(); rc != nil {
 		rc.Close()
 	}
-	return nil
 }
 
 func (p *Proxy) clientToServer(listenConn *net.UDPConn) {
 	runtime.LockOSThread()
 	prefix := p.cfg.S4
-	buf := make([]byte, prefix+bufSize)
+	size := p.cfg.packetBufSize()
+	buf := make([]byte, prefix+size)
 
 	for {
-		n, addr, err := listenConn.ReadFromUDPAddrPort(buf[prefix : prefix+bufSize])
+		n, addr, err := listenConn.ReadFromUDPAddrPort(buf[prefix : prefix+size])
 		if err != nil {
 			if p.stopped.Load() || isClosedErr(err) {
 				return
 			}
-			LogError(p.cfg, "listen read: ", err.Error())
+			p.logError("listen read: ", err.Error())
 			continue
 		}
 		p.lastActive.Store(true)
@@ -211,41 +396,63 @@ func (p *Proxy) clientToServer(listenConn *net.UDPConn) {
 		if cur := p.clientAddr.Load(); cur == nil || *cur != addr {
 			a := addr
 			p.clientAddr.Store(&a)
-			LogInfo(p.cfg, "client: ", addr.String())
+			p.logInfo("client: ", addr.String())
+		}
+
+		if p.capture != nil {
+			p.captureClientSide(captureIn, addr, buf[prefix:prefix+n], "")
 		}
 
 		currentRemote := p.remoteConn.Load()
-		out, sendJunk := TransformOutbound(buf, prefix, n, p.cfg)
+		wg := buf[prefix : prefix+n]
+		p.filterOutbound(wg)
+		tr := p.transformer()
+		out, sendJunk := tr.Outbound(buf, prefix, n)
 
-		if p.cfg.LogLevel >= LevelDebug {
+		if p.cfg.logLevel() >= LevelDebug {
 			LogDebug(p.cfg, "c->s: recv ", strconv.Itoa(n), "B, send ", strconv.Itoa(len(out)), "B, junk=", strconv.FormatBool(sendJunk))
 		}
 
+		var cps bool
+		var jc int
+		if sendJunk {
+			cps, jc = p.preamble(wg)
+		}
+		if sendJunk && p.hsQueue != nil {
+			p.queueHandshake(currentRemote, out, cps, jc)
+			continue
+		}
 		if sendJunk {
 			LogDebug(p.cfg, "c->s: handshake init ", strconv.Itoa(n), "B -> ", strconv.Itoa(len(out)), "B")
-			// CPS packets (I1->I2->I3->I4->I5).
-			cpsPackets := GenerateCPSPackets(p.cfg.CPS, &p.cpsCounter)
+			// CPS packets (I1->I2->I3->I4->I5) and junk packets (zero-alloc, pre-allocated buffers).
+			cpsPackets, junkPackets := tr.Prelude(cps, jc)
 			for ci, pkt := range cpsPackets {
 				if _, err := currentRemote.Write(pkt); err != nil {
-					if p.cfg.LogLevel >= LevelDebug {
+					if p.cfg.logLevel() >= LevelDebug {
 						LogDebug(p.cfg, "c->s: cps ", strconv.Itoa(ci), " write err: ", err.Error())
 					}
 					break
 				}
-				if p.cfg.LogLevel >= LevelDebug {
+				p.stats.cpsSent.Add(1)
+				if p.capture != nil {
+					p.captureServerSide(captureOut, currentRemote, pkt, "cps "+strconv.Itoa(ci+1))
+				}
+				if p.cfg.logLevel() >= LevelDebug {
 					LogDebug(p.cfg, "c->s: cps ", strconv.Itoa(ci+1), "/", strconv.Itoa(len(cpsPackets)), " ", strconv.Itoa(len(pkt)), "B sent")
 				}
 			}
-			// Junk packets (zero-alloc, pre-allocated buffers).
-			junkPackets := p.generateJunk()
 			for i, junk := range junkPackets {
 				if _, err := currentRemote.Write(junk); err != nil {
-					if p.cfg.LogLevel >= LevelDebug {
+					if p.cfg.logLevel() >= LevelDebug {
 						LogDebug(p.cfg, "c->s: junk ", strconv.Itoa(i), " write err: ", err.Error())
 					}
 					break // connection likely closed during reconnect
 				}
-				if p.cfg.LogLevel >= LevelDebug {
+				p.stats.junkSent.Add(1)
+				if p.capture != nil {
+					p.captureServerSide(captureOut, currentRemote, junk, "junk")
+				}
+				if p.cfg.logLevel() >= LevelDebug {
 					LogDebug(p.cfg, "c->s: junk ", strconv.Itoa(i+1), "/", strconv.Itoa(len(junkPackets)), " ", strconv.Itoa(len(junk)), "B sent")
 				}
 			}
@@ -256,8 +463,15 @@ func (p *Proxy) clientToServer(listenConn *net.UDPConn) {
 			if isClosedErr(err) {
 				continue // reconnect in progress, WG will retransmit
 			}
-			LogError(p.cfg, "remote write: ", err.Error())
-		} else if p.cfg.LogLevel >= LevelDebug {
+			p.remoteWriteErr(currentRemote, err, 1)
+			continue
+		}
+		p.stats.pktsOut.Add(1)
+		p.stats.bytesOut.Add(uint64(len(out)))
+		if p.capture != nil {
+			p.captureServerSide(captureOut, currentRemote, out, "")
+		}
+		if p.cfg.logLevel() >= LevelDebug {
 			LogDebug(p.cfg, "c->s: transformed ", strconv.Itoa(len(out)), "B sent to server")
 		}
 	}
@@ -265,10 +479,11 @@ func (p *Proxy) clientToServer(listenConn *net.UDPConn) {
 
 func (p *Proxy) serverToClient(listenConn *net.UDPConn, remoteConn *net.UDPConn, stop <-chan struct{}) {
 	runtime.LockOSThread()
-	buf := make([]byte, bufSize)
+	buf := make([]byte, p.cfg.packetBufSize())
 	currentRemote := remoteConn
 	backoff := time.Second
 	var pktCount uint8 = 255
+	var capRaw []byte // pre-transform copy for capture (TransformInbound works in place)
 
 	for {
 		n, err := currentRemote.Read(buf)
@@ -276,13 +491,14 @@ func (p *Proxy) serverToClient(listenConn *net.UDPConn, remoteConn *net.UDPConn,
 			if p.stopped.Load() {
 				return
 			}
-			LogInfo(p.cfg, "remote: ", err.Error(), ", reconnecting")
+			p.logInfo("remote: ", err.Error(), ", reconnecting")
 			newConn := p.reconnectRemote(stop, &backoff)
 			if newConn == nil {
 				return // shutdown
 			}
 			currentRemote.Close()
 			currentRemote = newConn
+			p.stats.reconnects.Add(1)
 			p.remoteConn.Store(newConn)
 			setSocketBuffers(newConn, SocketBufSize)
 			p.lastActive.Store(true)
@@ -301,42 +517,84 @@ func (p *Proxy) serverToClient(listenConn *net.UDPConn, remoteConn *net.UDPConn,
 		}
 		backoff = time.Second // reset backoff on success
 
-		if p.cfg.LogLevel >= LevelDebug {
+		if p.cfg.logLevel() >= LevelDebug {
 			LogDebug(p.cfg, "s->c: recv ", strconv.Itoa(n), "B from server")
 		}
 
-		out, valid := TransformInbound(buf, n, p.cfg)
+		if p.capture != nil {
+			capRaw = append(capRaw[:0], buf[:n]...)
+		}
+
+		out, valid := p.transformer().Inbound(buf, n)
 		if !valid {
-			if p.cfg.LogLevel >= LevelDebug {
+			p.stats.dropsIn.Add(1)
+			p.recordDrop(buf[:n])
+			if p.capture != nil {
+				p.captureServerSide(captureIn, currentRemote, capRaw, "dropped")
+			}
+			if p.cfg.logLevel() >= LevelDebug {
 				LogDebug(p.cfg, "s->c: invalid/junk packet ", strconv.Itoa(n), "B, dropped")
 			}
 			continue
 		}
+		if p.capture != nil {
+			p.captureServerSide(captureIn, currentRemote, capRaw, "")
+		}
+		if !p.filterInbound(out) {
+			continue
+		}
 
 		hsIn := len(out) >= 4 && out[0] != byte(wgTransportData)
+		if hsIn && out[0] == byte(wgHandshakeResponse) {
+			p.stats.lastHandshake.Store(time.Now().UnixNano())
+		}
 
-		if p.cfg.LogLevel >= LevelDebug {
+		if p.cfg.logLevel() >= LevelDebug {
 			LogDebug(p.cfg, "s->c: transformed ", strconv.Itoa(len(out)), "B, valid=true")
 		}
 
 		clientAddr := p.clientAddr.Load()
 		if clientAddr != nil {
 			_, err = listenConn.WriteToUDPAddrPort(out, *clientAddr)
+			if err == nil {
+				p.stats.pktsIn.Add(1)
+				p.stats.bytesIn.Add(uint64(len(out)))
+				if p.capture != nil {
+					p.captureClientSide(captureOut, *clientAddr, out, "")
+				}
+			}
 			if err != nil {
-				LogError(p.cfg, "listen write: ", err.Error())
-			} else if hsIn && p.cfg.LogLevel >= LevelDebug {
+				p.logError("listen write: ", err.Error())
+			} else if hsIn && p.cfg.logLevel() >= LevelDebug {
 				LogDebug(p.cfg, "s->c: handshake ", strconv.Itoa(n), "B -> ", strconv.Itoa(len(out)), "B, forwarded to ", clientAddr.String())
-			} else if p.cfg.LogLevel >= LevelDebug {
+			} else if p.cfg.logLevel() >= LevelDebug {
 				LogDebug(p.cfg, "s->c: sent ", strconv.Itoa(len(out)), "B to ", clientAddr.String())
 			}
 		} else if hsIn {
-			LogInfo(p.cfg, "s->c: handshake ", strconv.Itoa(n), "B -> ", strconv.Itoa(len(out)), "B, no client addr!")
-		} else if p.cfg.LogLevel >= LevelDebug {
+			p.logInfo("s->c: handshake ", strconv.Itoa(n), "B -> ", strconv.Itoa(len(out)), "B, no client addr!")
+		} else if p.cfg.logLevel() >= LevelDebug {
 			LogDebug(p.cfg, "s->c: no client addr, packet dropped")
 		}
 	}
 }
 
+// forceReconnect closes the current remote connections of the workers; the
+// server->client loops notice the error and redial (re-resolving the remote
+// address). Returns the closed connection of the proxy itself, or nil if the
+// proxy is not running.
+func (p *Proxy) forceReconnect() *net.UDPConn {
+	for _, lane := range p.allWorkers()[1:] {
+		if rc := lane.remoteConn.Load(); rc != nil {
+			rc.Close()
+		}
+	}
+	rc := p.remoteConn.Load()
+	if rc != nil {
+		rc.Close()
+	}
+	return rc
+}
+
 // reconnectRemote attempts to reconnect to the remote AWG server with exponential backoff.
 func (p *Proxy) reconnectRemote(stop <-chan struct{}, backoff *time.Duration) *net.UDPConn {
 	const maxBackoff = 30 * time.Second
@@ -348,21 +606,23 @@ func (p *Proxy) reconnectRemote(stop <-chan struct{}, backoff *time.Duration) *n
 		default:
 		}
 
-		LogInfo(p.cfg, "reconnecting to ", p.remoteAddr.String())
+		p.logInfo("reconnecting to ", p.remoteAddr.String())
 
 		// Re-resolve the address (handles DNS changes).
 		addr, err := net.ResolveUDPAddr("udp4", p.remoteAddr.String())
 		if err != nil {
-			LogError(p.cfg, "resolve: ", err.Error())
+			p.logError("resolve: ", err.Error())
 		} else {
 			conn, err := net.DialUDP("udp4", nil, addr)
 			if err == nil {
-				LogInfo(p.cfg, "reconnected to ", addr.String())
+				p.prepareRemote(conn)
+				p.logInfo("reconnected to ", addr.String())
+				p.transformer().Reset()
 				p.lastActive.Store(true)
 				*backoff = time.Second
 				return conn
 			}
-			LogError(p.cfg, "dial: ", err.Error())
+			p.logError("dial: ", err.Error())
 		}
 
 		// Wait with backoff.
@@ -404,21 +664,21 @@ func isClosedErrString(err error) bool {
 // Logging helpers — write directly to stdout, no fmt/log dependency.
 
 func LogInfo(cfg *Config, parts ...string) {
-	if cfg.LogLevel < LevelInfo {
+	if cfg.logLevel() < LevelInfo {
 		return
 	}
 	writeLog("INFO: ", parts)
 }
 
 func LogError(cfg *Config, parts ...string) {
-	if cfg.LogLevel < LevelError {
+	if cfg.logLevel() < LevelError {
 		return
 	}
 	writeLog("ERROR: ", parts)
 }
 
 func LogDebug(cfg *Config, parts ...string) {
-	if cfg.LogLevel < LevelDebug {
+	if cfg.logLevel() < LevelDebug {
 		return
 	}
 	writeLog("DEBUG: ", parts)
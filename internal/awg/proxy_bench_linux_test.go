@@ -0,0 +1,77 @@
+//go:build linux
+
+package awg
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// --- UDP offload ---
+
+// BenchmarkProxyThroughputOffload sends bursts of equal-size transport
+// packets as UDP_SEGMENT sends, as a NIC with GRO would deliver them, through
+// the proxy with the mmsg path and with GSO/GRO. pkt/s counts the packets
+// the proxy forwarded; the rest were dropped by full socket buffers.
+func BenchmarkProxyThroughputOffload(b *testing.B) {
+	skipWithoutOffload(b)
+	const burst = 32
+	for _, size := range []int{500, 1400} {
+		for _, offload := range []bool{false, true} {
+			name := strconv.Itoa(size) + "/mmsg"
+			if offload {
+				name = strconv.Itoa(size) + "/gso"
+			}
+			b.Run(name, func(b *testing.B) {
+				cfg := benchConfig()
+				cfg.S4 = 16
+				cfg.ComputeFastPath()
+
+				sink := startBenchMockServer(b)
+				defer sink.Close()
+				go func() {
+					buf := make([]byte, gsoBufSize)
+					for {
+						if _, err := sink.Read(buf); err != nil {
+							return
+						}
+					}
+				}()
+
+				var proxy *Proxy
+				proxyAddr, stopProxy := startBenchProxySetup(b, cfg, sink.LocalAddr().(*net.UDPAddr), func(p *Proxy) {
+					p.SetOffload(offload)
+					proxy = p
+				})
+				defer stopProxy()
+
+				client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+				if err != nil {
+					b.Fatal("listen: ", err)
+				}
+				defer client.Close()
+
+				pkts := make([][]byte, burst)
+				for i := range pkts {
+					pkts[i] = makeTransportPacket(size)
+				}
+				b.SetBytes(int64(size * burst))
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					if err := writeGSO(client, proxyAddr, pkts); err != nil {
+						b.Fatal("write: ", err)
+					}
+				}
+
+				b.StopTimer()
+				time.Sleep(50 * time.Millisecond)
+				if elapsed := b.Elapsed(); elapsed > 0 {
+					b.ReportMetric(float64(proxy.stats.pktsOut.Load())/elapsed.Seconds(), "pkt/s")
+				}
+			})
+		}
+	}
+}
@@ -35,6 +35,12 @@ func benchConfig() *Config {
 // and a cleanup function. Uses the same bind-discover-close-rebind pattern.
 func startBenchProxy(b *testing.B, cfg *Config, remoteAddr *net.UDPAddr) (*net.UDPAddr, func()) {
 	b.Helper()
+	return startBenchProxySetup(b, cfg, remoteAddr, nil)
+}
+
+// startBenchProxySetup is startBenchProxy with setup applied to the proxy before Run.
+func startBenchProxySetup(b *testing.B, cfg *Config, remoteAddr *net.UDPAddr, setup func(*Proxy)) (*net.UDPAddr, func()) {
+	b.Helper()
 
 	listenAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
 	if err != nil {
@@ -52,6 +58,9 @@ func startBenchProxy(b *testing.B, cfg *Config, remoteAddr *net.UDPAddr) (*net.U
 	time.Sleep(10 * time.Millisecond)
 
 	proxy := NewProxy(cfg, proxyAddr, remoteAddr)
+	if setup != nil {
+		setup(proxy)
+	}
 	stop := make(chan struct{})
 	done := make(chan struct{})
 
@@ -500,6 +509,31 @@ func BenchmarkProxyHandshakeBurst(b *testing.B) {
 	}
 }
 
+// benchConfigCPS returns benchConfig with CPS templates, including computed
+// fields, and a preset.
+func benchConfigCPS(tb testing.TB) *Config {
+	cfg := benchConfig()
+	for i, s := range []string{"<b 0xc0ffee><c be 2><t be ms 8><r 32>", "<b 0x0001><l><ms><r 40><crc32><me>", "@preset:dtls-hello"} {
+		tmpl, err := ParseCPSValue(s)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		cfg.CPS[i] = tmpl
+	}
+	return cfg
+}
+
+// BenchmarkHandshakePrelude measures generating the CPS and junk packets
+// sent before each handshake init; it must not allocate.
+func BenchmarkHandshakePrelude(b *testing.B) {
+	tr := NewAmneziaTransformer(benchConfigCPS(b))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.Prelude(true, 4)
+	}
+}
+
 // benchConfigMAC1 returns a config with synthetic MAC1 keys for benchmarking.
 func benchConfigMAC1() *Config {
 	cfg := benchConfig()
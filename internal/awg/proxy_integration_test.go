@@ -247,10 +247,17 @@ func TestProxyBidirectionalFlow(t *testing.T) {
 }
 
 // TestProxyTransportEchoRoundtrip verifies transport data survives a full
-// roundtrip through the proxy via an echo mock server.
+// roundtrip through the proxy via an echo mock server, with each transformer.
 func TestProxyTransportEchoRoundtrip(t *testing.T) {
 	cfg := proxyTestConfig()
+	for _, tc := range testTransformers(cfg) {
+		t.Run(tc.name, func(t *testing.T) {
+			testTransportEchoRoundtrip(t, cfg, tc.tr)
+		})
+	}
+}
 
+func testTransportEchoRoundtrip(t *testing.T, cfg *Config, tr Transformer) {
 	mockServer := startMockServer(t)
 	defer mockServer.Close()
 	mockAddr := mockServer.LocalAddr().(*net.UDPAddr)
@@ -267,7 +274,9 @@ func TestProxyTransportEchoRoundtrip(t *testing.T) {
 		}
 	}()
 
-	proxyAddr, stopProxy := startProxy(t, cfg, mockAddr)
+	_, proxyAddr, stopProxy := startProxySetup(t, cfg, mockAddr, func(p *Proxy) {
+		p.SetTransformer(tr)
+	})
 	defer stopProxy()
 
 	clientConn, err := net.DialUDP("udp", nil, proxyAddr)
@@ -1074,3 +1083,181 @@ func TestProxyMixedTraffic(t *testing.T) {
 
 	t.Logf("mixed traffic: all %d packets transformed correctly", len(specs))
 }
+
+// TestProxyServerInitiatedHandshake simulates a rekey started by the server:
+// the AmneziaWG init arrives inbound and must reach the client with a MAC1
+// valid for the client's key, and the client's response must leave with a
+// MAC1 valid for the server's key over the obfuscated form.
+func TestProxyServerInitiatedHandshake(t *testing.T) {
+	cfg := reverseTestConfig()
+
+	mockServer := startMockServer(t)
+	defer mockServer.Close()
+	proxyAddr, stopProxy := startProxy(t, cfg, mockServer.LocalAddr().(*net.UDPAddr))
+	defer stopProxy()
+
+	clientConn, err := net.DialUDP("udp", nil, proxyAddr)
+	if err != nil {
+		t.Fatal("dial: ", err)
+	}
+	defer clientConn.Close()
+
+	// The client has talked to the server before, so the proxy knows both ends.
+	from := establishSession(t, cfg, clientConn, mockServer)
+
+	// Server sends an init in AWG form, signed over the AWG-form message.
+	init := makeWGPacket(cfg.H1.Min, WgHandshakeInitSize)
+	recomputeMAC1(init, computeMAC1Key(reverseClientPub))
+	mockServer.WriteToUDP(append(make([]byte, cfg.S1), init...), from)
+
+	pkts := readPackets(clientConn, 2*time.Second, 1)
+	if len(pkts) != 1 || len(pkts[0]) != WgHandshakeInitSize {
+		t.Fatal("client did not get the init")
+	}
+	if got := binary.LittleEndian.Uint32(pkts[0][:4]); got != wgHandshakeInit {
+		t.Fatalf("init type = %d, want %d", got, wgHandshakeInit)
+	}
+	if !verifyMAC1(pkts[0], 116, computeMAC1Key(reverseClientPub)) {
+		t.Fatal("init MAC1 not valid for the client key")
+	}
+
+	// Client answers with a WireGuard response signed for the server.
+	clientConn.Write(signedWGPacket(wgHandshakeResponse, reverseServerPub))
+
+	pkts = readPackets(mockServer, 2*time.Second, 1)
+	if len(pkts) != 1 || len(pkts[0]) != cfg.respTotal {
+		t.Fatal("server did not get the response")
+	}
+	resp := pkts[0][cfg.S2:]
+	if got := binary.LittleEndian.Uint32(resp[:4]); !cfg.H2.Contains(got) {
+		t.Fatalf("response type %d not in H2 [%d,%d]", got, cfg.H2.Min, cfg.H2.Max)
+	}
+	if !verifyMAC1(resp, 60, computeMAC1Key(reverseServerPub)) {
+		t.Fatal("response MAC1 not valid for the server key")
+	}
+}
+
+// timedPacket is a packet received by readTimedPackets.
+type timedPacket struct {
+	data []byte
+	at   time.Time
+}
+
+func readTimedPackets(conn *net.UDPConn, deadline time.Duration, maxPackets int) []timedPacket {
+	var pkts []timedPacket
+	conn.SetReadDeadline(time.Now().Add(deadline))
+	buf := make([]byte, 65535)
+	for len(pkts) < maxPackets {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		pkts = append(pkts, timedPacket{append([]byte(nil), buf[:n]...), time.Now()})
+	}
+	return pkts
+}
+
+func pacingTestConfig(t *testing.T) *Config {
+	cfg := proxyTestConfig()
+	cfg.Jc, cfg.Jmin, cfg.Jmax = 3, 60, 60 // junk is 60B, distinct from everything else
+	for i, s := range []string{"<b 0xaa><r 9>", "<b 0xbb><r 19>"} {
+		tmpl, err := ParseCPSTemplate(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.CPS[i] = tmpl
+	}
+	return cfg
+}
+
+// checkBurst asserts that pkts hold one handshake burst in order:
+// I1, I2, Jc junk packets and the init.
+func checkBurst(t *testing.T, cfg *Config, pkts []timedPacket) {
+	t.Helper()
+	want := []int{10, 20}
+	for i := 0; i < cfg.Jc; i++ {
+		want = append(want, cfg.Jmax)
+	}
+	want = append(want, cfg.initTotal)
+	if len(pkts) != len(want) {
+		t.Fatalf("burst of %d packets, want %d", len(pkts), len(want))
+	}
+	for i, w := range want {
+		if len(pkts[i].data) != w {
+			t.Fatalf("packet %d: %dB, want %dB", i, len(pkts[i].data), w)
+		}
+	}
+	if pkts[0].data[0] != 0xaa || pkts[1].data[0] != 0xbb {
+		t.Fatal("CPS packets out of order")
+	}
+	if h := binary.LittleEndian.Uint32(pkts[len(pkts)-1].data[cfg.S1:]); !cfg.H1.Contains(h) {
+		t.Fatalf("last packet type %d is not H1", h)
+	}
+}
+
+// TestProxyPacedHandshake checks that with pacing the burst keeps its order
+// (CPS, junk, init), the gaps are respected, and transport data is not held
+// back behind a paced init.
+func TestProxyPacedHandshake(t *testing.T) {
+	cfg := pacingTestConfig(t)
+	pacing := Pacing{Gap: 20 * time.Millisecond, Jitter: 10 * time.Millisecond, InitDelay: 50 * time.Millisecond}
+
+	server := startMockServer(t)
+	defer server.Close()
+	_, proxyAddr, stop := startProxySetup(t, cfg, server.LocalAddr().(*net.UDPAddr), func(p *Proxy) {
+		p.SetPacing(pacing)
+	})
+	defer stop()
+	client := dialUDP(t, proxyAddr)
+	defer client.Close()
+
+	client.Write(makeWGPacket(wgHandshakeInit, WgHandshakeInitSize))
+	client.Write(makeWGPacket(wgTransportData, 100))
+
+	pkts := readTimedPackets(server, 2*time.Second, 7)
+	if len(pkts) == 0 || len(pkts[0].data) != 100 {
+		t.Fatal("transport packet did not overtake the paced init")
+	}
+	burst := pkts[1:]
+	checkBurst(t, cfg, burst)
+
+	for i := 1; i < len(burst)-1; i++ {
+		if gap := burst[i].at.Sub(burst[i-1].at); gap < pacing.Gap-2*time.Millisecond {
+			t.Fatalf("gap before packet %d is %v, want >= %v", i, gap, pacing.Gap)
+		}
+	}
+	last := len(burst) - 1
+	if gap := burst[last].at.Sub(burst[last-1].at); gap < pacing.Gap+pacing.InitDelay-2*time.Millisecond {
+		t.Fatalf("init followed the last junk packet after %v, want >= %v", gap, pacing.Gap+pacing.InitDelay)
+	}
+}
+
+// TestProxyPacedHandshakeQueue sends two inits back to back: each must get
+// its own complete burst, in order.
+func TestProxyPacedHandshakeQueue(t *testing.T) {
+	cfg := pacingTestConfig(t)
+	server := startMockServer(t)
+	defer server.Close()
+	_, proxyAddr, stop := startProxySetup(t, cfg, server.LocalAddr().(*net.UDPAddr), func(p *Proxy) {
+		p.SetPacing(Pacing{Gap: 5 * time.Millisecond})
+	})
+	defer stop()
+	client := dialUDP(t, proxyAddr)
+	defer client.Close()
+
+	first := makeWGPacket(wgHandshakeInit, WgHandshakeInitSize)
+	second := makeWGPacket(wgHandshakeInit, WgHandshakeInitSize)
+	second[8] ^= 0xff
+	client.Write(first)
+	client.Write(second)
+
+	pkts := readTimedPackets(server, 2*time.Second, 12)
+	if len(pkts) != 12 {
+		t.Fatalf("got %d packets, want two bursts of 6", len(pkts))
+	}
+	checkBurst(t, cfg, pkts[:6])
+	checkBurst(t, cfg, pkts[6:])
+	if pkts[5].data[cfg.S1+8] != first[8] || pkts[11].data[cfg.S1+8] != second[8] {
+		t.Fatal("inits emitted out of order")
+	}
+}
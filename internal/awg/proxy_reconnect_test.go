@@ -12,6 +12,13 @@ import (
 // startProxyWithHandle is like startProxy but also returns the *Proxy so tests
 // can inspect and manipulate internal state (remoteConn, clientAddr, etc.).
 func startProxyWithHandle(t *testing.T, cfg *Config, remoteAddr *net.UDPAddr) (*Proxy, *net.UDPAddr, func()) {
+	t.Helper()
+	return startProxySetup(t, cfg, remoteAddr, nil)
+}
+
+// startProxySetup is like startProxyWithHandle but calls setup (if non-nil)
+// on the new Proxy before Run, for options that must be set up front.
+func startProxySetup(t *testing.T, cfg *Config, remoteAddr *net.UDPAddr, setup func(*Proxy)) (*Proxy, *net.UDPAddr, func()) {
 	t.Helper()
 	listenAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
 	if err != nil {
@@ -27,6 +34,9 @@ func startProxyWithHandle(t *testing.T, cfg *Config, remoteAddr *net.UDPAddr) (*
 	time.Sleep(10 * time.Millisecond)
 
 	proxy := NewProxy(cfg, proxyAddr, remoteAddr)
+	if setup != nil {
+		setup(proxy)
+	}
 	stop := make(chan struct{})
 	done := make(chan struct{})
 
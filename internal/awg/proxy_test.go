@@ -102,7 +102,7 @@ func readPackets(conn *net.UDPConn, deadline time.Duration, maxPackets int) [][]
 	var packets [][]byte
 	conn.SetReadDeadline(time.Now().Add(deadline))
 	for i := 0; i < maxPackets; i++ {
-		buf := make([]byte, 1500)
+		buf := make([]byte, 65535)
 		n, _, err := conn.ReadFromUDP(buf)
 		if err != nil {
 			break
@@ -0,0 +1,60 @@
+package awg
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Retransmitted handshake inits.
+//
+// While the server is unreachable WireGuard repeats the init every 5 seconds
+// for up to 90 seconds, and every repeat would carry the full CPS and junk
+// burst. With a RetryPolicy only the first init of a handshake attempt gets
+// the full burst. WireGuard picks a new sender index for each repeat, so an
+// init counts as a retransmission if it repeats the previous sender index
+// (a duplicate) or follows the previous init within Window with no handshake
+// response in between.
+
+// RetryPolicy sets the decoy burst sent before retransmitted inits. The zero
+// value sends the full burst before every init.
+type RetryPolicy struct {
+	Window time.Duration // inits closer than Window to the previous one are retransmissions; 0 = disabled
+	Jc     int           // junk packets before a retransmission (capped at Config.Jc)
+	CPS    bool          // send the CPS packets before a retransmission
+}
+
+// retryState tracks the previous init; it is used by the client -> server
+// goroutine only.
+type retryState struct {
+	lastInit   int64 // unix nanos, 0 = none yet
+	lastSender uint32
+}
+
+// isRetransmit records an init with sender index sender at now and reports
+// whether it repeats the previous one. lastResp is the time of the last
+// handshake response from the server (unix nanos, 0 = never).
+func (r *retryState) isRetransmit(window time.Duration, sender uint32, now, lastResp int64) bool {
+	retry := r.lastInit != 0 && (sender == r.lastSender ||
+		now-r.lastInit < int64(window) && lastResp < r.lastInit)
+	r.lastInit, r.lastSender = now, sender
+	return retry
+}
+
+// SetRetryPolicy limits the burst before retransmitted inits. Must be called before Run.
+func (p *Proxy) SetRetryPolicy(rp RetryPolicy) {
+	p.retry = rp
+}
+
+// preamble returns whether CPS packets and how many junk packets go before
+// the handshake init msg (WireGuard form).
+func (p *Proxy) preamble(msg []byte) (cps bool, jc int) {
+	if p.retry.Window <= 0 || len(msg) < 8 {
+		return true, p.paramConfig().Jc
+	}
+	sender := binary.LittleEndian.Uint32(msg[4:8])
+	if !p.retryState.isRetransmit(p.retry.Window, sender, time.Now().UnixNano(), p.stats.lastHandshake.Load()) {
+		return true, p.paramConfig().Jc
+	}
+	p.stats.initRetries.Add(1)
+	return p.retry.CPS, min(p.retry.Jc, p.paramConfig().Jc)
+}
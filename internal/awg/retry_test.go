@@ -0,0 +1,78 @@
+package awg
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRetryStateIsRetransmit(t *testing.T) {
+	const window = 10 * time.Second
+	sec := int64(time.Second)
+	var r retryState
+
+	steps := []struct {
+		sender   uint32
+		at, resp int64
+		want     bool
+	}{
+		{1, 100 * sec, 0, false},           // first init
+		{2, 105 * sec, 0, true},            // WireGuard retry, new sender index
+		{3, 110 * sec, 0, true},            // and again: the window slides
+		{4, 111 * sec, 110*sec + 1, false}, // a response arrived: new attempt
+		{4, 200 * sec, 0, true},            // same sender index: duplicate, whatever the gap
+		{5, 300 * sec, 0, false},           // outside the window
+	}
+	for i, s := range steps {
+		if got := r.isRetransmit(window, s.sender, s.at, s.resp); got != s.want {
+			t.Fatalf("step %d: got %v, want %v", i, got, s.want)
+		}
+	}
+}
+
+// TestProxyRetryPolicy checks the burst sizes for an init, its retransmission
+// and the init of the next handshake after a response.
+func TestProxyRetryPolicy(t *testing.T) {
+	cfg := pacingTestConfig(t)
+	server := startMockServer(t)
+	defer server.Close()
+	proxy, proxyAddr, stop := startProxySetup(t, cfg, server.LocalAddr().(*net.UDPAddr), func(p *Proxy) {
+		p.SetRetryPolicy(RetryPolicy{Window: 10 * time.Second, Jc: 1})
+	})
+	defer stop()
+	client := dialUDP(t, proxyAddr)
+	defer client.Close()
+
+	var from *net.UDPAddr
+	sendInit := func(sender uint32) [][]byte {
+		t.Helper()
+		init := makeWGPacket(wgHandshakeInit, WgHandshakeInitSize)
+		binary.LittleEndian.PutUint32(init[4:8], sender)
+		client.Write(init)
+		var pkts [][]byte
+		pkts, from = readPacketsWithAddr(server, 300*time.Millisecond, 10)
+		return pkts
+	}
+
+	if pkts := sendInit(1); len(pkts) != 2+cfg.Jc+1 {
+		t.Fatalf("first init: %d packets, want the full burst", len(pkts))
+	}
+	pkts := sendInit(2)
+	if len(pkts) != 2 || len(pkts[0]) != cfg.Jmax || len(pkts[1]) != cfg.initTotal {
+		t.Fatalf("retransmission: %d packets, want one junk packet and the init", len(pkts))
+	}
+	if got := proxy.stats.initRetries.Load(); got != 1 {
+		t.Fatalf("init_retries = %d, want 1", got)
+	}
+
+	// The server answers; the next init starts a new handshake.
+	resp := makeWGPacket(cfg.H2.Min, WgHandshakeResponseSize)
+	server.WriteToUDP(append(make([]byte, cfg.S2), resp...), from)
+	if got := readPackets(client, 500*time.Millisecond, 1); len(got) != 1 {
+		t.Fatal("client did not get the response")
+	}
+	if pkts := sendInit(3); len(pkts) != 2+cfg.Jc+1 {
+		t.Fatalf("init after a response: %d packets, want the full burst", len(pkts))
+	}
+}
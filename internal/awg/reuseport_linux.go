@@ -0,0 +1,33 @@
+//go:build linux
+
+package awg
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// soReusePort is SO_REUSEPORT on amd64, arm and arm64; package syscall does
+// not define it.
+const soReusePort = 15
+
+// listenReusePort opens a UDP socket on addr with SO_REUSEPORT. The kernel
+// spreads datagrams over the sockets of one port by a hash of the source and
+// destination, so all packets of one client arrive on the same socket.
+func listenReusePort(addr *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: func(_, _ string, c syscall.RawConn) error {
+		var sysErr error
+		if err := c.Control(func(fd uintptr) {
+			sysErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		}); err != nil {
+			return err
+		}
+		return sysErr
+	}}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
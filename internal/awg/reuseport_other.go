@@ -0,0 +1,12 @@
+//go:build !linux
+
+package awg
+
+import (
+	"errors"
+	"net"
+)
+
+func listenReusePort(_ *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errors.New("listen workers are only supported on Linux")
+}
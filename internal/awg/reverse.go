@@ -0,0 +1,590 @@
+package awg
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server (reverse) and bridge modes.
+//
+// ServerProxy runs in front of a server and lets AmneziaWG clients connect to
+// it: packets arriving on the listen socket are decoded with the client-facing
+// Config (junk and CPS packets fail TransformInbound's checks and are dropped),
+// re-encoded with the server-facing Config and forwarded; replies take the
+// opposite way. In server mode the server-facing Config is plain WireGuard
+// (identity H, no padding or junk); in bridge mode it describes a second
+// AmneziaWG parameter set, so clients can be migrated between parameter sets
+// one at a time. Every client address has its own session with a dedicated
+// upstream socket, so the server sees a distinct endpoint per client.
+//
+// With SetWorkers the listen loop runs on several SO_REUSEPORT sockets. The
+// kernel assigns every client address to one of them, so the packets of a
+// client keep their order and its session is only used by one worker.
+//
+// MAC1 is keyed with the receiver's public key: messages to the server are
+// re-signed with ServerPub, messages to a client with that client's key. The
+// client key of a session is found by checking the MAC1 the server computed
+// against each of ClientPubs. Handshakes from clients are only re-signed if
+// their own MAC1 is valid for ServerPub, and only a handshake init creates a
+// session: other packets from unknown addresses are dropped, so spoofed
+// packets cannot obtain a valid MAC1 or tie up upstream sockets.
+
+const maxServerSessions = 4096
+
+type serverSession struct {
+	client     netip.AddrPort
+	conn       *net.UDPConn             // connected to the server
+	listen     *net.UDPConn             // listen socket the client's packets arrive on
+	clientKey  atomic.Pointer[[32]byte] // MAC1 key of the client, nil until identified
+	lastActive atomic.Int64             // unix nanos of the last packet in either direction
+	closed     atomic.Bool
+	toServer   junkState // used by the listen loop
+	toClient   junkState // used by the session goroutine
+
+	serverCookie *cookieState // cookie replies from the server, MAC2 towards it
+	clientCookie *cookieState // cookie replies from the client, MAC2 towards it
+}
+
+func (s *serverSession) close() {
+	if s.closed.CompareAndSwap(false, true) {
+		s.conn.Close()
+	}
+}
+
+// ServerProxy accepts AmneziaWG clients and forwards them to a WireGuard
+// server (server mode) or to an AmneziaWG server with other parameters
+// (bridge mode).
+type ServerProxy struct {
+	cfg        *Config // client-facing parameters
+	up         *Config // server-facing parameters
+	listenAddr *net.UDPAddr
+	remoteAddr *net.UDPAddr
+	stopped    atomic.Bool
+	stats      proxyStats // "out" is client -> server, "in" is server -> client
+	logLim     *logLimiter
+	pmtu       bool // path MTU discovery on the upstream sockets
+	workers    int  // listen sockets, see SetWorkers
+
+	serverPub  [32]byte
+	serverKey  [32]byte   // MAC1 key for messages to the server
+	toServer   mac1Signer // nil keys when ServerPub is not set
+	clientPubs [][32]byte // public keys of the accepted clients
+	clientKeys [][32]byte // MAC1 keys of the accepted clients, same order
+
+	mu       sync.Mutex
+	sessions map[netip.AddrPort]*serverSession
+	wg       sync.WaitGroup // session goroutines
+
+	statsInterval time.Duration // periodic stats summary, 0 = disabled
+}
+
+// NewServerProxy creates a proxy that accepts AmneziaWG clients described by
+// cfg in front of a plain WireGuard server. ServerPub is the WireGuard
+// server's public key; ClientPubs (or ClientPub if ClientPubs is empty) lists
+// the public keys of the clients.
+func NewServerProxy(cfg *Config, listenAddr, remoteAddr *net.UDPAddr) *ServerProxy {
+	return NewBridgeProxy(cfg, plainWireGuard(cfg), listenAddr, remoteAddr)
+}
+
+// NewBridgeProxy creates a proxy that accepts AmneziaWG clients described by
+// clientCfg and re-obfuscates their traffic with serverCfg for the server at
+// remoteAddr. Keys are taken as in NewServerProxy; serverCfg.ServerPub takes
+// precedence over clientCfg.ServerPub when set.
+func NewBridgeProxy(clientCfg, serverCfg *Config, listenAddr, remoteAddr *net.UDPAddr) *ServerProxy {
+	cfg := clientCfg
+	p := &ServerProxy{
+		cfg:        cfg,
+		up:         serverCfg,
+		listenAddr: listenAddr,
+		remoteAddr: remoteAddr,
+		logLim:     newLogLimiter(cfg.LogRate, cfg.LogBurst),
+		sessions:   make(map[netip.AddrPort]*serverSession),
+	}
+	serverPub := serverCfg.ServerPub
+	if serverPub == ([32]byte{}) {
+		serverPub = cfg.ServerPub
+	}
+	p.serverPub = serverPub
+	if serverPub != ([32]byte{}) {
+		p.serverKey = computeMAC1Key(serverPub)
+		p.toServer = mac1Signer{init: &p.serverKey, resp: &p.serverKey}
+	}
+	pubs := cfg.ClientPubs
+	if len(pubs) == 0 && cfg.ClientPub != ([32]byte{}) {
+		pubs = [][32]byte{cfg.ClientPub}
+	}
+	p.clientPubs = pubs
+	for _, pub := range pubs {
+		p.clientKeys = append(p.clientKeys, computeMAC1Key(pub))
+	}
+	return p
+}
+
+// SetPathMTUDiscovery enables path MTU discovery on the sockets towards the
+// server, see Proxy.SetPathMTUDiscovery. Must be called before Run.
+func (p *ServerProxy) SetPathMTUDiscovery(on bool) {
+	p.pmtu = on
+}
+
+// SetWorkers runs the client -> server loop on n listen sockets sharing the
+// port with SO_REUSEPORT, each on its own goroutine; the server -> client
+// side already has a goroutine per session. Linux only, a single socket is
+// used elsewhere or if the sockets cannot be opened. Must be called before Run.
+func (p *ServerProxy) SetWorkers(n int) {
+	p.workers = n
+}
+
+// SetStatsInterval enables a periodic StatsLine in the log. Must be called before Run.
+func (p *ServerProxy) SetStatsInterval(d time.Duration) {
+	p.statsInterval = d
+}
+
+// Run starts the proxy and blocks until stop is closed or a fatal error occurs.
+func (p *ServerProxy) Run(stop <-chan struct{}) error {
+	listenConns, err := p.listen()
+	if err != nil {
+		return err
+	}
+	for _, conn := range listenConns {
+		defer conn.Close()
+		setSocketBuffersLog(conn, SocketBufSize, p.cfg, "listen")
+	}
+
+	timeout := time.Duration(p.cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 180 * time.Second
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// Stop handler: close the listen sockets to unblock the read loops.
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+		p.stopped.Store(true)
+		for _, conn := range listenConns {
+			conn.Close()
+		}
+	}()
+
+	// Session expiry: drop sessions idle for longer than the timeout.
+	go func() {
+		interval := min(5*time.Second, timeout)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var statsC <-chan time.Time
+		if p.statsInterval > 0 {
+			statsTicker := time.NewTicker(p.statsInterval)
+			defer statsTicker.Stop()
+			statsC = statsTicker.C
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				p.flushLogs()
+				p.expireSessions(timeout)
+			case <-statsC:
+				p.LogStats()
+			}
+		}
+	}()
+
+	var workers sync.WaitGroup
+	for _, conn := range listenConns[1:] {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			p.clientToServer(conn)
+		}()
+	}
+	p.clientToServer(listenConns[0])
+	workers.Wait()
+
+	p.mu.Lock()
+	for addr, s := range p.sessions {
+		s.close()
+		delete(p.sessions, addr)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+	p.flushLogs()
+	return nil
+}
+
+// listen opens the listen sockets: one, or p.workers sharing the port.
+func (p *ServerProxy) listen() ([]*net.UDPConn, error) {
+	return listenSockets(p.listenAddr, p.workers, p.logInfo, p.logError)
+}
+
+// listenWorkers opens n SO_REUSEPORT sockets on addr. A zero port is chosen
+// by the first socket and shared by the others.
+func listenWorkers(addr *net.UDPAddr, n int) ([]*net.UDPConn, error) {
+	conns := make([]*net.UDPConn, 0, n)
+	for range n {
+		conn, err := listenReusePort(addr)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+		addr = conn.LocalAddr().(*net.UDPAddr)
+	}
+	return conns, nil
+}
+
+// plainWireGuard returns a Config under which the transforms leave WireGuard
+// packets unchanged (apart from re-signing MAC1), used as the server side of
+// server mode.
+func plainWireGuard(cfg *Config) *Config {
+	wg := &Config{
+		H1:        HRange{Min: wgHandshakeInit, Max: wgHandshakeInit},
+		H2:        HRange{Min: wgHandshakeResponse, Max: wgHandshakeResponse},
+		H3:        HRange{Min: wgCookieReply, Max: wgCookieReply},
+		H4:        HRange{Min: wgTransportData, Max: wgTransportData},
+		ServerPub: cfg.ServerPub,
+	}
+	wg.ComputeFastPath()
+	return wg
+}
+
+// clientToServer reads AmneziaWG packets from clients and forwards them to
+// the server through the client's session.
+func (p *ServerProxy) clientToServer(listenConn *net.UDPConn) {
+	// Headroom for the server-side S4 padding (see TransformOutbound).
+	head := p.up.S4
+	size := p.cfg.packetBufSize()
+	buf := make([]byte, head+size)
+	var last *serverSession // skips the map lookup for consecutive packets of one client
+
+	for {
+		n, addr, err := listenConn.ReadFromUDPAddrPort(buf[head : head+size])
+		if err != nil {
+			if p.stopped.Load() || isClosedErr(err) {
+				return
+			}
+			p.logError("listen read: ", err.Error())
+			continue
+		}
+
+		init, signed := p.clientHandshake(buf[head : head+n])
+		if !signed {
+			p.stats.dropsIn.Add(1)
+			if p.cfg.logLevel() >= LevelDebug {
+				LogDebug(p.cfg, "c->s: handshake ", strconv.Itoa(n), "B from ", addr.String(), " with invalid MAC1, dropped")
+			}
+			continue
+		}
+		wg, valid := transformInbound(buf[head:], n, p.cfg, mac1Signer{})
+		if !valid {
+			p.stats.dropsIn.Add(1)
+			if p.cfg.logLevel() >= LevelDebug {
+				LogDebug(p.cfg, "c->s: invalid/junk packet ", strconv.Itoa(n), "B from ", addr.String(), ", dropped")
+			}
+			continue
+		}
+
+		s := last
+		if s == nil || s.client != addr || s.closed.Load() {
+			if init {
+				s = p.session(addr, listenConn)
+			} else {
+				s = p.lookupSession(addr)
+			}
+			if s == nil {
+				p.stats.dropsIn.Add(1)
+				if p.cfg.logLevel() >= LevelDebug {
+					LogDebug(p.cfg, "c->s: ", strconv.Itoa(n), "B from ", addr.String(), " without a session, dropped")
+				}
+				continue
+			}
+			last = s
+		}
+		s.lastActive.Store(time.Now().UnixNano())
+
+		sign := p.toServer
+		sign.to, sign.from = s.serverCookie, s.clientCookie
+		out, sendJunk := transformOutbound(buf, head+n-len(wg), len(wg), p.up, sign)
+		if sendJunk {
+			p.sendPreamble(p.up, &s.toServer, func(pkt []byte) error {
+				_, err := s.conn.Write(pkt)
+				return err
+			})
+		}
+
+		if _, err := s.conn.Write(out); err != nil {
+			if isMsgSizeErr(err) {
+				p.stats.tooBig.Add(1)
+				p.logError(oversizeHint(s.conn, p.up))
+			} else if !isClosedErr(err) {
+				p.logError("remote write: ", err.Error())
+			}
+			continue
+		}
+		p.stats.pktsOut.Add(1)
+		p.stats.bytesOut.Add(uint64(len(out)))
+		if p.cfg.logLevel() >= LevelDebug {
+			LogDebug(p.cfg, "c->s: ", addr.String(), " recv ", strconv.Itoa(n), "B, sent ", strconv.Itoa(len(out)), "B to server")
+		}
+	}
+}
+
+// clientHandshake classifies a packet from a client before transformInbound
+// rewrites it: init reports a handshake init, signed is false for a
+// handshake init or response whose MAC1 is not valid for the server key.
+// Without ServerPub MAC1 is passed on unchanged and left to the server.
+func (p *ServerProxy) clientHandshake(pkt []byte) (init, signed bool) {
+	cfg := p.cfg
+	var msg []byte
+	var off int
+	switch n := len(pkt); {
+	case n == cfg.initTotal && cfg.H1.Contains(binary.LittleEndian.Uint32(pkt[cfg.S1:])):
+		msg, off, init = pkt[cfg.S1:], 116, true
+	case n == cfg.respTotal && cfg.H2.Contains(binary.LittleEndian.Uint32(pkt[cfg.S2:])):
+		msg, off = pkt[cfg.S2:], 60
+	default:
+		return false, true
+	}
+	if p.toServer.init == nil {
+		return init, true
+	}
+	return init, verifyMAC1(msg, off, p.serverKey)
+}
+
+// lookupSession returns the session of client, or nil if there is none.
+func (p *ServerProxy) lookupSession(client netip.AddrPort) *serverSession {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sessions[client]
+}
+
+// session returns the session of client, creating it if needed; replies to
+// a new session are sent from listen. Returns nil if the session table is full or the server cannot be dialed.
+func (p *ServerProxy) session(client netip.AddrPort, listen *net.UDPConn) *serverSession {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s := p.sessions[client]; s != nil {
+		return s
+	}
+	if len(p.sessions) >= maxServerSessions {
+		p.logError("session table full (", strconv.Itoa(maxServerSessions), "), dropping packet from ", client.String())
+		return nil
+	}
+	conn, err := net.DialUDP("udp4", nil, p.remoteAddr)
+	if err != nil {
+		p.logError("dial: ", err.Error())
+		return nil
+	}
+	setSocketBuffers(conn, SocketBufSize)
+	if p.pmtu {
+		if err := setPMTUDiscover(conn); err != nil {
+			p.logError("path MTU discovery: ", err.Error())
+		}
+	}
+	s := &serverSession{
+		client:   client,
+		conn:     conn,
+		listen:   listen,
+		toServer: newJunkState(p.up),
+		toClient: newJunkState(p.cfg),
+
+		serverCookie: newCookieState(p.serverPub),
+		clientCookie: newCookieState([32]byte{}), // key set when the client is identified
+	}
+	s.lastActive.Store(time.Now().UnixNano())
+	p.sessions[client] = s
+	p.logInfo("session: ", client.String(), " via ", conn.LocalAddr().String())
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.serverToClient(s)
+	}()
+	return s
+}
+
+// expireSessions closes sessions without traffic for longer than timeout.
+func (p *ServerProxy) expireSessions(timeout time.Duration) {
+	cutoff := time.Now().Add(-timeout).UnixNano()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, s := range p.sessions {
+		if s.lastActive.Load() < cutoff {
+			s.close()
+			delete(p.sessions, addr)
+			p.logInfo("session expired: ", addr.String())
+		}
+	}
+}
+
+// serverToClient reads packets for one session from the server and sends
+// them to the client in AmneziaWG form.
+func (p *ServerProxy) serverToClient(s *serverSession) {
+	head := p.cfg.S4
+	size := p.up.packetBufSize()
+	buf := make([]byte, head+size)
+
+	for {
+		n, err := s.conn.Read(buf[head : head+size])
+		if err != nil {
+			if s.closed.Load() || p.stopped.Load() || isClosedErr(err) {
+				return
+			}
+			// ECONNREFUSED while the server is down; keep the session.
+			p.logError("remote read: ", err.Error())
+			continue
+		}
+		s.lastActive.Store(time.Now().UnixNano())
+
+		// The client key is checked against the message as the server signed
+		// it, before transformInbound rewrites the type.
+		sign := p.clientSigner(s, buf[head:head+n])
+		sign.to, sign.from = s.clientCookie, s.serverCookie
+		wg, valid := transformInbound(buf[head:], n, p.up, mac1Signer{})
+		if !valid {
+			if p.cfg.logLevel() >= LevelDebug {
+				LogDebug(p.cfg, "s->c: invalid/junk packet ", strconv.Itoa(n), "B from server, dropped")
+			}
+			continue
+		}
+		isResp := len(wg) == WgHandshakeResponseSize && binary.LittleEndian.Uint32(wg[:4]) == wgHandshakeResponse
+		out, sendJunk := transformOutbound(buf, head+n-len(wg), len(wg), p.cfg, sign)
+
+		if sendJunk {
+			// Server-initiated handshake: precede it with CPS and junk as a client would.
+			p.sendPreamble(p.cfg, &s.toClient, func(pkt []byte) error {
+				_, err := s.listen.WriteToUDPAddrPort(pkt, s.client)
+				return err
+			})
+		}
+
+		if _, err := s.listen.WriteToUDPAddrPort(out, s.client); err != nil {
+			if p.stopped.Load() {
+				return
+			}
+			p.logError("listen write: ", err.Error())
+			continue
+		}
+		p.stats.pktsIn.Add(1)
+		p.stats.bytesIn.Add(uint64(len(out)))
+		if isResp {
+			p.stats.lastHandshake.Store(time.Now().UnixNano())
+		}
+		if p.cfg.logLevel() >= LevelDebug {
+			LogDebug(p.cfg, "s->c: ", strconv.Itoa(n), "B -> ", strconv.Itoa(len(out)), "B to ", s.client.String())
+		}
+	}
+}
+
+// sendPreamble sends the CPS and junk packets that precede a handshake init.
+func (p *ServerProxy) sendPreamble(cfg *Config, j *junkState, write func([]byte) error) {
+	for _, pkt := range j.cps(cfg, cfg) {
+		if write(pkt) != nil {
+			return
+		}
+		p.stats.cpsSent.Add(1)
+	}
+	for _, junk := range j.junk(cfg) {
+		if write(junk) != nil {
+			return
+		}
+		p.stats.junkSent.Add(1)
+	}
+}
+
+// clientSigner returns the MAC1 keys for a packet from the server to the
+// session's client. pkt is the packet as received, in the server-side form.
+// For handshake messages the client key is identified (once per session) by
+// the MAC1 the server computed.
+func (p *ServerProxy) clientSigner(s *serverSession, pkt []byte) mac1Signer {
+	up := p.up
+	var msg []byte
+	var off int
+	switch n := len(pkt); {
+	case n == up.initTotal && up.H1.Contains(binary.LittleEndian.Uint32(pkt[up.S1:])):
+		msg, off = pkt[up.S1:], 116
+	case n == up.respTotal && up.H2.Contains(binary.LittleEndian.Uint32(pkt[up.S2:])):
+		msg, off = pkt[up.S2:], 60
+	default:
+		return mac1Signer{}
+	}
+	key := s.clientKey.Load()
+	if key == nil || !verifyMAC1(msg, off, *key) {
+		key = nil
+		for i := range p.clientKeys {
+			if verifyMAC1(msg, off, p.clientKeys[i]) {
+				key = &p.clientKeys[i]
+				s.clientCookie.setKey(p.clientPubs[i])
+				break
+			}
+		}
+		if key == nil {
+			p.logError("s->c: handshake for ", s.client.String(), " does not match any client public key, MAC1 left as is")
+			return mac1Signer{}
+		}
+		s.clientKey.Store(key)
+	}
+	return mac1Signer{init: key, resp: key}
+}
+
+// Sessions returns the number of active client sessions.
+func (p *ServerProxy) Sessions() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.sessions)
+}
+
+// StatsLine returns a one-line summary of the counters for periodic logging.
+// Junk and CPS counts cover both directions.
+func (p *ServerProxy) StatsLine() string {
+	s := &p.stats
+	lastHS := "never"
+	if ts := s.lastHandshake.Load(); ts != 0 {
+		lastHS = time.Since(time.Unix(0, ts)).Truncate(time.Second).String()
+	}
+	return "stats: sessions=" + strconv.Itoa(p.Sessions()) +
+		", c->s " + strconv.FormatUint(s.pktsOut.Load(), 10) + " pkts/" + strconv.FormatUint(s.bytesOut.Load(), 10) + "B" +
+		", s->c " + strconv.FormatUint(s.pktsIn.Load(), 10) + " pkts/" + strconv.FormatUint(s.bytesIn.Load(), 10) + "B" +
+		", dropped=" + strconv.FormatUint(s.dropsIn.Load(), 10) +
+		", junk=" + strconv.FormatUint(s.junkSent.Load(), 10) +
+		", cps=" + strconv.FormatUint(s.cpsSent.Load(), 10) +
+		", too_big=" + strconv.FormatUint(s.tooBig.Load(), 10) +
+		", last_handshake=" + lastHS
+}
+
+// LogStats writes the StatsLine at info level.
+func (p *ServerProxy) LogStats() {
+	LogInfo(p.cfg, p.StatsLine())
+}
+
+func (p *ServerProxy) logInfo(parts ...string) {
+	if p.cfg.logLevel() < LevelInfo {
+		return
+	}
+	p.logLim.log("INFO: ", parts)
+}
+
+func (p *ServerProxy) logError(parts ...string) {
+	if p.cfg.logLevel() < LevelError {
+		return
+	}
+	p.logLim.log("ERROR: ", parts)
+}
+
+func (p *ServerProxy) flushLogs() {
+	if p.cfg.logLevel() < LevelError {
+		return
+	}
+	p.logLim.writeSuppressed()
+}
@@ -0,0 +1,427 @@
+package awg
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	reverseServerPub = [32]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	reverseClientPub = [32]byte{9, 10, 11, 12, 13, 14, 15, 16}
+)
+
+func reverseTestConfig() *Config {
+	cfg := proxyTestConfig()
+	cfg.ServerPub = reverseServerPub
+	cfg.ClientPub = reverseClientPub
+	cfg.ComputeMAC1Keys()
+	return cfg
+}
+
+// signedWGPacket returns a WireGuard init or response with a valid MAC1 for pub.
+func signedWGPacket(msgType uint32, pub [32]byte) []byte {
+	if msgType == wgHandshakeInit {
+		pkt := makeWGPacket(msgType, WgHandshakeInitSize)
+		recomputeMAC1(pkt, computeMAC1Key(pub))
+		return pkt
+	}
+	pkt := makeWGPacket(msgType, WgHandshakeResponseSize)
+	recomputeMAC1Response(pkt, computeMAC1Key(pub))
+	return pkt
+}
+
+// startServerProxy starts a ServerProxy in front of remoteAddr.
+func startServerProxy(t *testing.T, cfg *Config, remoteAddr *net.UDPAddr) (*ServerProxy, *net.UDPAddr, func()) {
+	t.Helper()
+	return startSessionProxy(t, func(listen *net.UDPAddr) *ServerProxy {
+		return NewServerProxy(cfg, listen, remoteAddr)
+	})
+}
+
+// startSessionProxy starts the ServerProxy returned by newProxy on a free port.
+func startSessionProxy(t *testing.T, newProxy func(listen *net.UDPAddr) *ServerProxy) (*ServerProxy, *net.UDPAddr, func()) {
+	t.Helper()
+	tmpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyAddr := tmpConn.LocalAddr().(*net.UDPAddr)
+	tmpConn.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	proxy := newProxy(proxyAddr)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.Run(stop)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	return proxy, proxyAddr, func() {
+		close(stop)
+		<-done
+	}
+}
+
+// openSession sends a handshake init signed for the server from client
+// through the proxy and returns the upstream address the server got it from.
+func openSession(t *testing.T, cfg *Config, client, wgServer *net.UDPConn) *net.UDPAddr {
+	t.Helper()
+	init := signedWGPacket(wgHandshakeInit, reverseServerPub)
+	out, _ := TransformOutbound(init, 0, len(init), cfg)
+	client.Write(out)
+	pkts, from := readPacketsWithAddr(wgServer, 500*time.Millisecond, 1)
+	if len(pkts) != 1 || len(pkts[0]) != WgHandshakeInitSize {
+		t.Fatal("handshake init not forwarded")
+	}
+	return from
+}
+
+func dialUDP(t *testing.T, addr *net.UDPAddr) *net.UDPConn {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// TestServerProxyRoundTrip chains a client-mode Proxy and a ServerProxy: the
+// WireGuard server must see plain WireGuard with MAC1 valid for its key, the
+// client must get responses with MAC1 valid for the client key.
+func TestServerProxyRoundTrip(t *testing.T) {
+	wgServer := startMockServer(t)
+	defer wgServer.Close()
+
+	_, serverProxyAddr, stopServer := startServerProxy(t, reverseTestConfig(), wgServer.LocalAddr().(*net.UDPAddr))
+	defer stopServer()
+	clientProxyAddr, stopClient := startProxy(t, reverseTestConfig(), serverProxyAddr)
+	defer stopClient()
+
+	client := dialUDP(t, clientProxyAddr)
+	defer client.Close()
+
+	init := signedWGPacket(wgHandshakeInit, reverseServerPub)
+	client.Write(init)
+
+	pkts, from := readPacketsWithAddr(wgServer, 500*time.Millisecond, 10)
+	if len(pkts) != 1 {
+		t.Fatalf("server got %d packets, want only the init (junk must be dropped)", len(pkts))
+	}
+	if len(pkts[0]) != WgHandshakeInitSize || binary.LittleEndian.Uint32(pkts[0][:4]) != wgHandshakeInit {
+		t.Fatalf("server got %dB type %d, want WireGuard init", len(pkts[0]), binary.LittleEndian.Uint32(pkts[0][:4]))
+	}
+	if !verifyMAC1(pkts[0], 116, computeMAC1Key(reverseServerPub)) {
+		t.Fatal("init MAC1 not valid for the server key")
+	}
+
+	wgServer.WriteToUDP(signedWGPacket(wgHandshakeResponse, reverseClientPub), from)
+	pkts = readPackets(client, 500*time.Millisecond, 1)
+	if len(pkts) != 1 || len(pkts[0]) != WgHandshakeResponseSize || binary.LittleEndian.Uint32(pkts[0][:4]) != wgHandshakeResponse {
+		t.Fatalf("client did not get a WireGuard response: %d packets", len(pkts))
+	}
+	if !verifyMAC1(pkts[0], 60, computeMAC1Key(reverseClientPub)) {
+		t.Fatal("response MAC1 not valid for the client key")
+	}
+
+	data := makeWGPacket(wgTransportData, 200)
+	client.Write(data)
+	pkts = readPackets(wgServer, 500*time.Millisecond, 1)
+	if len(pkts) != 1 || string(pkts[0]) != string(data) {
+		t.Fatal("transport data client->server not restored")
+	}
+	wgServer.WriteToUDP(data, from)
+	pkts = readPackets(client, 500*time.Millisecond, 1)
+	if len(pkts) != 1 || string(pkts[0]) != string(data) {
+		t.Fatal("transport data server->client not restored")
+	}
+}
+
+// TestServerProxyMultipleClients checks that each client gets its own
+// upstream endpoint and replies are routed back to the right client.
+func TestServerProxyMultipleClients(t *testing.T) {
+	wgServer := startMockServer(t)
+	defer wgServer.Close()
+
+	cfg := reverseTestConfig()
+	proxy, proxyAddr, stop := startServerProxy(t, cfg, wgServer.LocalAddr().(*net.UDPAddr))
+	defer stop()
+
+	var clients [2]*net.UDPConn
+	var upstream [2]*net.UDPAddr
+	for i := range clients {
+		clients[i] = dialUDP(t, proxyAddr)
+		defer clients[i].Close()
+		upstream[i] = openSession(t, cfg, clients[i], wgServer)
+		pkt := makeWGPacket(wgTransportData, 64)
+		pkt[8] = byte(i)
+		out, _ := TransformOutbound(pkt, 0, len(pkt), cfg)
+		clients[i].Write(out)
+		pkts, from := readPacketsWithAddr(wgServer, 500*time.Millisecond, 1)
+		if len(pkts) != 1 || pkts[0][8] != byte(i) || from.String() != upstream[i].String() {
+			t.Fatalf("client %d: transport not forwarded through its session", i)
+		}
+	}
+	if upstream[0].String() == upstream[1].String() {
+		t.Fatal("clients share one upstream endpoint")
+	}
+	if n := proxy.Sessions(); n != 2 {
+		t.Fatalf("Sessions() = %d, want 2", n)
+	}
+
+	for i := range clients {
+		reply := makeWGPacket(wgTransportData, 64)
+		reply[8] = byte(10 + i)
+		wgServer.WriteToUDP(reply, upstream[i])
+		pkts := readPackets(clients[i], 500*time.Millisecond, 1)
+		if len(pkts) != 1 {
+			t.Fatalf("client %d: no reply", i)
+		}
+		got, valid := TransformInbound(pkts[0], len(pkts[0]), cfg)
+		if !valid || got[8] != byte(10+i) {
+			t.Fatalf("client %d: wrong reply", i)
+		}
+	}
+}
+
+// TestServerProxyRejectsUnsigned checks that handshakes without a MAC1 for
+// the server key and packets from unknown clients neither reach the server
+// nor create sessions.
+func TestServerProxyRejectsUnsigned(t *testing.T) {
+	wgServer := startMockServer(t)
+	defer wgServer.Close()
+
+	cfg := reverseTestConfig()
+	proxy, proxyAddr, stop := startServerProxy(t, cfg, wgServer.LocalAddr().(*net.UDPAddr))
+	defer stop()
+
+	client := dialUDP(t, proxyAddr)
+	defer client.Close()
+
+	spoofed := [][]byte{makeWGPacket(wgTransportData, 64), signedWGPacket(wgHandshakeResponse, reverseServerPub)}
+	for _, pkt := range spoofed {
+		out, _ := TransformOutbound(pkt, 0, len(pkt), cfg)
+		client.Write(out)
+	}
+	init := signedWGPacket(wgHandshakeInit, reverseServerPub)
+	out, _ := TransformOutbound(init, 0, len(init), cfg)
+	out[len(out)-32] ^= 0xff // first byte of MAC1
+	client.Write(out)
+
+	if pkts := readPackets(wgServer, 300*time.Millisecond, 3); len(pkts) != 0 {
+		t.Fatalf("server got %d spoofed packets", len(pkts))
+	}
+	if n := proxy.Sessions(); n != 0 {
+		t.Fatalf("Sessions() = %d, want 0", n)
+	}
+
+	openSession(t, cfg, client, wgServer)
+	data := makeWGPacket(wgTransportData, 64)
+	out, _ = TransformOutbound(append([]byte(nil), data...), 0, len(data), cfg)
+	client.Write(out)
+	if pkts := readPackets(wgServer, 500*time.Millisecond, 1); len(pkts) != 1 || string(pkts[0]) != string(data) {
+		t.Fatal("transport not forwarded after the handshake init")
+	}
+}
+
+// TestServerProxyIdentifiesClientKey checks that responses are re-signed with
+// the key of the client the server answered, out of several.
+func TestServerProxyIdentifiesClientKey(t *testing.T) {
+	wgServer := startMockServer(t)
+	defer wgServer.Close()
+
+	other := [32]byte{0xaa}
+	cfg := reverseTestConfig()
+	cfg.ClientPubs = [][32]byte{other, reverseClientPub}
+	_, proxyAddr, stop := startServerProxy(t, cfg, wgServer.LocalAddr().(*net.UDPAddr))
+	defer stop()
+
+	client := dialUDP(t, proxyAddr)
+	defer client.Close()
+	init := signedWGPacket(wgHandshakeInit, reverseServerPub)
+	out, _ := TransformOutbound(init, 0, len(init), cfg)
+	client.Write(out)
+	_, from := readPacketsWithAddr(wgServer, 500*time.Millisecond, 1)
+	if from == nil {
+		t.Fatal("init not forwarded")
+	}
+
+	wgServer.WriteToUDP(signedWGPacket(wgHandshakeResponse, reverseClientPub), from)
+	pkts := readPackets(client, 500*time.Millisecond, 1)
+	if len(pkts) != 1 || len(pkts[0]) != cfg.respTotal {
+		t.Fatal("no padded response")
+	}
+	resp := pkts[0][cfg.S2:]
+	if h := binary.LittleEndian.Uint32(resp[:4]); !cfg.H2.Contains(h) {
+		t.Fatalf("response type %d not in H2", h)
+	}
+	if !verifyMAC1(resp, 60, computeMAC1Key(reverseClientPub)) {
+		t.Fatal("response MAC1 not re-signed with the matching client key")
+	}
+}
+
+func TestServerProxySessionExpiry(t *testing.T) {
+	wgServer := startMockServer(t)
+	defer wgServer.Close()
+
+	cfg := reverseTestConfig()
+	cfg.Timeout = 1
+	proxy, proxyAddr, stop := startServerProxy(t, cfg, wgServer.LocalAddr().(*net.UDPAddr))
+	defer stop()
+
+	client := dialUDP(t, proxyAddr)
+	defer client.Close()
+	first := openSession(t, cfg, client, wgServer)
+
+	deadline := time.Now().Add(4 * time.Second)
+	for proxy.Sessions() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle session not expired")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if second := openSession(t, cfg, client, wgServer); second.String() == first.String() {
+		t.Fatal("expired session reused its upstream socket")
+	}
+}
+
+// TestServerProxyWorkers sends interleaved bursts from several clients
+// through four listen workers: every client's packets must reach the server
+// in order, and replies must come back from the proxy port.
+func TestServerProxyWorkers(t *testing.T) {
+	wgServer := startMockServer(t)
+	defer wgServer.Close()
+
+	cfg := reverseTestConfig()
+	proxy, proxyAddr, stop := startSessionProxy(t, func(listen *net.UDPAddr) *ServerProxy {
+		p := NewServerProxy(cfg, listen, wgServer.LocalAddr().(*net.UDPAddr))
+		p.SetWorkers(4)
+		return p
+	})
+	defer stop()
+
+	const clients, burst = 8, 16
+	conns := make([]*net.UDPConn, clients)
+	upstream := make([]*net.UDPAddr, clients)
+	for i := range conns {
+		conns[i] = dialUDP(t, proxyAddr)
+		defer conns[i].Close()
+		upstream[i] = openSession(t, cfg, conns[i], wgServer)
+	}
+	for seq := range burst {
+		for i, conn := range conns {
+			pkt := makeWGPacket(wgTransportData, 64)
+			pkt[8], pkt[9] = byte(i), byte(seq)
+			out, _ := TransformOutbound(pkt, 0, len(pkt), cfg)
+			conn.Write(out)
+		}
+	}
+
+	next := map[byte]byte{}
+	for received := 0; received < clients*burst; received++ {
+		pkts, from := readPacketsWithAddr(wgServer, time.Second, 1)
+		if len(pkts) != 1 {
+			t.Fatalf("server got %d of %d packets", received, clients*burst)
+		}
+		client, seq := pkts[0][8], pkts[0][9]
+		if seq != next[client] {
+			t.Fatalf("client %d: packet %d arrived, want %d", client, seq, next[client])
+		}
+		if from.String() != upstream[client].String() {
+			t.Fatalf("client %d: packet %d not sent through its session", client, seq)
+		}
+		next[client]++
+	}
+	if n := proxy.Sessions(); n != clients {
+		t.Fatalf("Sessions() = %d, want %d", n, clients)
+	}
+
+	for i, conn := range conns {
+		reply := makeWGPacket(wgTransportData, 64)
+		reply[8] = byte(100 + i)
+		wgServer.WriteToUDP(reply, upstream[i])
+		pkts := readPackets(conn, time.Second, 1)
+		if len(pkts) != 1 {
+			t.Fatalf("client %d: no reply", i)
+		}
+		if got, valid := TransformInbound(pkts[0], len(pkts[0]), cfg); !valid || got[8] != byte(100+i) {
+			t.Fatalf("client %d: wrong reply", i)
+		}
+	}
+}
+
+// TestBridgeReobfuscates checks that a bridge decodes client traffic with the
+// client-facing parameters and re-encodes it with the server-facing ones,
+// including junk and MAC1, in both directions.
+func TestBridgeReobfuscates(t *testing.T) {
+	awgServer := startMockServer(t)
+	defer awgServer.Close()
+
+	clientCfg := reverseTestConfig()
+	serverCfg := v2Config()
+	serverCfg.ServerPub = reverseServerPub
+	serverCfg.ComputeMAC1Keys()
+	_, proxyAddr, stop := startSessionProxy(t, func(listen *net.UDPAddr) *ServerProxy {
+		return NewBridgeProxy(clientCfg, serverCfg, listen, awgServer.LocalAddr().(*net.UDPAddr))
+	})
+	defer stop()
+
+	client := dialUDP(t, proxyAddr)
+	defer client.Close()
+
+	for _, junk := range GenerateJunkPackets(clientCfg) {
+		client.Write(junk)
+	}
+	init := signedWGPacket(wgHandshakeInit, reverseServerPub)
+	out, _ := TransformOutbound(init, 0, len(init), clientCfg)
+	client.Write(out)
+
+	pkts, from := readPacketsWithAddr(awgServer, 500*time.Millisecond, 10)
+	if len(pkts) != serverCfg.Jc+1 {
+		t.Fatalf("server got %d packets, want %d junk + init", len(pkts), serverCfg.Jc)
+	}
+	got := pkts[len(pkts)-1]
+	if len(got) != serverCfg.initTotal {
+		t.Fatalf("init is %dB, want %d", len(got), serverCfg.initTotal)
+	}
+	msg := got[serverCfg.S1:]
+	if h := binary.LittleEndian.Uint32(msg[:4]); !serverCfg.H1.Contains(h) {
+		t.Fatalf("init type %d not in server-side H1", h)
+	}
+	if !verifyMAC1(msg, 116, computeMAC1Key(reverseServerPub)) {
+		t.Fatal("init MAC1 not re-signed for the server-side type")
+	}
+
+	resp := signedWGPacket(wgHandshakeResponse, reverseClientPub)
+	binary.LittleEndian.PutUint32(resp[:4], serverCfg.H2.Min)
+	recomputeMAC1Response(resp, computeMAC1Key(reverseClientPub))
+	awgResp := append(make([]byte, serverCfg.S2), resp...)
+	awgServer.WriteToUDP(awgResp, from)
+
+	pkts = readPackets(client, 500*time.Millisecond, 1)
+	if len(pkts) != 1 || len(pkts[0]) != clientCfg.respTotal {
+		t.Fatal("client did not get a response padded with the client-side S2")
+	}
+	msg = pkts[0][clientCfg.S2:]
+	if h := binary.LittleEndian.Uint32(msg[:4]); !clientCfg.H2.Contains(h) {
+		t.Fatalf("response type %d not in client-side H2", h)
+	}
+	if !verifyMAC1(msg, 60, computeMAC1Key(reverseClientPub)) {
+		t.Fatal("response MAC1 not re-signed for the client-side type")
+	}
+
+	data := makeWGPacket(wgTransportData, 100)
+	out, _ = TransformOutbound(append([]byte(nil), data...), 0, len(data), clientCfg)
+	client.Write(out)
+	pkts = readPackets(awgServer, 500*time.Millisecond, 1)
+	if len(pkts) != 1 || len(pkts[0]) != serverCfg.S4+len(data) {
+		t.Fatal("transport not re-padded with the server-side S4")
+	}
+	wg, valid := TransformInbound(pkts[0], len(pkts[0]), serverCfg)
+	if !valid || string(wg) != string(data) {
+		t.Fatal("transport not decodable with the server-side parameters")
+	}
+}
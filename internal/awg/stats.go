@@ -0,0 +1,162 @@
+package awg
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// proxyStats holds traffic counters. Each direction is written by its own
+// goroutine; padding keeps the two directions on separate cache lines.
+type proxyStats struct {
+	pktsOut     atomic.Uint64 // client -> server packets sent (after transform)
+	bytesOut    atomic.Uint64
+	junkSent    atomic.Uint64 // junk packets sent before handshake inits
+	cpsSent     atomic.Uint64 // CPS packets sent before handshake inits
+	tooBig      atomic.Uint64 // client -> server packets rejected with EMSGSIZE
+	initRetries atomic.Uint64 // inits sent with the reduced burst of RetryPolicy
+	_           [16]byte
+
+	pktsIn        atomic.Uint64 // server -> client packets forwarded
+	bytesIn       atomic.Uint64
+	dropsIn       atomic.Uint64 // inbound packets rejected by TransformInbound
+	lastHandshake atomic.Int64  // unix nanos of the last inbound handshake response
+	filteredIn    atomic.Uint64 // inbound packets for an unknown receiver index (session filter)
+	_             [24]byte
+
+	reconnects atomic.Uint64
+}
+
+// ParseLogLevel maps a level name (none, error, info, debug) to a Level* constant.
+func ParseLogLevel(s string) (int, bool) {
+	switch s {
+	case "none":
+		return LevelNone, true
+	case "error":
+		return LevelError, true
+	case "info":
+		return LevelInfo, true
+	case "debug":
+		return LevelDebug, true
+	}
+	return 0, false
+}
+
+func logLevelName(level int) string {
+	switch level {
+	case LevelNone:
+		return "none"
+	case LevelError:
+		return "error"
+	case LevelInfo:
+		return "info"
+	case LevelDebug:
+		return "debug"
+	}
+	return strconv.Itoa(level)
+}
+
+// clientString returns the client addresses of the workers.
+func (p *Proxy) clientString() string {
+	return p.joinWorkers(func(w *Proxy) string {
+		if ca := w.clientAddr.Load(); ca != nil {
+			return ca.String()
+		}
+		return ""
+	}, "none")
+}
+
+// remoteString returns the address of the current remote connection, which may
+// differ from the configured one after a reconnect re-resolved it.
+func (p *Proxy) remoteString() string {
+	if rc := p.remoteConn.Load(); rc != nil {
+		if ra := rc.RemoteAddr(); ra != nil {
+			return ra.String()
+		}
+	}
+	return p.remoteAddr.String()
+}
+
+func (p *Proxy) lastHandshakeAge() string {
+	if ts := p.statsTotal().lastHandshake.Load(); ts != 0 {
+		return time.Since(time.Unix(0, ts)).Truncate(time.Second).String()
+	}
+	return "never"
+}
+
+// Status returns a multi-line key=value snapshot of the proxy state and counters.
+// With SetWorkers the client, local and session values of the workers are
+// comma-separated and the counters summed.
+func (p *Proxy) Status() string {
+	client := p.clientString()
+	local := p.joinWorkers(func(w *Proxy) string {
+		if rc := w.remoteConn.Load(); rc != nil {
+			return rc.LocalAddr().String()
+		}
+		return ""
+	}, "none")
+	uptime := "0s"
+	if st := p.started.Load(); st != 0 {
+		uptime = time.Since(time.Unix(0, st)).Truncate(time.Second).String()
+	}
+	lastHS := p.lastHandshakeAge()
+	if lastHS != "never" {
+		lastHS += " ago"
+	}
+	session := "off"
+	if p.filter != nil {
+		session = p.joinWorkers(func(w *Proxy) string {
+			if s := w.filter.String(); s != "none" {
+				return s
+			}
+			return ""
+		}, "none")
+	}
+	s := p.statsTotal()
+	return "client=" + client + "\n" +
+		"remote=" + p.remoteAddr.String() + "\n" +
+		"local=" + local + "\n" +
+		"workers=" + strconv.Itoa(len(p.allWorkers())) + "\n" +
+		"uptime=" + uptime + "\n" +
+		"log_level=" + logLevelName(p.cfg.logLevel()) + "\n" +
+		"last_handshake=" + lastHS + "\n" +
+		"session=" + session + "\n" +
+		"out_packets=" + strconv.FormatUint(s.pktsOut.Load(), 10) + "\n" +
+		"out_bytes=" + strconv.FormatUint(s.bytesOut.Load(), 10) + "\n" +
+		"junk_sent=" + strconv.FormatUint(s.junkSent.Load(), 10) + "\n" +
+		"cps_sent=" + strconv.FormatUint(s.cpsSent.Load(), 10) + "\n" +
+		"out_too_big=" + strconv.FormatUint(s.tooBig.Load(), 10) + "\n" +
+		"init_retries=" + strconv.FormatUint(s.initRetries.Load(), 10) + "\n" +
+		"in_packets=" + strconv.FormatUint(s.pktsIn.Load(), 10) + "\n" +
+		"in_bytes=" + strconv.FormatUint(s.bytesIn.Load(), 10) + "\n" +
+		"in_dropped=" + strconv.FormatUint(s.dropsIn.Load(), 10) + "\n" +
+		"in_filtered=" + strconv.FormatUint(s.filteredIn.Load(), 10) + "\n" +
+		"reconnects=" + strconv.FormatUint(s.reconnects.Load(), 10) + "\n"
+}
+
+// StatsLine returns a one-line summary of the counters for periodic logging.
+func (p *Proxy) StatsLine() string {
+	s := p.statsTotal()
+	return "stats: c->s " + strconv.FormatUint(s.pktsOut.Load(), 10) + " pkts/" + strconv.FormatUint(s.bytesOut.Load(), 10) + "B" +
+		", s->c " + strconv.FormatUint(s.pktsIn.Load(), 10) + " pkts/" + strconv.FormatUint(s.bytesIn.Load(), 10) + "B" +
+		", dropped=" + strconv.FormatUint(s.dropsIn.Load(), 10) +
+		", filtered=" + strconv.FormatUint(s.filteredIn.Load(), 10) +
+		", junk=" + strconv.FormatUint(s.junkSent.Load(), 10) +
+		", cps=" + strconv.FormatUint(s.cpsSent.Load(), 10) +
+		", too_big=" + strconv.FormatUint(s.tooBig.Load(), 10) +
+		", init_retries=" + strconv.FormatUint(s.initRetries.Load(), 10) +
+		", reconnects=" + strconv.FormatUint(s.reconnects.Load(), 10) +
+		", client=" + p.clientString() +
+		", remote=" + p.remoteString() +
+		", last_handshake=" + p.lastHandshakeAge()
+}
+
+// LogStats writes the StatsLine at info level (used for SIGUSR1 and the periodic summary).
+func (p *Proxy) LogStats() {
+	LogInfo(p.cfg, p.StatsLine())
+}
+
+// SetStatsInterval enables a periodic StatsLine in the log. Must be called before Run.
+func (p *Proxy) SetStatsInterval(d time.Duration) {
+	p.statsInterval = d
+}
@@ -0,0 +1,69 @@
+package awg
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsLineAfterSession(t *testing.T) {
+	cfg := proxyTestConfig()
+	mockServer := startMockServer(t)
+	defer mockServer.Close()
+
+	proxy, proxyAddr, stopProxy := startProxyWithHandle(t, cfg, mockServer.LocalAddr().(*net.UDPAddr))
+	defer stopProxy()
+
+	if line := proxy.StatsLine(); !strings.Contains(line, "client=none") || !strings.Contains(line, "last_handshake=never") {
+		t.Fatalf("unexpected initial stats: %s", line)
+	}
+
+	clientConn, err := net.DialUDP("udp", nil, proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+	proxyRemote := establishSession(t, cfg, clientConn, mockServer)
+
+	// Server -> client: a handshake response and one junk packet.
+	resp := makeWGPacket(wgHandshakeResponse, WgHandshakeResponseSize)
+	binary.LittleEndian.PutUint32(resp[:4], cfg.H2.Min)
+	padded := append(make([]byte, cfg.S2), resp...)
+	mockServer.WriteToUDP(padded, proxyRemote)
+	mockServer.WriteToUDP([]byte{1, 2, 3, 4, 5}, proxyRemote)
+	readPackets(clientConn, time.Second, 1)
+	time.Sleep(50 * time.Millisecond)
+
+	line := proxy.StatsLine()
+	for _, want := range []string{
+		"c->s 1 pkts/" + strconv.Itoa(cfg.S1+WgHandshakeInitSize) + "B",
+		"s->c 1 pkts/" + strconv.Itoa(WgHandshakeResponseSize) + "B",
+		"dropped=1",
+		"junk=4",
+		"client=" + clientConn.LocalAddr().String(),
+		"remote=" + mockServer.LocalAddr().String(),
+		"last_handshake=0s",
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("stats line missing %q: %s", want, line)
+		}
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for name, want := range map[string]int{"none": LevelNone, "error": LevelError, "info": LevelInfo, "debug": LevelDebug} {
+		got, ok := ParseLogLevel(name)
+		if !ok || got != want {
+			t.Errorf("ParseLogLevel(%q) = %d, %v", name, got, ok)
+		}
+		if logLevelName(want) != name {
+			t.Errorf("logLevelName(%d) = %q", want, logLevelName(want))
+		}
+	}
+	if _, ok := ParseLogLevel("verbose"); ok {
+		t.Error("expected unknown level to be rejected")
+	}
+}
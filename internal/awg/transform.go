@@ -3,6 +3,7 @@ package awg
 import (
 	"encoding/binary"
 	"math/rand/v2"
+	"sync/atomic"
 )
 
 // randFill fills b with pseudo-random bytes using math/rand/v2.
@@ -69,12 +70,18 @@ type Config struct {
 	H3   HRange // replacement type for cookie reply
 	H4   HRange // replacement type for transport data
 
-	CPS [5]*CPSTemplate // I1-I5 CPS templates (v2, nil = not configured)
+	CPS          [5]*CPSTemplate // I1-I5 CPS templates (v2, nil = not configured)
+	CPSPolicy    [5]CPSPolicy    // when each CPS template is sent (zero = before every handshake init)
+	JunkTemplate *JunkTemplate   // junk packet content (nil = random bytes)
+	Padding      [4]*CPSTemplate // S1-S4 padding content (nil = random bytes)
 
-	ServerPub     [32]byte // AWG server public key (for outbound MAC1 recomputation)
-	ClientPub     [32]byte // WG client public key (for inbound MAC1 recomputation)
-	mac1keyServer [32]byte // precomputed BLAKE2s-256("mac1----" || ServerPub)
-	mac1keyClient [32]byte // precomputed BLAKE2s-256("mac1----" || ClientPub)
+	ServerPub     [32]byte   // AWG server public key (for outbound MAC1 recomputation)
+	ClientPub     [32]byte   // WG client public key (for inbound MAC1 recomputation)
+	ClientPubs    [][32]byte // server mode: public keys of the accepted AWG clients
+	mac1keyServer [32]byte   // precomputed BLAKE2s-256("mac1----" || ServerPub)
+	mac1keyClient [32]byte   // precomputed BLAKE2s-256("mac1----" || ClientPub)
+	outMAC        mac1Signer
+	inMAC         mac1Signer
 
 	h4Fixed     uint32 // H4.Min for point-range configs (avoids Pick())
 	h4NoOp      bool   // true when H4={4,4} and S4==0 (identity transform, zero work)
@@ -82,8 +89,17 @@ type Config struct {
 	respTotal   int    // S2 + WgHandshakeResponseSize (expected total size of padded response)
 	cookieTotal int    // S3 + WgCookieReplySize (expected total size of padded cookie)
 
-	Timeout  int // inactivity timeout seconds, default 180
-	LogLevel int // 0=none, 1=error, 2=info
+	padFill [4]*paddingFill // Padding laid out for S1-S4 (see newPaddingFill), nil = random bytes
+
+	Timeout  int     // inactivity timeout seconds, default 180
+	LogLevel int     // 0=none, 1=error, 2=info
+	LogRate  float64 // repeated INFO/ERROR messages per second (0 = default 1, < 0 = unlimited; AWG_LOG_RATE=0 sets -1)
+	LogBurst int     // repeated messages allowed before limiting (0 = default 5)
+
+	logOverride atomic.Int32  // runtime log level + 1 (0 = use LogLevel), see SetLogLevel
+	cpsCounter  atomic.Uint32 // next value of the CPS <c> tags, see CPSCounter
+	cpsLimit    atomic.Uint32 // counter value the state file is saved ahead to
+	cpsState    *cpsState     // state file of ReserveCPSState, nil if none
 }
 
 // Log levels.
@@ -94,20 +110,64 @@ const (
 	LevelDebug = 3
 )
 
+// SetLogLevel overrides LogLevel at runtime (safe for concurrent use).
+// A negative level removes the override.
+func (c *Config) SetLogLevel(level int) {
+	if level < 0 {
+		c.logOverride.Store(0)
+		return
+	}
+	c.logOverride.Store(int32(level) + 1)
+}
+
+// logLevel returns the effective log level.
+func (c *Config) logLevel() int {
+	if v := c.logOverride.Load(); v != 0 {
+		return int(v) - 1
+	}
+	return c.LogLevel
+}
+
+// mac1Signer selects the keys used to recompute MAC1 after the type field of a
+// handshake init or response was rewritten (MAC1 covers the type). MAC1 is
+// keyed with the public key of the message's receiver. A nil key leaves MAC1
+// untouched. to and from, when set, carry the cookie state of the receiver
+// and of the sender of the packets (see cookie.go).
+type mac1Signer struct {
+	init *[32]byte
+	resp *[32]byte
+	to   *cookieState // receiver: MAC1 history and cookie for MAC2
+	from *cookieState // sender: its cookie replies pass in this direction
+}
+
 // ComputeMAC1Keys derives MAC1 keys from ServerPub and ClientPub.
 func (c *Config) ComputeMAC1Keys() {
 	c.mac1keyServer = computeMAC1Key(c.ServerPub)
 	c.mac1keyClient = computeMAC1Key(c.ClientPub)
+	c.outMAC, c.inMAC = mac1Signer{}, mac1Signer{}
+	// Both handshake directions: the server may initiate, in which case the
+	// init arrives inbound and the client's response goes outbound.
+	if c.ServerPub != ([32]byte{}) {
+		c.outMAC.init = &c.mac1keyServer
+		c.outMAC.resp = &c.mac1keyServer
+	}
+	if c.ClientPub != ([32]byte{}) {
+		c.inMAC.init = &c.mac1keyClient
+		c.inMAC.resp = &c.mac1keyClient
+	}
 }
 
 // ComputeFastPath precomputes fast-path flags for hot-path optimizations.
-// Must be called after setting H4, S4 and all S1-S4 values.
+// Must be called after setting H4, S4, all S1-S4 values and Padding.
 func (c *Config) ComputeFastPath() {
 	c.h4Fixed = c.H4.Min
 	c.h4NoOp = c.H4.Min == wgTransportData && c.H4.Max == wgTransportData && c.S4 == 0
 	c.initTotal = c.S1 + WgHandshakeInitSize
 	c.respTotal = c.S2 + WgHandshakeResponseSize
 	c.cookieTotal = c.S3 + WgCookieReplySize
+	for i, size := range [4]int{c.S1, c.S2, c.S3, c.S4} {
+		c.padFill[i] = newPaddingFill(c.Padding[i], size)
+	}
 }
 
 // TransformOutbound transforms an outbound WireGuard packet into AmneziaWG format.
@@ -116,6 +176,12 @@ func (c *Config) ComputeFastPath() {
 // For zero-alloc S4 padding, the caller should allocate buf with S4 extra bytes at the start
 // and read data into buf[S4:]. When S4>0 and dataOff>=S4, padding uses the headroom in buf.
 func TransformOutbound(buf []byte, dataOff, n int, cfg *Config) (out []byte, sendJunk bool) {
+	return transformOutbound(buf, dataOff, n, cfg, cfg.outMAC)
+}
+
+// transformOutbound converts a WireGuard packet to AmneziaWG form, re-signing
+// handshake MAC1 with the keys in sign.
+func transformOutbound(buf []byte, dataOff, n int, cfg *Config, sign mac1Signer) (out []byte, sendJunk bool) {
 	if n < 4 {
 		return buf[dataOff : dataOff+n], false
 	}
@@ -127,12 +193,10 @@ func TransformOutbound(buf []byte, dataOff, n int, cfg *Config) (out []byte, sen
 	case msgType == wgHandshakeInit && n == WgHandshakeInitSize:
 		// Replace type and recompute MAC1.
 		binary.LittleEndian.PutUint32(data[:4], cfg.H1.Pick())
-		if cfg.ServerPub != ([32]byte{}) {
-			recomputeMAC1(data, cfg.mac1keyServer)
-		}
+		sign.apply(data, 116, sign.init)
 		if cfg.S1 > 0 {
 			out = make([]byte, cfg.S1+n)
-			randFill(out[:cfg.S1])
+			cfg.fillPadding(0, out[:cfg.S1])
 			copy(out[cfg.S1:], data)
 		} else {
 			out = data
@@ -142,9 +206,10 @@ func TransformOutbound(buf []byte, dataOff, n int, cfg *Config) (out []byte, sen
 	case msgType == wgHandshakeResponse && n == WgHandshakeResponseSize:
 		// Replace type and prepend S2 padding bytes.
 		binary.LittleEndian.PutUint32(data[:4], cfg.H2.Pick())
+		sign.apply(data, 60, sign.resp)
 		if cfg.S2 > 0 {
 			out = make([]byte, cfg.S2+n)
-			randFill(out[:cfg.S2])
+			cfg.fillPadding(1, out[:cfg.S2])
 			copy(out[cfg.S2:], data)
 		} else {
 			out = data
@@ -152,10 +217,11 @@ func TransformOutbound(buf []byte, dataOff, n int, cfg *Config) (out []byte, sen
 		return out, false
 
 	case msgType == wgCookieReply && n == WgCookieReplySize:
+		sign.cookieReply(data)
 		binary.LittleEndian.PutUint32(data[:4], cfg.H3.Pick())
 		if cfg.S3 > 0 {
 			out = make([]byte, cfg.S3+n)
-			randFill(out[:cfg.S3])
+			cfg.fillPadding(2, out[:cfg.S3])
 			copy(out[cfg.S3:], data)
 		} else {
 			out = data
@@ -173,11 +239,11 @@ func TransformOutbound(buf []byte, dataOff, n int, cfg *Config) (out []byte, sen
 		}
 		if cfg.S4 > 0 && dataOff >= cfg.S4 {
 			// Zero-alloc: use headroom before dataOff.
-			randFill(buf[dataOff-cfg.S4 : dataOff])
+			cfg.fillPadding(3, buf[dataOff-cfg.S4:dataOff])
 			return buf[dataOff-cfg.S4 : dataOff+n], false
 		} else if cfg.S4 > 0 {
 			out = make([]byte, cfg.S4+n)
-			randFill(out[:cfg.S4])
+			cfg.fillPadding(3, out[:cfg.S4])
 			copy(out[cfg.S4:], data)
 			return out, false
 		}
@@ -194,6 +260,12 @@ func TransformOutbound(buf []byte, dataOff, n int, cfg *Config) (out []byte, sen
 // Uses size-based dispatch: handshake packets have fixed total sizes and are checked first,
 // transport data is checked last to avoid false positives from random padding bytes.
 func TransformInbound(buf []byte, n int, cfg *Config) (out []byte, valid bool) {
+	return transformInbound(buf, n, cfg, cfg.inMAC)
+}
+
+// transformInbound converts an AmneziaWG packet to WireGuard form, re-signing
+// handshake MAC1 with the keys in sign.
+func transformInbound(buf []byte, n int, cfg *Config, sign mac1Signer) (out []byte, valid bool) {
 	if n < 4 {
 		return nil, false
 	}
@@ -213,6 +285,7 @@ func TransformInbound(buf []byte, n int, cfg *Config) (out []byte, valid bool) {
 		h := binary.LittleEndian.Uint32(buf[cfg.S1 : cfg.S1+4])
 		if cfg.H1.Contains(h) {
 			binary.LittleEndian.PutUint32(buf[cfg.S1:cfg.S1+4], wgHandshakeInit)
+			sign.apply(buf[cfg.S1:n], 116, sign.init)
 			return buf[cfg.S1:n], true
 		}
 	}
@@ -221,9 +294,7 @@ func TransformInbound(buf []byte, n int, cfg *Config) (out []byte, valid bool) {
 		h := binary.LittleEndian.Uint32(buf[cfg.S2 : cfg.S2+4])
 		if cfg.H2.Contains(h) {
 			binary.LittleEndian.PutUint32(buf[cfg.S2:cfg.S2+4], wgHandshakeResponse)
-			if cfg.ClientPub != ([32]byte{}) {
-				recomputeMAC1Response(buf[cfg.S2:cfg.S2+WgHandshakeResponseSize], cfg.mac1keyClient)
-			}
+			sign.apply(buf[cfg.S2:n], 60, sign.resp)
 			return buf[cfg.S2:n], true
 		}
 	}
@@ -232,6 +303,7 @@ func TransformInbound(buf []byte, n int, cfg *Config) (out []byte, valid bool) {
 		h := binary.LittleEndian.Uint32(buf[cfg.S3 : cfg.S3+4])
 		if cfg.H3.Contains(h) {
 			binary.LittleEndian.PutUint32(buf[cfg.S3:cfg.S3+4], wgCookieReply)
+			sign.cookieReply(buf[cfg.S3:n])
 			return buf[cfg.S3:n], true
 		}
 	}
@@ -248,7 +320,8 @@ func TransformInbound(buf []byte, n int, cfg *Config) (out []byte, valid bool) {
 	return nil, false
 }
 
-// GenerateJunkPackets creates Jc junk packets with random sizes in [Jmin, Jmax].
+// GenerateJunkPackets creates Jc junk packets with random sizes in [Jmin, Jmax],
+// filled with random bytes or from JunkTemplate.
 // Uses 2 allocations instead of Jc+1: one shared data buffer + one slice header.
 func GenerateJunkPackets(cfg *Config) [][]byte {
 	if cfg.Jc <= 0 || cfg.Jmax <= 0 {
@@ -264,9 +337,8 @@ func GenerateJunkPackets(cfg *Config) [][]byte {
 		jmax = jmin
 	}
 
-	// Single data buffer for all junk (upper bound: Jc * Jmax).
-	data := make([]byte, cfg.Jc*jmax)
-	randFill(data)
+	// Single data buffer for all junk (upper bound: Jc * junkMax).
+	data := make([]byte, cfg.Jc*cfg.junkMax())
 
 	packets := make([][]byte, cfg.Jc)
 	off := 0
@@ -275,8 +347,10 @@ func GenerateJunkPackets(cfg *Config) [][]byte {
 		if jmax > jmin {
 			size = jmin + rand.IntN(jmax-jmin+1)
 		}
+		size = cfg.JunkTemplate.packetSize(size, jmin, jmax)
 		packets[i] = data[off : off+size]
 		off += size
 	}
+	fillJunkPackets(cfg.JunkTemplate, packets)
 	return packets
 }
@@ -0,0 +1,214 @@
+package awg
+
+import (
+	"encoding/binary"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Transformer converts packets between the WireGuard form spoken on the
+// client side and the form sent to the server. The proxy loops only move
+// packets; everything that makes the traffic AmneziaWG lives behind this
+// interface, so other obfuscation schemes, or none, can be plugged in with
+// Proxy.SetTransformer.
+//
+// Outbound and Prelude are called by the client -> server side (the read
+// loop, or the handshake emitter with pacing), Inbound by the server ->
+// client loop; each method is called from one goroutine at a time, except
+// Reset, which may run concurrently with the others. With Proxy.SetWorkers
+// the workers share a Transformer set with SetTransformer, so its methods
+// may be called concurrently.
+// Transformed packets must fit the buffers sized from Config (see
+// Config.MaxPadding).
+type Transformer interface {
+	// Outbound converts the WireGuard packet buf[dataOff:dataOff+n]. It may
+	// modify buf and use the dataOff bytes before the packet as headroom.
+	// handshake reports a handshake init, which is sent after the Prelude.
+	Outbound(buf []byte, dataOff, n int) (out []byte, handshake bool)
+
+	// Inbound converts the packet buf[:n] from the server back to WireGuard
+	// form, in place. valid=false drops the packet.
+	Inbound(buf []byte, n int) (out []byte, valid bool)
+
+	// Prelude returns the packets sent before a handshake init: the CPS
+	// packets if cps is set and up to jc junk packets. The packets may be
+	// reused by the next call.
+	Prelude(cps bool, jc int) (cpsPkts, junk [][]byte)
+
+	// Reset is called after the proxy reconnects to the server: to the
+	// network the next handshake starts a new flow.
+	Reset()
+}
+
+// IdleSender is implemented by Transformers that send packets of their own
+// while the tunnel is idle, such as AmneziaWG CPS packets with an idle
+// policy. The proxy sends each IdlePacket whenever no client packet went to
+// the server for its Interval.
+type IdleSender interface {
+	IdlePackets() []IdlePacket
+}
+
+// IdlePacket is a packet an IdleSender sends on an idle tunnel.
+type IdlePacket struct {
+	Interval time.Duration
+	Name     string        // for logs and captures, e.g. "cps 1"
+	Generate func() []byte // called from one goroutine at a time
+}
+
+// TransportIdentity is implemented by Transformers that may leave
+// WireGuard transport data unchanged. If TransportIdentity reports true,
+// the batch loop forwards transport packets without calling Outbound.
+type TransportIdentity interface {
+	TransportIdentity() bool
+}
+
+// amneziaTransformer is the default Transformer: AmneziaWG obfuscation as
+// set up in Config, with MAC1 re-signing and cookie tracking.
+type amneziaTransformer struct {
+	cfg          *Config
+	counter      *Config      // whose CPS counter the <c> tags use, see Proxy.Reload
+	junk         junkState    // pre-allocated CPS and junk packets
+	serverCookie *cookieState // cookie replies from the server, MAC2 of outbound handshakes
+	clientCookie *cookieState // cookie replies from the client, MAC2 of inbound handshakes
+	reset        atomic.Bool  // set by Reset, restarts the CPS policy init count
+}
+
+// NewAmneziaTransformer returns the AmneziaWG transformer for cfg, the one a
+// Proxy uses unless SetTransformer is called.
+func NewAmneziaTransformer(cfg *Config) Transformer {
+	return newAmneziaTransformer(cfg, cfg)
+}
+
+// newAmneziaTransformer returns the AmneziaWG transformer for cfg that
+// takes CPS counter values from counter.
+func newAmneziaTransformer(cfg, counter *Config) *amneziaTransformer {
+	return &amneziaTransformer{
+		cfg:          cfg,
+		counter:      counter,
+		junk:         newJunkState(cfg),
+		serverCookie: newCookieState(cfg.ServerPub),
+		clientCookie: newCookieState(cfg.ClientPub),
+	}
+}
+
+// IdlePackets returns the CPS packets with an idle policy (CPSPolicy.Idle).
+func (t *amneziaTransformer) IdlePackets() []IdlePacket {
+	var pkts []IdlePacket
+	for i, pol := range t.cfg.CPSPolicy {
+		tmpl := t.cfg.CPS[i]
+		if pol.Idle <= 0 || tmpl == nil {
+			continue
+		}
+		pkts = append(pkts, IdlePacket{
+			Interval: pol.Idle,
+			Name:     "cps " + strconv.Itoa(i+1),
+			Generate: func() []byte { return tmpl.Generate(t.counter.nextCPSCounter(1)) },
+		})
+	}
+	return pkts
+}
+
+// TransportIdentity reports H4={4,4} without S4 padding.
+func (t *amneziaTransformer) TransportIdentity() bool {
+	return t.cfg.h4NoOp
+}
+
+// outSign returns the MAC1 keys and cookie state for client -> server packets.
+func (t *amneziaTransformer) outSign() mac1Signer {
+	return mac1Signer{init: t.cfg.outMAC.init, resp: t.cfg.outMAC.resp, to: t.serverCookie, from: t.clientCookie}
+}
+
+// inSign returns the MAC1 keys and cookie state for server -> client packets.
+func (t *amneziaTransformer) inSign() mac1Signer {
+	return mac1Signer{init: t.cfg.inMAC.init, resp: t.cfg.inMAC.resp, to: t.clientCookie, from: t.serverCookie}
+}
+
+func (t *amneziaTransformer) Outbound(buf []byte, dataOff, n int) ([]byte, bool) {
+	return transformOutbound(buf, dataOff, n, t.cfg, t.outSign())
+}
+
+func (t *amneziaTransformer) Inbound(buf []byte, n int) ([]byte, bool) {
+	return transformInbound(buf, n, t.cfg, t.inSign())
+}
+
+// Prelude generates the CPS packets (I1->I5) and junk packets into
+// pre-allocated buffers, without allocating.
+func (t *amneziaTransformer) Prelude(cps bool, jc int) (cpsPkts, junk [][]byte) {
+	if t.reset.Swap(false) {
+		t.junk.cpsInits = 0
+	}
+	if cps {
+		cpsPkts = t.junk.cps(t.cfg, t.counter)
+	}
+	junk = t.junk.junk(t.cfg)
+	return cpsPkts, junk[:min(jc, len(junk))]
+}
+
+func (t *amneziaTransformer) Reset() {
+	t.reset.Store(true)
+}
+
+// PassthroughTransformer forwards packets unchanged, turning the proxy into a
+// plain UDP relay for WireGuard. Useful to tell obfuscation problems from
+// network problems.
+type PassthroughTransformer struct{}
+
+func (PassthroughTransformer) Outbound(buf []byte, dataOff, n int) ([]byte, bool) {
+	data := buf[dataOff : dataOff+n]
+	return data, n == WgHandshakeInitSize && binary.LittleEndian.Uint32(data) == wgHandshakeInit
+}
+
+func (PassthroughTransformer) Inbound(buf []byte, n int) ([]byte, bool) {
+	return buf[:n], n >= 4
+}
+
+func (PassthroughTransformer) Prelude(bool, int) (cpsPkts, junk [][]byte) {
+	return nil, nil
+}
+
+func (PassthroughTransformer) Reset() {}
+
+func (PassthroughTransformer) TransportIdentity() bool { return true }
+
+// activeTransformer is the Transformer a Proxy uses and what the loops
+// derive from it.
+type activeTransformer struct {
+	tr       Transformer
+	identity bool    // transport passes unchanged, batch fast path (see TransportIdentity)
+	cfg      *Config // the Config tr was built from by the proxy, nil for SetTransformer
+}
+
+// SetTransformer replaces the AmneziaWG transformer. It may be called while
+// the proxy runs: the loops switch over with their next packet, and the idle
+// packets of t replace those of the previous transformer. All workers use t
+// (see SetWorkers).
+func (p *Proxy) SetTransformer(t Transformer) {
+	p.setTransformer(t, nil)
+}
+
+// setTransformer installs t, built from cfg if not nil, and the matching
+// transformers of the lanes.
+func (p *Proxy) setTransformer(t Transformer, cfg *Config) {
+	ti, ok := t.(TransportIdentity)
+	p.tr.Store(&activeTransformer{tr: t, identity: ok && ti.TransportIdentity(), cfg: cfg})
+	p.startIdle(t)
+	for _, lane := range p.allWorkers()[1:] {
+		lane.setTransformer(p.laneTransformer(t, cfg), cfg)
+	}
+}
+
+// transformer returns the Transformer in use.
+func (p *Proxy) transformer() Transformer {
+	return p.tr.Load().tr
+}
+
+// paramConfig returns the Config of the obfuscation parameters in use: the
+// one the transformer was built from, or the proxy's own for a custom
+// transformer.
+func (p *Proxy) paramConfig() *Config {
+	if cfg := p.tr.Load().cfg; cfg != nil {
+		return cfg
+	}
+	return p.cfg
+}
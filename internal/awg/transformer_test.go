@@ -0,0 +1,327 @@
+package awg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// xorTransformer is a toy obfuscation scheme: every byte is XORed with key,
+// and each handshake init is preceded by one junk packet.
+type xorTransformer struct {
+	key  byte
+	junk [1][]byte
+}
+
+func newXORTransformer(key byte) *xorTransformer {
+	return &xorTransformer{key: key, junk: [1][]byte{bytes.Repeat([]byte{key}, 40)}}
+}
+
+func (x *xorTransformer) Outbound(buf []byte, dataOff, n int) ([]byte, bool) {
+	data := buf[dataOff : dataOff+n]
+	init := n == WgHandshakeInitSize && binary.LittleEndian.Uint32(data) == wgHandshakeInit
+	for i := range data {
+		data[i] ^= x.key
+	}
+	return data, init
+}
+
+func (x *xorTransformer) Inbound(buf []byte, n int) ([]byte, bool) {
+	if n == len(x.junk[0]) {
+		return nil, false
+	}
+	for i := range buf[:n] {
+		buf[i] ^= x.key
+	}
+	return buf[:n], true
+}
+
+func (x *xorTransformer) Prelude(cps bool, jc int) (cpsPkts, junk [][]byte) {
+	return nil, x.junk[:min(jc, 1)]
+}
+
+func (x *xorTransformer) Reset() {}
+
+// transformerCase is a transformer the loop tests run with, together with
+// the server's side of its wire format: encode turns a WireGuard message
+// into what the server sends, decode turns what the server received back
+// into a WireGuard message (valid=false for junk). The AmneziaWG wire format
+// is checked byte by byte by the integration tests instead.
+type transformerCase struct {
+	name   string
+	tr     Transformer
+	encode func(msg []byte) []byte
+	decode func(pkt []byte) (msg []byte, valid bool)
+}
+
+// testTransformers returns the transformers the echo test runs with.
+func testTransformers(cfg *Config) []transformerCase {
+	return append([]transformerCase{{name: "amneziawg", tr: NewAmneziaTransformer(cfg)}}, customTransformers()...)
+}
+
+// customTransformers returns the transformers other than AmneziaWG.
+func customTransformers() []transformerCase {
+	xor := newXORTransformer(0x5a)
+	return []transformerCase{
+		{
+			name:   "passthrough",
+			tr:     PassthroughTransformer{},
+			encode: func(msg []byte) []byte { return msg },
+			decode: func(pkt []byte) ([]byte, bool) { return pkt, true },
+		},
+		{
+			name: "xor",
+			tr:   newXORTransformer(0x5a),
+			encode: func(msg []byte) []byte {
+				out, _ := xor.Outbound(append([]byte(nil), msg...), 0, len(msg))
+				return out
+			},
+			decode: func(pkt []byte) ([]byte, bool) {
+				return xor.Inbound(append([]byte(nil), pkt...), len(pkt))
+			},
+		},
+	}
+}
+
+// startTransformerProxy starts a mock server and a proxy using tc's
+// transformer, and dials the proxy. stop closes all three.
+func startTransformerProxy(t *testing.T, cfg *Config, tc transformerCase) (proxy *Proxy, clientConn, mockServer *net.UDPConn, stop func()) {
+	t.Helper()
+	mockServer = startMockServer(t)
+	proxy, proxyAddr, stopProxy := startProxySetup(t, cfg, mockServer.LocalAddr().(*net.UDPAddr), func(p *Proxy) {
+		p.SetTransformer(tc.tr)
+	})
+	clientConn, err := net.DialUDP("udp", nil, proxyAddr)
+	if err != nil {
+		stopProxy()
+		mockServer.Close()
+		t.Fatal("dial: ", err)
+	}
+	return proxy, clientConn, mockServer, func() {
+		clientConn.Close()
+		stopProxy()
+		mockServer.Close()
+	}
+}
+
+// checkHandshake sends a handshake init from the client and a response from
+// the server, checks both arrive unchanged and returns the proxy's remote
+// address.
+func (tc transformerCase) checkHandshake(t *testing.T, clientConn, mockServer *net.UDPConn) *net.UDPAddr {
+	t.Helper()
+	init, proxyRemoteAddr := tc.establish(t, clientConn, mockServer)
+	if !bytes.Equal(init, makeWGPacket(wgHandshakeInit, WgHandshakeInitSize)) {
+		t.Fatal("init changed on the way to the server")
+	}
+	tc.checkInbound(t, clientConn, mockServer, proxyRemoteAddr, makeWGPacket(wgHandshakeResponse, WgHandshakeResponseSize))
+	return proxyRemoteAddr
+}
+
+// checkInbound sends msg from the server and checks it reaches the client
+// unchanged.
+func (tc transformerCase) checkInbound(t *testing.T, clientConn, mockServer *net.UDPConn, proxyRemoteAddr *net.UDPAddr, msg []byte) {
+	t.Helper()
+	if _, err := mockServer.WriteToUDP(tc.encode(msg), proxyRemoteAddr); err != nil {
+		t.Fatal("write from server: ", err)
+	}
+	clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 2048)
+	n, err := clientConn.Read(buf)
+	if err != nil {
+		t.Fatal("read at client: ", err)
+	}
+	if !bytes.Equal(buf[:n], msg) {
+		t.Fatalf("inbound: got %d bytes, want %d unchanged", n, len(msg))
+	}
+}
+
+// establish sends a WireGuard handshake init through the proxy and reads at
+// the mock server until it decodes, skipping junk and CPS packets. It returns
+// the decoded init and the proxy's remote address.
+func (tc transformerCase) establish(t *testing.T, clientConn, mockServer *net.UDPConn) ([]byte, *net.UDPAddr) {
+	t.Helper()
+	if _, err := clientConn.Write(makeWGPacket(wgHandshakeInit, WgHandshakeInitSize)); err != nil {
+		t.Fatal("establish: write init: ", err)
+	}
+	return tc.readMessage(t, mockServer, wgHandshakeInit)
+}
+
+// readMessage reads at the mock server until a packet decodes to a WireGuard
+// message of msgType and returns it with the sender's address.
+func (tc transformerCase) readMessage(t *testing.T, mockServer *net.UDPConn, msgType uint32) ([]byte, *net.UDPAddr) {
+	t.Helper()
+	mockServer.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := mockServer.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal("no message of type ", msgType, " at mock server: ", err)
+		}
+		msg, valid := tc.decode(buf[:n])
+		if valid && len(msg) >= 4 && binary.LittleEndian.Uint32(msg) == msgType {
+			return append([]byte(nil), msg...), addr
+		}
+	}
+}
+
+// checkTransport sends transport data of outSize bytes from the client and
+// of inSize bytes from the server, and checks both arrive unchanged.
+func (tc transformerCase) checkTransport(t *testing.T, clientConn, mockServer *net.UDPConn, proxyRemoteAddr *net.UDPAddr, outSize, inSize int) {
+	t.Helper()
+	out := makeWGPacket(wgTransportData, outSize)
+	want := append([]byte(nil), out...)
+	if _, err := clientConn.Write(out); err != nil {
+		t.Fatal("write transport: ", err)
+	}
+	if got, _ := tc.readMessage(t, mockServer, wgTransportData); !bytes.Equal(got, want) {
+		t.Fatalf("outbound transport: got %d bytes, want %d unchanged", len(got), outSize)
+	}
+
+	tc.checkInbound(t, clientConn, mockServer, proxyRemoteAddr, makeWGPacket(wgTransportData, inSize))
+}
+
+func TestPassthroughTransformer(t *testing.T) {
+	var tr PassthroughTransformer
+	init := makeWGPacket(wgHandshakeInit, WgHandshakeInitSize)
+	want := append([]byte(nil), init...)
+	buf := append(make([]byte, 8), init...)
+	out, hs := tr.Outbound(buf, 8, len(init))
+	if !hs || !bytes.Equal(out, want) {
+		t.Fatalf("Outbound: handshake=%v, changed=%v", hs, !bytes.Equal(out, want))
+	}
+	if _, hs := tr.Outbound(makeWGPacket(wgTransportData, 64), 0, 64); hs {
+		t.Fatal("transport data reported as a handshake")
+	}
+	if out, valid := tr.Inbound(buf[8:], len(init)); !valid || !bytes.Equal(out, want) {
+		t.Fatal("Inbound changed or dropped the packet")
+	}
+	if cps, junk := tr.Prelude(true, 4); len(cps)+len(junk) != 0 {
+		t.Fatal("Prelude returned packets")
+	}
+}
+
+// TestProxyCustomTransformer checks that the proxy sends what a custom
+// transformer produces: its prelude, then the transformed init.
+func TestProxyCustomTransformer(t *testing.T) {
+	cfg := proxyTestConfig()
+	server := startMockServer(t)
+	defer server.Close()
+	xt := newXORTransformer(0x5a)
+	_, proxyAddr, stop := startProxySetup(t, cfg, server.LocalAddr().(*net.UDPAddr), func(p *Proxy) {
+		p.SetTransformer(xt)
+	})
+	defer stop()
+	client := dialUDP(t, proxyAddr)
+	defer client.Close()
+
+	init := makeWGPacket(wgHandshakeInit, WgHandshakeInitSize)
+	client.Write(init)
+	pkts := readPackets(server, 300*time.Millisecond, cfg.Jc+2)
+	if len(pkts) != 2 || !bytes.Equal(pkts[0], xt.junk[0]) {
+		t.Fatalf("server got %d packets, want the junk packet and the init", len(pkts))
+	}
+	for i := range init {
+		if pkts[1][i] != init[i]^0x5a {
+			t.Fatalf("init byte %d not transformed", i)
+		}
+	}
+}
+
+func TestAmneziaPreludeNoAlloc(t *testing.T) {
+	cfg := benchConfigCPS(t)
+	tr := NewAmneziaTransformer(cfg)
+	cpsPkts, junk := tr.Prelude(true, cfg.Jc)
+	if len(cpsPkts) != 3 || len(junk) != cfg.Jc {
+		t.Fatalf("prelude: %d CPS and %d junk packets, want 3 and %d", len(cpsPkts), len(junk), cfg.Jc)
+	}
+	for i, pkt := range cpsPkts {
+		if len(pkt) != cfg.CPS[i].Size() {
+			t.Fatalf("CPS packet %d: %d bytes, want %d", i, len(pkt), cfg.CPS[i].Size())
+		}
+	}
+	if err := parseDTLSClientHello(cpsPkts[2]); err != nil {
+		t.Fatal("preset generated into the shared buffer: ", err)
+	}
+	if n := testing.AllocsPerRun(100, func() { tr.Prelude(true, cfg.Jc) }); n != 0 {
+		t.Fatalf("Prelude allocates %v times per call", n)
+	}
+}
+
+// TestTransformerFlow runs a session through the proxy with each custom
+// transformer: handshake, transport both ways and cookie reply, with the
+// v1 and the padded v2 configs (which the custom transformers ignore).
+func TestTransformerFlow(t *testing.T) {
+	for _, cfg := range []*Config{proxyTestConfig(), v2Config()} {
+		for _, tc := range customTransformers() {
+			t.Run(tc.name, func(t *testing.T) {
+				_, clientConn, mockServer, stop := startTransformerProxy(t, cfg, tc)
+				defer stop()
+				proxyRemoteAddr := tc.checkHandshake(t, clientConn, mockServer)
+				tc.checkTransport(t, clientConn, mockServer, proxyRemoteAddr, 200, 150)
+				tc.checkInbound(t, clientConn, mockServer, proxyRemoteAddr, makeWGPacket(wgCookieReply, WgCookieReplySize))
+			})
+		}
+	}
+}
+
+// TestTransformerReconnect checks that each custom transformer keeps
+// working both ways after a forced reconnect.
+func TestTransformerReconnect(t *testing.T) {
+	cfg := proxyTestConfig()
+	for _, tc := range customTransformers() {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy, clientConn, mockServer, stop := startTransformerProxy(t, cfg, tc)
+			defer stop()
+			_, proxyRemoteAddr := tc.establish(t, clientConn, mockServer)
+			tc.checkTransport(t, clientConn, mockServer, proxyRemoteAddr, 100, 80)
+
+			forceReconnect(t, proxy)
+
+			_, proxyRemoteAddr = tc.establish(t, clientConn, mockServer)
+			tc.checkTransport(t, clientConn, mockServer, proxyRemoteAddr, 120, 90)
+		})
+	}
+}
+
+// idleTransformer is a passthrough transformer that sends a marker packet on
+// an idle tunnel and forwards transport data unchanged.
+type idleTransformer struct {
+	PassthroughTransformer
+	interval time.Duration
+}
+
+func (it idleTransformer) IdlePackets() []IdlePacket {
+	return []IdlePacket{{Interval: it.interval, Name: "marker", Generate: func() []byte { return []byte("idle") }}}
+}
+
+// TestProxyOptionalInterfaces checks that the proxy uses IdleSender and
+// TransportIdentity of any transformer, not only the AmneziaWG one.
+func TestProxyOptionalInterfaces(t *testing.T) {
+	cfg := proxyTestConfig()
+	server := startMockServer(t)
+	defer server.Close()
+	proxy, _, stop := startProxySetup(t, cfg, server.LocalAddr().(*net.UDPAddr), func(p *Proxy) {
+		p.SetTransformer(idleTransformer{interval: 200 * time.Millisecond})
+	})
+	defer stop()
+
+	if !proxy.tr.Load().identity {
+		t.Fatal("TransportIdentity of a custom transformer ignored")
+	}
+	pkts := readPackets(server, 700*time.Millisecond, 2)
+	if len(pkts) != 2 || string(pkts[0]) != "idle" || string(pkts[1]) != "idle" {
+		t.Fatalf("server got %q, want two idle packets", pkts)
+	}
+
+	p := NewProxy(cfg, nil, nil)
+	p.SetTransformer(newXORTransformer(0x5a))
+	if p.tr.Load().identity {
+		t.Fatal("fast path for a transformer without TransportIdentity")
+	}
+	p.SetTransformer(NewAmneziaTransformer(cfg))
+	if p.tr.Load().identity != cfg.h4NoOp {
+		t.Fatalf("h4NoOp = %v for the AmneziaWG transformer, want %v", p.tr.Load().identity, cfg.h4NoOp)
+	}
+}
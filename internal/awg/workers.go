@@ -0,0 +1,136 @@
+package awg
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Client-mode workers.
+//
+// With SetWorkers the proxy listens on several SO_REUSEPORT sockets and runs
+// one lane per socket: a Proxy of its own with a socket to the server, a
+// transformer, a client address and a pair of loops, sharing the Config,
+// capture, diagnostics and log limiter with the proxy. The kernel assigns
+// every client address to one listen socket, so the packets of a flow are
+// handled by one lane in both directions and keep their order, while flows on
+// different lanes run in parallel. The server sees one endpoint per lane.
+
+// SetWorkers runs the proxy as n workers on listen sockets sharing the port
+// with SO_REUSEPORT, each with its own socket to the server. A WireGuard
+// peer uses one worker, so several peers (e.g. interfaces on different
+// ports) are forwarded in parallel; like a single proxy, a worker serves the
+// last client it heard from. Linux only, a single socket is used elsewhere
+// or if the sockets cannot be opened. Must be called before Run.
+func (p *Proxy) SetWorkers(n int) {
+	p.workers = n
+}
+
+// listen opens the listen sockets: one, or p.workers sharing the port.
+func (p *Proxy) listen() ([]*net.UDPConn, error) {
+	return listenSockets(p.listenAddr, p.workers, p.logInfo, p.logError)
+}
+
+// listenSockets opens one socket on addr, or workers sockets sharing the port
+// if workers > 1 and SO_REUSEPORT is available.
+func listenSockets(addr *net.UDPAddr, workers int, logInfo, logError func(...string)) ([]*net.UDPConn, error) {
+	if workers > 1 {
+		conns, err := listenWorkers(addr, workers)
+		if err == nil {
+			logInfo("listen workers: ", strconv.Itoa(len(conns)), " sockets with SO_REUSEPORT")
+			return conns, nil
+		}
+		logError("listen workers: ", err.Error(), ", using one socket")
+	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []*net.UDPConn{conn}, nil
+}
+
+// startLanes creates the n lanes that run next to the proxy itself.
+func (p *Proxy) startLanes(n int) []*Proxy {
+	p.idleMu.Lock()
+	defer p.idleMu.Unlock()
+	at := p.tr.Load()
+	for range n {
+		lane := &Proxy{
+			cfg:        p.cfg,
+			listenAddr: p.listenAddr,
+			remoteAddr: p.remoteAddr,
+			capture:    p.capture,
+			diag:       p.diag,
+			pmtu:       p.pmtu,
+			offload:    p.offload,
+			pacing:     p.pacing,
+			retry:      p.retry,
+			logLim:     p.logLim,
+			parent:     p,
+		}
+		if p.filter != nil {
+			lane.filter = new(sessionFilter)
+		}
+		lane.setTransformer(p.laneTransformer(at.tr, at.cfg), at.cfg)
+		p.lanes = append(p.lanes, lane)
+	}
+	return p.lanes
+}
+
+// laneTransformer returns the transformer of a lane for the proxy's t: an
+// AmneziaWG transformer of its own, as its junk buffers and cookies belong to
+// one flow, or t itself if it was set with SetTransformer.
+func (p *Proxy) laneTransformer(t Transformer, cfg *Config) Transformer {
+	if cfg == nil {
+		return t
+	}
+	return newAmneziaTransformer(cfg, p.cfg)
+}
+
+// allWorkers returns the proxy and its lanes.
+func (p *Proxy) allWorkers() []*Proxy {
+	p.idleMu.Lock()
+	defer p.idleMu.Unlock()
+	return append([]*Proxy{p}, p.lanes...)
+}
+
+// joinWorkers joins the non-empty values of f over the workers with commas,
+// or returns none.
+func (p *Proxy) joinWorkers(f func(*Proxy) string, none string) string {
+	var vals []string
+	for _, w := range p.allWorkers() {
+		if v := f(w); v != "" {
+			vals = append(vals, v)
+		}
+	}
+	if len(vals) == 0 {
+		return none
+	}
+	return strings.Join(vals, ",")
+}
+
+// statsTotal returns the counters summed over the workers; lastHandshake is
+// the latest one.
+func (p *Proxy) statsTotal() *proxyStats {
+	workers := p.allWorkers()
+	if len(workers) == 1 {
+		return &p.stats
+	}
+	t := new(proxyStats)
+	for _, w := range workers {
+		s := &w.stats
+		t.pktsOut.Add(s.pktsOut.Load())
+		t.bytesOut.Add(s.bytesOut.Load())
+		t.junkSent.Add(s.junkSent.Load())
+		t.cpsSent.Add(s.cpsSent.Load())
+		t.tooBig.Add(s.tooBig.Load())
+		t.initRetries.Add(s.initRetries.Load())
+		t.pktsIn.Add(s.pktsIn.Load())
+		t.bytesIn.Add(s.bytesIn.Load())
+		t.dropsIn.Add(s.dropsIn.Load())
+		t.filteredIn.Add(s.filteredIn.Load())
+		t.reconnects.Add(s.reconnects.Load())
+		t.lastHandshake.Store(max(t.lastHandshake.Load(), s.lastHandshake.Load()))
+	}
+	return t
+}
@@ -0,0 +1,156 @@
+package awg
+
+import (
+	"encoding/binary"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestProxyWorkers checks that with SetWorkers each client flow goes through
+// one worker and keeps its order in both directions while the workers run
+// concurrently.
+func TestProxyWorkers(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT workers are Linux only")
+	}
+	cfg := proxyTestConfig()
+	server := startMockServer(t)
+	defer server.Close()
+	proxy, proxyAddr, stop := startProxySetup(t, cfg, server.LocalAddr().(*net.UDPAddr), func(p *Proxy) {
+		p.SetWorkers(4)
+	})
+	defer stop()
+	if n := len(proxy.allWorkers()); n != 4 {
+		t.Fatalf("%d workers, want 4", n)
+	}
+
+	// Client i sends transport packets numbered by seq in the counter field
+	// (bytes 8-16), all clients at once.
+	const clients, burst = 8, 200
+	conns := make([]*net.UDPConn, clients)
+	for i := range conns {
+		conn, err := net.DialUDP("udp", nil, proxyAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	setSocketBuffers(server, SocketBufSize)
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := range burst {
+				pkt := makeWGPacket(wgTransportData, 64)
+				binary.LittleEndian.PutUint32(pkt[4:8], uint32(i))
+				binary.LittleEndian.PutUint64(pkt[8:16], uint64(seq))
+				conn.Write(pkt)
+				if seq%16 == 0 {
+					time.Sleep(time.Millisecond) // stay within the socket buffers
+				}
+			}
+		}()
+	}
+
+	next := make([]uint64, clients)
+	upstream := make([]string, clients)
+	for received := 0; received < clients*burst; received++ {
+		pkts, from := readPacketsWithAddr(server, 2*time.Second, 1)
+		if len(pkts) != 1 {
+			t.Fatalf("server got %d of %d packets", received, clients*burst)
+		}
+		if h := binary.LittleEndian.Uint32(pkts[0]); h != cfg.H4.Min {
+			t.Fatalf("packet with header %d, want H4", h)
+		}
+		client, seq := binary.LittleEndian.Uint32(pkts[0][4:8]), binary.LittleEndian.Uint64(pkts[0][8:16])
+		if seq != next[client] {
+			t.Fatalf("client %d: packet %d arrived, want %d", client, seq, next[client])
+		}
+		if upstream[client] == "" {
+			upstream[client] = from.String()
+		} else if upstream[client] != from.String() {
+			t.Fatalf("client %d: packet %d sent from %s, earlier ones from %s", client, seq, from, upstream[client])
+		}
+		next[client]++
+	}
+	wg.Wait()
+
+	// Replies: one client per worker, each the last one its worker heard from.
+	owner := map[string]int{}
+	for i, up := range upstream {
+		owner[up] = i
+	}
+	if len(owner) < 2 {
+		t.Fatalf("all clients on one worker (%s)", upstream[0])
+	}
+	for up, i := range owner {
+		conns[i].Write(makeWGPacket(wgTransportData, 32))
+		if pkts, _ := readPacketsWithAddr(server, time.Second, 1); len(pkts) != 1 {
+			t.Fatalf("client %d: packet through %s lost", i, up)
+		}
+	}
+	replies := make([][][]byte, clients)
+	var readers sync.WaitGroup
+	for _, i := range owner {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			replies[i] = readPackets(conns[i], 2*time.Second, burst)
+		}()
+	}
+	for up := range owner {
+		addr, err := net.ResolveUDPAddr("udp", up)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := range burst {
+				pkt := makeWGPacket(cfg.H4.Min, 64)
+				binary.LittleEndian.PutUint64(pkt[8:16], uint64(seq))
+				server.WriteToUDP(pkt, addr)
+				if seq%16 == 0 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	readers.Wait()
+	for up, i := range owner {
+		pkts := replies[i]
+		if len(pkts) != burst {
+			t.Fatalf("client %d: %d of %d replies through %s", i, len(pkts), burst, up)
+		}
+		for seq, pkt := range pkts {
+			if binary.LittleEndian.Uint32(pkt) != wgTransportData || binary.LittleEndian.Uint64(pkt[8:16]) != uint64(seq) {
+				t.Fatalf("client %d: reply %d out of order", i, seq)
+			}
+		}
+	}
+
+	status := proxy.Status()
+	if !strings.Contains(status, "workers=4\n") || !strings.Contains(status, "out_packets="+strconv.Itoa(clients*burst+len(owner))+"\n") {
+		t.Fatalf("status does not sum the workers:\n%s", status)
+	}
+
+	// Each worker has AmneziaWG state of its own; SetTransformer reaches all.
+	workers := proxy.allWorkers()
+	if workers[1].transformer() == workers[0].transformer() {
+		t.Fatal("workers share the AmneziaWG transformer")
+	}
+	proxy.SetTransformer(PassthroughTransformer{})
+	for i, w := range workers {
+		if _, ok := w.transformer().(PassthroughTransformer); !ok {
+			t.Fatalf("worker %d kept its transformer", i)
+		}
+	}
+}
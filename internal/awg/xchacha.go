@@ -0,0 +1,206 @@
+package awg
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"math/bits"
+)
+
+// XChaCha20-Poly1305 (draft-irtf-cfrg-xchacha, RFC 8439) for WireGuard cookie
+// replies. Only what the 16-byte cookie needs is implemented; speed is not a
+// concern.
+
+const poly1305TagSize = 16
+
+// chacha20Rounds applies the 20 ChaCha rounds to x in place.
+func chacha20Rounds(x *[16]uint32) {
+	qr := func(a, b, c, d int) {
+		x[a] += x[b]
+		x[d] = bits.RotateLeft32(x[d]^x[a], 16)
+		x[c] += x[d]
+		x[b] = bits.RotateLeft32(x[b]^x[c], 12)
+		x[a] += x[b]
+		x[d] = bits.RotateLeft32(x[d]^x[a], 8)
+		x[c] += x[d]
+		x[b] = bits.RotateLeft32(x[b]^x[c], 7)
+	}
+	for i := 0; i < 10; i++ {
+		qr(0, 4, 8, 12)
+		qr(1, 5, 9, 13)
+		qr(2, 6, 10, 14)
+		qr(3, 7, 11, 15)
+		qr(0, 5, 10, 15)
+		qr(1, 6, 11, 12)
+		qr(2, 7, 8, 13)
+		qr(3, 4, 9, 14)
+	}
+}
+
+// chacha20Init loads the constants, key and the 16-byte input (counter and
+// nonce, or the HChaCha20 nonce) into a ChaCha state.
+func chacha20Init(key *[32]byte, input []byte) [16]uint32 {
+	s := [16]uint32{0x61707865, 0x3320646e, 0x79622d32, 0x6b206574}
+	for i := 0; i < 8; i++ {
+		s[4+i] = binary.LittleEndian.Uint32(key[i*4:])
+	}
+	for i := 0; i < 4; i++ {
+		s[12+i] = binary.LittleEndian.Uint32(input[i*4:])
+	}
+	return s
+}
+
+// hchacha20 derives the XChaCha20 subkey from key and the first 16 nonce bytes.
+func hchacha20(key *[32]byte, nonce []byte) [32]byte {
+	x := chacha20Init(key, nonce)
+	chacha20Rounds(&x)
+	var out [32]byte
+	for i := 0; i < 4; i++ {
+		binary.LittleEndian.PutUint32(out[i*4:], x[i])
+		binary.LittleEndian.PutUint32(out[16+i*4:], x[12+i])
+	}
+	return out
+}
+
+// chacha20XOR XORs src into dst with the ChaCha20 (IETF) keystream starting at
+// block counter. dst and src may overlap exactly.
+func chacha20XOR(dst, src []byte, key *[32]byte, nonce *[12]byte, counter uint32) {
+	var input [16]byte
+	copy(input[4:], nonce[:])
+	var block [64]byte
+	for len(src) > 0 {
+		binary.LittleEndian.PutUint32(input[:4], counter)
+		s := chacha20Init(key, input[:])
+		x := s
+		chacha20Rounds(&x)
+		for i := range x {
+			binary.LittleEndian.PutUint32(block[i*4:], x[i]+s[i])
+		}
+		n := min(len(src), len(block))
+		for i := 0; i < n; i++ {
+			dst[i] = src[i] ^ block[i]
+		}
+		dst, src = dst[n:], src[n:]
+		counter++
+	}
+}
+
+// poly1305 computes the one-time authenticator of msg (RFC 8439 2.5) using
+// 64-bit limbs: h = h0 + h1<<64 + h2<<128.
+func poly1305(key *[32]byte, msg []byte) [poly1305TagSize]byte {
+	r0 := binary.LittleEndian.Uint64(key[0:8]) & 0x0FFFFFFC0FFFFFFF
+	r1 := binary.LittleEndian.Uint64(key[8:16]) & 0x0FFFFFFC0FFFFFFC
+	var h0, h1, h2 uint64
+
+	for len(msg) > 0 {
+		var block [16]byte
+		hibit := uint64(1)
+		if len(msg) >= 16 {
+			copy(block[:], msg[:16])
+			msg = msg[16:]
+		} else {
+			copy(block[:], msg)
+			block[len(msg)] = 1
+			hibit = 0
+			msg = nil
+		}
+		var c uint64
+		h0, c = bits.Add64(h0, binary.LittleEndian.Uint64(block[0:8]), 0)
+		h1, c = bits.Add64(h1, binary.LittleEndian.Uint64(block[8:16]), c)
+		h2 += c + hibit
+
+		// h *= r. r's clamping keeps h2*r below 2^64.
+		h0r0hi, h0r0lo := bits.Mul64(h0, r0)
+		h1r0hi, h1r0lo := bits.Mul64(h1, r0)
+		h0r1hi, h0r1lo := bits.Mul64(h0, r1)
+		h1r1hi, h1r1lo := bits.Mul64(h1, r1)
+		h2r0 := h2 * r0
+		h2r1 := h2 * r1
+
+		t0 := h0r0lo
+		t1, c := bits.Add64(h1r0lo, h0r1lo, 0)
+		t2, c2 := bits.Add64(h1r0hi, h0r1hi, c)
+		t1, c = bits.Add64(t1, h0r0hi, 0)
+		t2, c3 := bits.Add64(t2, h1r1lo, c)
+		t2, c4 := bits.Add64(t2, h2r0, 0)
+		t3 := h1r1hi + h2r1 + c2 + c3 + c4
+
+		// Reduce modulo 2^130-5: h = t mod 2^130 + 5*(t >> 130),
+		// computed as 4*(t>>130) + (t>>130).
+		h0, h1, h2 = t0, t1, t2&3
+		cclo, cchi := t2&^3, t3
+		h0, c = bits.Add64(h0, cclo, 0)
+		h1, c = bits.Add64(h1, cchi, c)
+		h2 += c
+		cclo, cchi = cclo>>2|cchi<<62, cchi>>2
+		h0, c = bits.Add64(h0, cclo, 0)
+		h1, c = bits.Add64(h1, cchi, c)
+		h2 += c
+	}
+
+	// Final reduction: subtract p = 2^130-5 if h >= p.
+	g0, b := bits.Sub64(h0, 0xFFFFFFFFFFFFFFFB, 0)
+	g1, b := bits.Sub64(h1, 0xFFFFFFFFFFFFFFFF, b)
+	_, b = bits.Sub64(h2, 3, b)
+	mask := b - 1 // all ones if h >= p
+	h0 = h0&^mask | g0&mask
+	h1 = h1&^mask | g1&mask
+
+	var c uint64
+	h0, c = bits.Add64(h0, binary.LittleEndian.Uint64(key[16:24]), 0)
+	h1, _ = bits.Add64(h1, binary.LittleEndian.Uint64(key[24:32]), c)
+	var tag [poly1305TagSize]byte
+	binary.LittleEndian.PutUint64(tag[0:8], h0)
+	binary.LittleEndian.PutUint64(tag[8:16], h1)
+	return tag
+}
+
+// aeadTag computes the ChaCha20-Poly1305 tag over aad and ciphertext.
+func aeadTag(key *[32]byte, nonce *[12]byte, ciphertext, aad []byte) [poly1305TagSize]byte {
+	var polyKey [32]byte
+	chacha20XOR(polyKey[:], polyKey[:], key, nonce, 0)
+	pad := func(n int) int { return (16 - n%16) % 16 }
+	mac := make([]byte, 0, len(aad)+pad(len(aad))+len(ciphertext)+pad(len(ciphertext))+16)
+	mac = append(mac, aad...)
+	mac = append(mac, make([]byte, pad(len(aad)))...)
+	mac = append(mac, ciphertext...)
+	mac = append(mac, make([]byte, pad(len(ciphertext)))...)
+	mac = binary.LittleEndian.AppendUint64(mac, uint64(len(aad)))
+	mac = binary.LittleEndian.AppendUint64(mac, uint64(len(ciphertext)))
+	return poly1305(&polyKey, mac)
+}
+
+// xchachaKey derives the ChaCha20 subkey and nonce for a 24-byte XChaCha20 nonce.
+func xchachaKey(key *[32]byte, nonce *[24]byte) (subkey [32]byte, n12 [12]byte) {
+	subkey = hchacha20(key, nonce[:16])
+	copy(n12[4:], nonce[16:])
+	return
+}
+
+// xchacha20poly1305Seal appends the encryption of plaintext and its tag to dst.
+func xchacha20poly1305Seal(dst []byte, key *[32]byte, nonce *[24]byte, plaintext, aad []byte) []byte {
+	subkey, n12 := xchachaKey(key, nonce)
+	off := len(dst)
+	dst = append(dst, plaintext...)
+	ct := dst[off:]
+	chacha20XOR(ct, ct, &subkey, &n12, 1)
+	tag := aeadTag(&subkey, &n12, ct, aad)
+	return append(dst, tag[:]...)
+}
+
+// xchacha20poly1305Open appends the decryption of ciphertext (including the
+// tag) to dst. It returns false if the tag does not verify.
+func xchacha20poly1305Open(dst []byte, key *[32]byte, nonce *[24]byte, ciphertext, aad []byte) ([]byte, bool) {
+	if len(ciphertext) < poly1305TagSize {
+		return dst, false
+	}
+	subkey, n12 := xchachaKey(key, nonce)
+	ct := ciphertext[:len(ciphertext)-poly1305TagSize]
+	tag := aeadTag(&subkey, &n12, ct, aad)
+	if subtle.ConstantTimeCompare(tag[:], ciphertext[len(ct):]) != 1 {
+		return dst, false
+	}
+	off := len(dst)
+	dst = append(dst, ct...)
+	chacha20XOR(dst[off:], dst[off:], &subkey, &n12, 1)
+	return dst, true
+}
@@ -0,0 +1,86 @@
+package awg
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func xchachaTestInput(n int) (key [32]byte, nonce [24]byte, data, aad []byte) {
+	for i := range key {
+		key[i] = byte(i * 7)
+	}
+	for i := range nonce {
+		nonce[i] = byte(0x40 + i)
+	}
+	data = make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	aad = []byte("additional data!")
+	return
+}
+
+func TestXChaCha20Poly1305SealMatchesReference(t *testing.T) {
+	// Lengths around the 16-byte Poly1305 block and 64-byte ChaCha20 block.
+	for _, n := range []int{0, 1, 15, 16, 17, 32, 63, 64, 65, 200} {
+		key, nonce, data, aad := xchachaTestInput(n)
+		ref, err := chacha20poly1305.NewX(key[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ref.Seal(nil, nonce[:], data, aad)
+		got := xchacha20poly1305Seal(nil, &key, &nonce, data, aad)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("len %d:\n  got  %x\n  want %x", n, got, want)
+		}
+	}
+}
+
+func TestXChaCha20Poly1305OpenReference(t *testing.T) {
+	key, nonce, data, aad := xchachaTestInput(16)
+	ref, _ := chacha20poly1305.NewX(key[:])
+	box := ref.Seal(nil, nonce[:], data, aad)
+
+	got, ok := xchacha20poly1305Open(nil, &key, &nonce, box, aad)
+	if !ok || !bytes.Equal(got, data) {
+		t.Fatalf("open failed: ok=%v got %x", ok, got)
+	}
+}
+
+func TestXChaCha20Poly1305OpenRejectsTampering(t *testing.T) {
+	key, nonce, data, aad := xchachaTestInput(16)
+	box := xchacha20poly1305Seal(nil, &key, &nonce, data, aad)
+
+	for i := range box {
+		bad := append([]byte(nil), box...)
+		bad[i] ^= 1
+		if _, ok := xchacha20poly1305Open(nil, &key, &nonce, bad, aad); ok {
+			t.Fatalf("tampered byte %d accepted", i)
+		}
+	}
+	if _, ok := xchacha20poly1305Open(nil, &key, &nonce, box, []byte("other aad")); ok {
+		t.Fatal("wrong AAD accepted")
+	}
+	if _, ok := xchacha20poly1305Open(nil, &key, &nonce, box[:10], aad); ok {
+		t.Fatal("short ciphertext accepted")
+	}
+}
+
+// TestPoly1305HighLimbs exercises the final reduction with all-ones input,
+// where h is close to 2^130-5.
+func TestPoly1305HighLimbs(t *testing.T) {
+	var key [32]byte
+	for i := range key {
+		key[i] = 0xff
+	}
+	var nonce [24]byte
+	data := bytes.Repeat([]byte{0xff}, 64)
+	ref, _ := chacha20poly1305.NewX(key[:])
+	want := ref.Seal(nil, nonce[:], data, data)
+	got := xchacha20poly1305Seal(nil, &key, &nonce, data, data)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got  %x\nwant %x", got, want)
+	}
+}
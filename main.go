@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/timbrs/amneziawg-mikrotik/internal/awg"
 )
@@ -17,6 +18,18 @@ import (
 var version = "dev"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "cps" {
+		os.Exit(runCPS(os.Args[2:]))
+	}
+
+	envFile := os.Getenv("AWG_ENV_FILE")
+	if err := loadEnvFile(envFile); err != nil {
+		_, _ = io.WriteString(os.Stderr, "FATAL: "+err.Error()+"\n")
+		os.Exit(1)
+	}
 	cfg, listenAddr, remoteAddr, err := parseEnv()
 	if err != nil {
 		_, _ = io.WriteString(os.Stderr, "FATAL: "+err.Error()+"\n")
@@ -61,7 +74,112 @@ func main() {
 	awg.LogInfo(cfg, "config: initTotal=", strconv.Itoa(cfg.S1+148),
 		" respTotal=", strconv.Itoa(cfg.S2+92), " cookieTotal=", strconv.Itoa(cfg.S3+64))
 
+	pathMTU := awg.DefaultPathMTU
+	if v := os.Getenv("AWG_PATH_MTU"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 576 || n > 65535 {
+			_, _ = io.WriteString(os.Stderr, "FATAL: AWG_PATH_MTU: expected 576..65535, got "+v+"\n")
+			os.Exit(1)
+		}
+		pathMTU = n
+	}
+	logMTU(cfg, pathMTU, "")
+	pmtuDiscover := os.Getenv("AWG_PMTU_DISCOVER") == "1"
+
+	switch os.Getenv("AWG_MODE") {
+	case "server":
+		os.Exit(runServer(cfg, nil, listenAddr, remoteAddr, pathMTU, pmtuDiscover))
+	case "bridge":
+		up, err := parseUpstreamEnv(cfg)
+		if err != nil {
+			_, _ = io.WriteString(os.Stderr, "FATAL: "+err.Error()+"\n")
+			os.Exit(1)
+		}
+		os.Exit(runServer(cfg, up, listenAddr, remoteAddr, pathMTU, pmtuDiscover))
+	}
+
+	pacing, err := parsePacingEnv()
+	if err != nil {
+		_, _ = io.WriteString(os.Stderr, "FATAL: "+err.Error()+"\n")
+		os.Exit(1)
+	}
+	retry, err := parseRetryEnv()
+	if err != nil {
+		_, _ = io.WriteString(os.Stderr, "FATAL: "+err.Error()+"\n")
+		os.Exit(1)
+	}
+
+	saveCPS, err := setupCPSCounter(cfg)
+	if err != nil {
+		_, _ = io.WriteString(os.Stderr, "FATAL: "+err.Error()+"\n")
+		os.Exit(1)
+	}
+
 	proxy := awg.NewProxy(cfg, listenAddr, remoteAddr)
+	switch v := os.Getenv("AWG_TRANSFORM"); v {
+	case "", "amneziawg":
+	case "passthrough":
+		// Без обфускации: для проверки, виновата ли сеть или параметры AWG.
+		proxy.SetTransformer(awg.PassthroughTransformer{})
+		awg.LogInfo(cfg, "transform: passthrough, packets are forwarded unchanged")
+	default:
+		_, _ = io.WriteString(os.Stderr, "FATAL: AWG_TRANSFORM: expected amneziawg or passthrough, got "+v+"\n")
+		os.Exit(1)
+	}
+	for idx, pol := range cfg.CPSPolicy {
+		if cfg.CPS[idx] != nil && pol != (awg.CPSPolicy{}) {
+			awg.LogInfo(cfg, "CPS I", strconv.Itoa(idx+1), " policy: ", pol.String())
+		}
+	}
+	if pacing != (awg.Pacing{}) {
+		proxy.SetPacing(pacing)
+		awg.LogInfo(cfg, "handshake pacing: ", pacing.String())
+	}
+	if retry.Window > 0 {
+		proxy.SetRetryPolicy(retry)
+		awg.LogInfo(cfg, "init retransmissions within ", retry.Window.String(), ": Jc=", strconv.Itoa(min(retry.Jc, cfg.Jc)),
+			" cps=", strconv.FormatBool(retry.CPS))
+	}
+	if pmtuDiscover {
+		proxy.SetPathMTUDiscovery(true)
+		awg.LogInfo(cfg, "path MTU discovery: enabled on the remote socket")
+	}
+	if os.Getenv("AWG_UDP_OFFLOAD") == "1" {
+		// Только Linux: без поддержки ядра остаются обычные recvmmsg/sendmmsg.
+		proxy.SetOffload(true)
+		awg.LogInfo(cfg, "UDP offload: GSO/GRO where the kernel supports it")
+	}
+	// Каждый поток обслуживает своих клиентов целиком: пакеты одного
+	// WireGuard-пира идут через один поток и не переставляются.
+	workers, err := parseWorkersEnv(cfg)
+	if err != nil {
+		_, _ = io.WriteString(os.Stderr, "FATAL: "+err.Error()+"\n")
+		os.Exit(1)
+	}
+	proxy.SetWorkers(workers)
+
+	var capture *awg.Capture
+	if path := os.Getenv("AWG_CAPTURE"); path != "" {
+		var maxSize int64
+		if v := os.Getenv("AWG_CAPTURE_SIZE"); v != "" {
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+				maxSize = n
+			}
+		}
+		files := 0
+		if v := os.Getenv("AWG_CAPTURE_FILES"); v != "" {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				files = n
+			}
+		}
+		capture, err = awg.OpenCapture(path, maxSize, files)
+		if err != nil {
+			_, _ = io.WriteString(os.Stderr, "FATAL: AWG_CAPTURE: "+err.Error()+"\n")
+			os.Exit(1)
+		}
+		proxy.SetCapture(capture)
+		awg.LogInfo(cfg, "capture: writing pcapng to ", path)
+	}
 
 	stop := make(chan struct{})
 	sigCh := make(chan os.Signal, 1)
@@ -73,12 +191,248 @@ func main() {
 		close(stop)
 	}()
 
-	if err := proxy.Run(stop); err != nil {
+	notifyStats(proxy)
+	if v := os.Getenv("AWG_STATS_INTERVAL"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			proxy.SetStatsInterval(time.Duration(n) * time.Second)
+			awg.LogInfo(cfg, "stats summary every ", v, "s")
+		}
+	}
+
+	if os.Getenv("AWG_DIAGNOSE") == "1" {
+		proxy.SetDiagnose(true)
+		awg.LogInfo(cfg, "diagnose mode: inferring S2/H2/S4/H4 from dropped inbound packets")
+	}
+
+	if os.Getenv("AWG_SESSION_FILTER") == "1" {
+		proxy.SetSessionFilter(true)
+		awg.LogInfo(cfg, "session filter: dropping inbound packets for unknown receiver indices")
+	}
+
+	if addr := os.Getenv("AWG_CONTROL"); addr != "" {
+		ln, err := awg.ListenControl(addr)
+		if err != nil {
+			_, _ = io.WriteString(os.Stderr, "FATAL: AWG_CONTROL: "+err.Error()+"\n")
+			os.Exit(1)
+		}
+		awg.LogInfo(cfg, "control socket: ", ln.Addr().String())
+		// reload заново читает AWG_ENV_FILE и окружение; адреса, режим и
+		// размеры буферов применяются только при перезапуске.
+		proxy.SetReload(func() (*awg.Config, error) {
+			if err := loadEnvFile(envFile); err != nil {
+				return nil, err
+			}
+			next, _, _, err := parseEnv()
+			return next, err
+		})
+		go proxy.ServeControl(ln, stop)
+	}
+
+	err = proxy.Run(stop)
+	saveCPS()
+	// os.Exit не выполняет defer: файл дампа закрывается явно.
+	if capture != nil {
+		capture.Close()
+	}
+	if err != nil {
 		_, _ = io.WriteString(os.Stderr, "FATAL: "+err.Error()+"\n")
 		os.Exit(1)
 	}
 }
 
+// statsLogger реализуют оба режима прокси (для обработчика SIGUSR1).
+type statsLogger interface {
+	LogStats()
+}
+
+// logMTU выводит рекомендуемый MTU интерфейса WireGuard для заданного MTU пути
+// и предупреждает о пакетах, которые в него не помещаются.
+func logMTU(cfg *awg.Config, pathMTU int, side string) {
+	awg.LogInfo(cfg, side, "mtu: recommended WireGuard MTU=", strconv.Itoa(cfg.RecommendedMTU(pathMTU)),
+		" (path MTU ", strconv.Itoa(pathMTU), ", S4=", strconv.Itoa(cfg.S4), ")")
+	for _, w := range cfg.MTUWarnings(pathMTU) {
+		awg.LogInfo(cfg, side, "mtu: warning: ", w)
+	}
+}
+
+// runServer запускает обратный режим (up == nil): приём AmneziaWG-клиентов
+// перед обычным WireGuard-сервером (AWG_REMOTE), или режим моста: клиентская
+// сторона с параметрами AWG_*, серверная -- с параметрами up. Возвращает код выхода.
+func runServer(cfg, up *awg.Config, listenAddr, remoteAddr *net.UDPAddr, pathMTU int, pmtuDiscover bool) int {
+	mode := "server"
+	var proxy *awg.ServerProxy
+	if up == nil {
+		awg.LogInfo(cfg, "server mode: accepting AmneziaWG clients, forwarding WireGuard to ", remoteAddr.String(),
+			", client keys=", strconv.Itoa(max(len(cfg.ClientPubs), 1)))
+		proxy = awg.NewServerProxy(cfg, listenAddr, remoteAddr)
+	} else {
+		mode = "bridge"
+		awg.LogInfo(cfg, "bridge mode: re-obfuscating AmneziaWG clients for ", remoteAddr.String(),
+			", client keys=", strconv.Itoa(max(len(cfg.ClientPubs), 1)))
+		awg.LogInfo(cfg, "upstream config: Jc=", strconv.Itoa(up.Jc), " S1=", strconv.Itoa(up.S1), " S2=", strconv.Itoa(up.S2),
+			" S3=", strconv.Itoa(up.S3), " S4=", strconv.Itoa(up.S4))
+		logMTU(up, pathMTU, "upstream ")
+		proxy = awg.NewBridgeProxy(cfg, up, listenAddr, remoteAddr)
+	}
+	if pmtuDiscover {
+		proxy.SetPathMTUDiscovery(true)
+		awg.LogInfo(cfg, "path MTU discovery: enabled on the server sockets")
+	}
+	workers, err := parseWorkersEnv(cfg)
+	if err != nil {
+		_, _ = io.WriteString(os.Stderr, "FATAL: "+err.Error()+"\n")
+		return 1
+	}
+	proxy.SetWorkers(workers)
+	for _, name := range [...]string{"AWG_CAPTURE", "AWG_CONTROL", "AWG_DIAGNOSE", "AWG_JUNK_GAP", "AWG_JUNK_JITTER", "AWG_INIT_DELAY", "AWG_RETRY_WINDOW", "AWG_SESSION_FILTER", "AWG_TRANSFORM", "AWG_UDP_OFFLOAD"} {
+		if os.Getenv(name) != "" {
+			awg.LogInfo(cfg, name, " is not supported in ", mode, " mode, ignored")
+		}
+	}
+	// Простаивающего клиента здесь нет: сессии создаются входящими пакетами.
+	policies, prefix := cfg.CPSPolicy, "AWG_I"
+	if up != nil {
+		policies, prefix = up.CPSPolicy, "AWG_UP_I"
+	}
+	for idx, pol := range policies {
+		if pol.Idle > 0 {
+			awg.LogInfo(cfg, prefix, strconv.Itoa(idx+1), "_POLICY: idle is not supported in ", mode, " mode, ignored")
+		}
+	}
+
+	cfgs := []*awg.Config{cfg}
+	if up != nil {
+		cfgs = append(cfgs, up)
+	}
+	saveCPS, err := setupCPSCounter(cfgs...)
+	if err != nil {
+		_, _ = io.WriteString(os.Stderr, "FATAL: "+err.Error()+"\n")
+		return 1
+	}
+
+	stop := make(chan struct{})
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-sigCh
+		awg.LogInfo(cfg, "shutting down")
+		close(stop)
+	}()
+
+	notifyStats(proxy)
+	if v := os.Getenv("AWG_STATS_INTERVAL"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			proxy.SetStatsInterval(time.Duration(n) * time.Second)
+		}
+	}
+
+	err = proxy.Run(stop)
+	saveCPS()
+	if err != nil {
+		_, _ = io.WriteString(os.Stderr, "FATAL: "+err.Error()+"\n")
+		return 1
+	}
+	return 0
+}
+
+// setupCPSCounter задаёт начальное значение счётчика тегов <c>
+// (AWG_CPS_COUNTER=random или число) и восстанавливает его из файла
+// AWG_CPS_STATE, если тот уже есть. Возвращает функцию, сохраняющую точные
+// значения счётчиков в этот файл при завершении.
+func setupCPSCounter(cfgs ...*awg.Config) (func(), error) {
+	switch v := os.Getenv("AWG_CPS_COUNTER"); v {
+	case "":
+	case "random":
+		for _, c := range cfgs {
+			c.SeedCPSCounter()
+		}
+	default:
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, &envError{msg: "AWG_CPS_COUNTER: expected random or 0..4294967295, got " + v}
+		}
+		for _, c := range cfgs {
+			c.SetCPSCounter(uint32(n))
+		}
+	}
+
+	path := os.Getenv("AWG_CPS_STATE")
+	if path == "" {
+		return func() {}, nil
+	}
+	restored, err := awg.LoadCPSState(path, cfgs...)
+	if err != nil {
+		return nil, &envError{msg: "AWG_CPS_STATE: " + err.Error()}
+	}
+	if restored {
+		awg.LogInfo(cfgs[0], "CPS counter restored from ", path, ": ", strconv.FormatUint(uint64(cfgs[0].CPSCounter()), 10))
+	}
+	// Во время работы файл сохраняется с запасом вперёд, чтобы после SIGKILL
+	// или пропадания питания значения <c> не повторялись.
+	if err := awg.ReserveCPSState(path, cfgs...); err != nil {
+		return nil, &envError{msg: "AWG_CPS_STATE: " + err.Error()}
+	}
+	return func() {
+		if err := awg.SaveCPSState(path, cfgs...); err != nil {
+			awg.LogError(cfgs[0], "AWG_CPS_STATE: ", err.Error())
+			return
+		}
+		awg.LogInfo(cfgs[0], "CPS counter saved to ", path, ": ", strconv.FormatUint(uint64(cfgs[0].CPSCounter()), 10))
+	}, nil
+}
+
+// envFileSet -- переменные, заданные AWG_ENV_FILE при прошлой загрузке, и их
+// значения до неё (nil -- переменной не было).
+var envFileSet = map[string]*string{}
+
+// loadEnvFile переносит строки KEY=VALUE из файла path в окружение. Пустые
+// строки и строки с # пропускаются. Переменные, которые файл задавал раньше,
+// сначала возвращаются к исходным значениям: удалённая из файла строка при
+// reload перестаёт действовать. Пустой path -- файла нет.
+func loadEnvFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return &envError{msg: "AWG_ENV_FILE: " + err.Error()}
+	}
+	env := map[string]string{}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return &envError{msg: "AWG_ENV_FILE: line " + strconv.Itoa(n+1) + ": expected KEY=VALUE"}
+		}
+		env[key] = strings.TrimSpace(value)
+	}
+	for key, orig := range envFileSet {
+		if orig == nil {
+			_ = os.Unsetenv(key)
+		} else {
+			_ = os.Setenv(key, *orig)
+		}
+	}
+	for key := range env {
+		if _, seen := envFileSet[key]; seen {
+			continue
+		}
+		if v, ok := os.LookupEnv(key); ok {
+			envFileSet[key] = &v
+		} else {
+			envFileSet[key] = nil
+		}
+	}
+	for key, value := range env {
+		_ = os.Setenv(key, value)
+	}
+	return nil
+}
+
 func parseEnv() (*awg.Config, *net.UDPAddr, *net.UDPAddr, error) {
 	var errs []string
 
@@ -98,6 +452,14 @@ func parseEnv() (*awg.Config, *net.UDPAddr, *net.UDPAddr, error) {
 	h4Str := getRequired("AWG_H4", el, "transport type (H4 from .conf)", "1234567893", &errs)
 	serverPubB64 := getRequired("AWG_SERVER_PUB", el, "server public key, base64 (PublicKey from .conf [Peer])", "AAAA...==", &errs)
 	clientPubB64 := getRequired("AWG_CLIENT_PUB", el, "client public key, base64 (derive via wg pubkey)", "BBBB...==", &errs)
+	serverMode := false
+	switch m := os.Getenv("AWG_MODE"); m {
+	case "", "client":
+	case "server", "bridge":
+		serverMode = true
+	default:
+		errs = append(errs, "AWG_MODE: expected client, server or bridge, got "+m)
+	}
 
 	// Fail early if any required vars are missing
 	if len(errs) > 0 {
@@ -139,12 +501,29 @@ func parseEnv() (*awg.Config, *net.UDPAddr, *net.UDPAddr, error) {
 		copy(cfg.ServerPub[:], b)
 	}
 
-	if b, err := base64.StdEncoding.DecodeString(clientPubB64); err != nil {
-		errs = append(errs, "AWG_CLIENT_PUB: invalid base64: "+err.Error())
-	} else if len(b) != 32 {
-		errs = append(errs, "AWG_CLIENT_PUB: must be 32 bytes, got "+strconv.Itoa(len(b)))
-	} else {
-		copy(cfg.ClientPub[:], b)
+	// В режиме сервера AWG_CLIENT_PUB — список ключей клиентов через запятую.
+	clientPubs := strings.Split(clientPubB64, ",")
+	if len(clientPubs) > 1 && !serverMode {
+		errs = append(errs, "AWG_CLIENT_PUB: several keys are only allowed with AWG_MODE=server or bridge")
+	}
+	for i, key := range clientPubs {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+		if err != nil {
+			errs = append(errs, "AWG_CLIENT_PUB: invalid base64: "+err.Error())
+			continue
+		}
+		if len(b) != 32 {
+			errs = append(errs, "AWG_CLIENT_PUB: must be 32 bytes, got "+strconv.Itoa(len(b)))
+			continue
+		}
+		var pub [32]byte
+		copy(pub[:], b)
+		if i == 0 {
+			cfg.ClientPub = pub
+		}
+		if serverMode {
+			cfg.ClientPubs = append(cfg.ClientPubs, pub)
+		}
 	}
 
 	// Optional v2 parameters.
@@ -156,13 +535,42 @@ func parseEnv() (*awg.Config, *net.UDPAddr, *net.UDPAddr, error) {
 	}
 	for idx, name := range [5]string{"AWG_I1", "AWG_I2", "AWG_I3", "AWG_I4", "AWG_I5"} {
 		if v := os.Getenv(name); v != "" {
-			tmpl, err := awg.ParseCPSTemplate(v)
+			tmpl, err := awg.ParseCPSValue(v)
 			if err != nil {
 				errs = append(errs, name+": "+err.Error())
 			} else {
 				cfg.CPS[idx] = tmpl
 			}
 		}
+		if v := os.Getenv(name + "_POLICY"); v != "" {
+			pol, err := awg.ParseCPSPolicy(v)
+			if err != nil {
+				errs = append(errs, name+"_POLICY: "+err.Error())
+			} else {
+				cfg.CPSPolicy[idx] = pol
+			}
+		}
+	}
+	if v := os.Getenv("AWG_JUNK_TEMPLATE"); v != "" {
+		tmpl, err := awg.ParseJunkTemplate(v)
+		if err != nil {
+			errs = append(errs, "AWG_JUNK_TEMPLATE: "+err.Error())
+		} else {
+			cfg.JunkTemplate = tmpl
+		}
+	}
+	for idx, name := range [4]string{"AWG_S1_TEMPLATE", "AWG_S2_TEMPLATE", "AWG_S3_TEMPLATE", "AWG_S4_TEMPLATE"} {
+		if v := os.Getenv(name); v != "" {
+			tmpl, err := awg.ParsePaddingTemplate(v)
+			if err != nil {
+				errs = append(errs, name+": "+err.Error())
+			} else {
+				cfg.Padding[idx] = tmpl
+			}
+		}
+	}
+	if err := cfg.JunkTemplate.CheckSizes(cfg.Jmin, cfg.Jmax); err != nil && cfg.Jc > 0 {
+		errs = append(errs, "AWG_JUNK_TEMPLATE: "+err.Error())
 	}
 
 	if len(errs) > 0 {
@@ -182,20 +590,259 @@ func parseEnv() (*awg.Config, *net.UDPAddr, *net.UDPAddr, error) {
 	}
 
 	cfg.LogLevel = awg.LevelInfo
-	switch os.Getenv("AWG_LOG_LEVEL") {
-	case "none":
-		cfg.LogLevel = awg.LevelNone
-	case "error":
-		cfg.LogLevel = awg.LevelError
-	case "info", "":
-		cfg.LogLevel = awg.LevelInfo
-	case "debug":
-		cfg.LogLevel = awg.LevelDebug
+	if level, ok := awg.ParseLogLevel(os.Getenv("AWG_LOG_LEVEL")); ok {
+		cfg.LogLevel = level
+	}
+
+	if v := os.Getenv("AWG_LOG_RATE"); v != "" {
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil || r < 0 {
+			return nil, nil, nil, &envError{msg: "AWG_LOG_RATE: expected non-negative number"}
+		}
+		if r == 0 {
+			// AWG_LOG_RATE=0 -- без ограничения; в Config это отрицательное
+			// значение, а 0 там означает значение по умолчанию.
+			r = -1
+		}
+		cfg.LogRate = r
+	}
+	if v := os.Getenv("AWG_LOG_BURST"); v != "" {
+		b, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, nil, nil, &envError{msg: "AWG_LOG_BURST: " + err.Error()}
+		}
+		cfg.LogBurst = b
 	}
 
 	return cfg, listenAddr, remoteAddr, nil
 }
 
+// parsePacingEnv читает задержки пакетов рукопожатия (в миллисекундах).
+// parseWorkersEnv читает AWG_WORKERS (1..64, по умолчанию 1) и предупреждает,
+// если потоков больше, чем GOMAXPROCS.
+func parseWorkersEnv(cfg *awg.Config) (int, error) {
+	v := os.Getenv("AWG_WORKERS")
+	if v == "" {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > 64 {
+		return 0, &envError{msg: "AWG_WORKERS: expected 1..64, got " + v}
+	}
+	if procs := runtime.GOMAXPROCS(0); n > procs {
+		awg.LogInfo(cfg, "AWG_WORKERS=", v, " exceeds GOMAXPROCS=", strconv.Itoa(procs), ", raise AWG_GOMAXPROCS to use more cores")
+	}
+	return n, nil
+}
+
+func parsePacingEnv() (awg.Pacing, error) {
+	var pacing awg.Pacing
+	var errs []string
+	for _, f := range [...]struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"AWG_JUNK_GAP", &pacing.Gap}, {"AWG_JUNK_JITTER", &pacing.Jitter}, {"AWG_INIT_DELAY", &pacing.InitDelay},
+	} {
+		if v := os.Getenv(f.name); v != "" {
+			ms := collectInt(f.name, v, &errs)
+			if ms < 0 || ms > 1000 {
+				errs = append(errs, f.name+": expected 0..1000 ms, got "+v)
+			}
+			*f.dst = time.Duration(ms) * time.Millisecond
+		}
+	}
+	if len(errs) > 0 {
+		return awg.Pacing{}, &envError{msg: buildErrorMsg(errs)}
+	}
+	return pacing, nil
+}
+
+// parseRetryEnv читает политику для повторных init: AWG_RETRY_WINDOW (секунды),
+// AWG_RETRY_JC и AWG_RETRY_CPS.
+func parseRetryEnv() (awg.RetryPolicy, error) {
+	var rp awg.RetryPolicy
+	var errs []string
+	if v := os.Getenv("AWG_RETRY_WINDOW"); v != "" {
+		sec := collectInt("AWG_RETRY_WINDOW", v, &errs)
+		if sec < 0 {
+			errs = append(errs, "AWG_RETRY_WINDOW: expected seconds >= 0, got "+v)
+		}
+		rp.Window = time.Duration(sec) * time.Second
+	}
+	if v := os.Getenv("AWG_RETRY_JC"); v != "" {
+		rp.Jc = collectInt("AWG_RETRY_JC", v, &errs)
+		if rp.Jc < 0 {
+			errs = append(errs, "AWG_RETRY_JC: expected >= 0, got "+v)
+		}
+	}
+	rp.CPS = os.Getenv("AWG_RETRY_CPS") == "1"
+	if len(errs) > 0 {
+		return awg.RetryPolicy{}, &envError{msg: buildErrorMsg(errs)}
+	}
+	return rp, nil
+}
+
+// parseUpstreamEnv собирает параметры серверной стороны для режима моста:
+// AWG_UP_* переопределяют соответствующие AWG_*, остальные берутся из cfg.
+func parseUpstreamEnv(cfg *awg.Config) (*awg.Config, error) {
+	var errs []string
+	up := &awg.Config{
+		Jc: cfg.Jc, Jmin: cfg.Jmin, Jmax: cfg.Jmax,
+		S1: cfg.S1, S2: cfg.S2, S3: cfg.S3, S4: cfg.S4,
+		H1: cfg.H1, H2: cfg.H2, H3: cfg.H3, H4: cfg.H4,
+		CPS:          cfg.CPS,
+		CPSPolicy:    cfg.CPSPolicy,
+		JunkTemplate: cfg.JunkTemplate,
+		Padding:      cfg.Padding,
+		ServerPub:    cfg.ServerPub,
+	}
+	for _, f := range [...]struct {
+		name string
+		dst  *int
+	}{
+		{"AWG_UP_JC", &up.Jc}, {"AWG_UP_JMIN", &up.Jmin}, {"AWG_UP_JMAX", &up.Jmax},
+		{"AWG_UP_S1", &up.S1}, {"AWG_UP_S2", &up.S2}, {"AWG_UP_S3", &up.S3}, {"AWG_UP_S4", &up.S4},
+	} {
+		if v := os.Getenv(f.name); v != "" {
+			*f.dst = collectInt(f.name, v, &errs)
+		}
+	}
+	for _, f := range [...]struct {
+		name string
+		dst  *awg.HRange
+	}{
+		{"AWG_UP_H1", &up.H1}, {"AWG_UP_H2", &up.H2}, {"AWG_UP_H3", &up.H3}, {"AWG_UP_H4", &up.H4},
+	} {
+		if v := os.Getenv(f.name); v != "" {
+			*f.dst = collectHRange(f.name, v, &errs)
+		}
+	}
+	for idx, name := range [5]string{"AWG_UP_I1", "AWG_UP_I2", "AWG_UP_I3", "AWG_UP_I4", "AWG_UP_I5"} {
+		if v := os.Getenv(name); v != "" {
+			tmpl, err := awg.ParseCPSValue(v)
+			if err != nil {
+				errs = append(errs, name+": "+err.Error())
+			} else {
+				up.CPS[idx] = tmpl
+			}
+		}
+		if v := os.Getenv(name + "_POLICY"); v != "" {
+			pol, err := awg.ParseCPSPolicy(v)
+			if err != nil {
+				errs = append(errs, name+"_POLICY: "+err.Error())
+			} else {
+				up.CPSPolicy[idx] = pol
+			}
+		}
+	}
+	if v := os.Getenv("AWG_UP_JUNK_TEMPLATE"); v != "" {
+		tmpl, err := awg.ParseJunkTemplate(v)
+		if err != nil {
+			errs = append(errs, "AWG_UP_JUNK_TEMPLATE: "+err.Error())
+		} else {
+			up.JunkTemplate = tmpl
+		}
+	}
+	for idx, name := range [4]string{"AWG_UP_S1_TEMPLATE", "AWG_UP_S2_TEMPLATE", "AWG_UP_S3_TEMPLATE", "AWG_UP_S4_TEMPLATE"} {
+		if v := os.Getenv(name); v != "" {
+			tmpl, err := awg.ParsePaddingTemplate(v)
+			if err != nil {
+				errs = append(errs, name+": "+err.Error())
+			} else {
+				up.Padding[idx] = tmpl
+			}
+		}
+	}
+	if err := up.JunkTemplate.CheckSizes(up.Jmin, up.Jmax); err != nil && up.Jc > 0 {
+		errs = append(errs, "AWG_UP_JUNK_TEMPLATE: "+err.Error())
+	}
+	if len(errs) > 0 {
+		return nil, &envError{msg: buildErrorMsg(errs)}
+	}
+	up.ComputeMAC1Keys()
+	up.ComputeFastPath()
+	return up, nil
+}
+
+// runCtl implements "awg-proxy ctl [-s addr] <command> [args]": it sends one
+// command to the control socket of a running proxy and prints the reply.
+func runCtl(args []string) int {
+	addr := os.Getenv("AWG_CONTROL")
+	if len(args) >= 2 && args[0] == "-s" {
+		addr = args[1]
+		args = args[2:]
+	}
+	if addr == "" || len(args) == 0 {
+		_, _ = io.WriteString(os.Stderr, "usage: awg-proxy ctl [-s addr] <command> [args]\n"+
+			"  addr defaults to $AWG_CONTROL\n"+
+			"  commands: "+awg.ControlCommands+"\n")
+		return 2
+	}
+	reply, err := awg.ControlRequest(addr, strings.Join(args, " "))
+	if err != nil {
+		_, _ = io.WriteString(os.Stderr, "ctl: "+err.Error()+"\n")
+		return 1
+	}
+	_, _ = io.WriteString(os.Stdout, reply)
+	if strings.HasPrefix(reply, "error:") {
+		return 1
+	}
+	return 0
+}
+
+// runCPS выполняет "awg-proxy cps render": показывает, что отправит CPS-шаблон.
+// Код возврата 1 -- ошибка в шаблоне, 2 -- неверные аргументы.
+func runCPS(args []string) int {
+	usage := func() int {
+		_, _ = io.WriteString(os.Stderr, "usage: awg-proxy cps render <template|@preset:name> [-n samples] [-mtu path_mtu]\n")
+		return 2
+	}
+	if len(args) == 0 || args[0] != "render" {
+		return usage()
+	}
+	samples, pathMTU, tmpl := 3, awg.DefaultPathMTU, ""
+	for i := 1; i < len(args); i++ {
+		switch args[i] {
+		case "-n", "-mtu":
+			if i+1 == len(args) {
+				return usage()
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 || args[i] == "-mtu" && n < 576 {
+				return usage()
+			}
+			if args[i] == "-n" {
+				samples = n
+			} else {
+				pathMTU = n
+			}
+			i++
+		default:
+			if tmpl != "" {
+				return usage()
+			}
+			tmpl = args[i]
+		}
+	}
+	if tmpl == "" {
+		return usage()
+	}
+
+	report, err := awg.RenderCPS(tmpl, samples, pathMTU)
+	if err != nil {
+		msg := "error: " + err.Error() + "\n"
+		// Указываем на место ошибки в шаблоне.
+		if perr, ok := err.(*awg.CPSError); ok {
+			msg += "  " + tmpl + "\n  " + strings.Repeat(" ", perr.Pos) + "^\n"
+		}
+		_, _ = io.WriteString(os.Stderr, msg)
+		return 1
+	}
+	_, _ = io.WriteString(os.Stdout, report)
+	return 0
+}
+
 func getRequired(name, envList, hint, example string, errs *[]string) string {
 	v := os.Getenv(name)
 	if v == "" {
@@ -0,0 +1,6 @@
+//go:build !unix
+
+package main
+
+// notifyStats is a no-op where SIGUSR1 does not exist.
+func notifyStats(_ statsLogger) {}